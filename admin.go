@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"helper/v3/diagnostics"
+	"helper/v3/models"
+	"net/http"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// checkAdmin verifies the admin token sent in the Authorization header.
+func (a *app) checkAdmin(token string) error {
+	if a.adminToken == "" {
+		return huma.Error501NotImplemented("the admin endpoints are disabled on this server")
+	}
+	token = strings.TrimPrefix(token, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) != 1 {
+		return huma.Error401Unauthorized("invalid admin token")
+	}
+	return nil
+}
+
+// metricsHandler serves the expvar variables, including the parser failure
+// counters, to the holders of the admin token. It is not a Huma operation, so
+// its errors are written as problems here, like those of the API.
+func (a *app) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := a.checkAdmin(r.Header.Get("Authorization")); err != nil {
+			writeProblem(w, err)
+			return
+		}
+		expvar.Handler().ServeHTTP(w, r)
+	})
+}
+
+// writeProblem writes err as the problem body Huma would send for it.
+func writeProblem(w http.ResponseWriter, err error) {
+	var p *problem
+	if !errors.As(err, &p) {
+		p = newProblem(http.StatusInternalServerError, err.Error()).(*problem)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.GetStatus())
+	json.NewEncoder(w).Encode(p)
+}
+
+// addAdminRoutes registers the endpoints reserved to the holders of the
+// admin token.
+func (a *app) addAdminRoutes(api huma.API) {
+	// List Parser Captures
+	register(api, huma.Operation{
+		OperationID: "listParserCaptures",
+		Method:      http.MethodGet,
+		Path:        "/admin/diagnostics",
+		Summary:     "List Parser Captures",
+		Description: "List the redacted Pepal pages the parsers could not read, one per parser and page structure, most recent first, with the failure counters since the server started. A capture with drift has a structure that was not acknowledged, hinting at a change of the Pepal templates.",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer youradmintoken" doc:"Admin token"`
+	}) (*models.ParseCapturesOutput, error) {
+		if err := a.checkAdmin(input.Token); err != nil {
+			return nil, err
+		}
+		resp := &models.ParseCapturesOutput{}
+		resp.Body.Parsers = a.diagnostics.Stats()
+		resp.Body.Captures = a.diagnostics.Captures()
+		return resp, nil
+	})
+
+	// Get Parser Capture
+	register(api, huma.Operation{
+		OperationID: "getParserCapture",
+		Method:      http.MethodGet,
+		Path:        "/admin/diagnostics/{id}",
+		Summary:     "Get Parser Capture",
+		Description: "Get a capture with its first redacted page",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer youradmintoken" doc:"Admin token"`
+		ID    string `path:"id" example:"courses-3f2a9c0d1e4b5a67" doc:"Capture ID"`
+	}) (*models.ParseCaptureOutput, error) {
+		if err := a.checkAdmin(input.Token); err != nil {
+			return nil, err
+		}
+		capture, err := a.diagnostics.Capture(input.ID)
+		if err != nil {
+			return nil, diagnosticsError(err)
+		}
+		resp := &models.ParseCaptureOutput{}
+		resp.Body = capture
+		return resp, nil
+	})
+
+	// Acknowledge Page Structure
+	register(api, huma.Operation{
+		OperationID: "acknowledgeParserFingerprint",
+		Method:      http.MethodPut,
+		Path:        "/admin/diagnostics/fingerprints/{fingerprint}",
+		Summary:     "Acknowledge Page Structure",
+		Description: "Mark the pages of a captured structure as expected, such as a Pepal maintenance page: their failures stop counting as drift",
+	}, func(ctx context.Context, input *struct {
+		Token       string `header:"Authorization" example:"Bearer youradmintoken" doc:"Admin token"`
+		Fingerprint string `path:"fingerprint" example:"3f2a9c0d1e4b5a67" doc:"Page structure fingerprint"`
+		Body        struct {
+			Note string `json:"note,omitempty" maxLength:"200" example:"Page de maintenance" doc:"Why the page is expected"`
+		}
+	}) (*models.GenericOutput, error) {
+		if err := a.checkAdmin(input.Token); err != nil {
+			return nil, err
+		}
+		if err := a.diagnostics.Acknowledge(input.Fingerprint, input.Body.Note); err != nil {
+			return nil, diagnosticsError(err)
+		}
+		resp := &models.GenericOutput{}
+		resp.Body.Message = "Page structure acknowledged"
+		return resp, nil
+	})
+}
+
+func diagnosticsError(err error) error {
+	if errors.Is(err, diagnostics.ErrNotFound) {
+		return huma.Error404NotFound(err.Error())
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"helper/v3/controllers"
+	"helper/v3/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// maxCalendarDays bounds the period a calendar query can span.
+const maxCalendarDays = 366
+
+// addCalendarRoutes registers the calendar resource.
+func (a *app) addCalendarRoutes(api huma.API) {
+	// Get Calendar
+	register(api, huma.Operation{
+		OperationID: "getCalendar",
+		Method:      http.MethodGet,
+		Path:        "/calendar/{calUUID}",
+		Summary:     "Get Calendar",
+		Description: "Get the schedule for the week, or for the period selected with from/to, week or month",
+		Middlewares: huma.Middlewares{withTimeout(30 * time.Second)},
+	}, func(ctx context.Context, input *struct {
+		CalUUID string `path:"calUUID" pattern:"^[0-9a-fA-F]{32}$" example:"49caac7c643b4be6817db60be4374ee7" doc:"Calendar UUID"`
+		From    string `query:"from" format:"date" example:"2024-06-10" doc:"First day, used with to"`
+		To      string `query:"to" format:"date" example:"2024-06-30" doc:"Last day, used with from"`
+		Week    int    `query:"week" example:"1" doc:"Week offset from the current week (1 for next week, -1 for the previous one)"`
+		Month   string `query:"month" pattern:"^[0-9]{4}-[0-9]{2}$" example:"2024-06" doc:"Month (YYYY-MM)"`
+	}) (*models.CalendarOutput, error) {
+		dateRange, err := a.calendarRange(input.From, input.To, input.Week, input.Month)
+		if err != nil {
+			return nil, err
+		}
+		return a.calendar(ctx, input.CalUUID, dateRange)
+	})
+
+	// Get Calendar Changes
+	register(api, huma.Operation{
+		OperationID: "getCalendarChanges",
+		Method:      http.MethodGet,
+		Path:        "/calendar/{calUUID}/changes",
+		Summary:     "Get Calendar Changes",
+		Description: "Get the events added, removed or changed (room, professor, time slot) between the successive downloads of the calendar. Changes are found from the second download on.",
+	}, func(ctx context.Context, input *struct {
+		CalUUID string `path:"calUUID" pattern:"^[0-9a-fA-F]{32}$" example:"49caac7c643b4be6817db60be4374ee7" doc:"Calendar UUID"`
+		Since   string `query:"since" format:"date-time" example:"2024-06-10T08:00:00+02:00" doc:"Only return the changes found after this time"`
+	}) (*models.CalendarChangesOutput, error) {
+		var since time.Time
+		if input.Since != "" {
+			var err error
+			since, err = time.Parse(time.RFC3339, input.Since)
+			if err != nil {
+				return nil, huma.Error422UnprocessableEntity("invalid since time", err)
+			}
+		}
+		resp := &models.CalendarChangesOutput{}
+		resp.Body.Changes = []models.CalendarChange{}
+		for _, change := range a.changes.Changes(input.CalUUID) {
+			if change.DetectedAt.After(since) {
+				resp.Body.Changes = append(resp.Body.Changes, change)
+			}
+		}
+		return resp, nil
+	})
+
+	// Watch Calendar
+	register(api, huma.Operation{
+		OperationID: "watchCalendar",
+		Method:      http.MethodPut,
+		Path:        "/calendar/{calUUID}/watch",
+		Summary:     "Watch Calendar",
+		Description: "Notify the session user of the changes of the calendar, which is then downloaded regularly",
+	}, func(ctx context.Context, input *struct {
+		Token   string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		CalUUID string `path:"calUUID" pattern:"^[0-9a-fA-F]{32}$" example:"49caac7c643b4be6817db60be4374ee7" doc:"Calendar UUID"`
+	}) (*models.CalendarWatchOutput, error) {
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.changes.Watch(ctx, session.Username, input.CalUUID); err != nil {
+			return nil, err
+		}
+		return a.calendarWatch(session.Username, input.CalUUID), nil
+	})
+
+	// Stop Watching Calendar
+	register(api, huma.Operation{
+		OperationID: "unwatchCalendar",
+		Method:      http.MethodDelete,
+		Path:        "/calendar/{calUUID}/watch",
+		Summary:     "Stop Watching Calendar",
+		Description: "Stop notifying the session user of the changes of the calendar",
+	}, func(ctx context.Context, input *struct {
+		Token   string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		CalUUID string `path:"calUUID" pattern:"^[0-9a-fA-F]{32}$" example:"49caac7c643b4be6817db60be4374ee7" doc:"Calendar UUID"`
+	}) (*models.CalendarWatchOutput, error) {
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.changes.Unwatch(session.Username, input.CalUUID); err != nil {
+			return nil, err
+		}
+		return a.calendarWatch(session.Username, input.CalUUID), nil
+	})
+}
+
+// calendarWatch reports whether a user watches a calendar.
+func (a *app) calendarWatch(username, calUUID string) *models.CalendarWatchOutput {
+	resp := &models.CalendarWatchOutput{}
+	resp.Body.CalUUID = strings.ToLower(calUUID)
+	resp.Body.Watched = a.changes.Watching(username, calUUID)
+	return resp
+}
+
+// calendar returns the events of a calendar within dateRange.
+func (a *app) calendar(ctx context.Context, calUUID string, dateRange controllers.DateRange) (*models.CalendarOutput, error) {
+	events, err := a.pepal.FetchCalendarRange(ctx, calUUID, dateRange)
+	if err != nil {
+		return nil, err
+	}
+	resp := &models.CalendarOutput{}
+	resp.Body.From = dateRange.From.Format("2006-01-02")
+	resp.Body.To = dateRange.To.Format("2006-01-02")
+	resp.Body.Schedule = events
+	return resp, nil
+}
+
+// calendarRange resolves the period selected by a calendar query: from and
+// to when given, else the month, else the week at the given offset from the
+// current one.
+func (a *app) calendarRange(from, to string, week int, month string) (controllers.DateRange, error) {
+	loc := a.pepal.Location
+	now := time.Now().In(loc)
+
+	switch {
+	case from != "" || to != "":
+		if from == "" || to == "" {
+			return controllers.DateRange{}, huma.Error422UnprocessableEntity("from and to must be given together")
+		}
+		fromDay, err := time.ParseInLocation("2006-01-02", from, loc)
+		if err != nil {
+			return controllers.DateRange{}, huma.Error422UnprocessableEntity("invalid from date", err)
+		}
+		toDay, err := time.ParseInLocation("2006-01-02", to, loc)
+		if err != nil {
+			return controllers.DateRange{}, huma.Error422UnprocessableEntity("invalid to date", err)
+		}
+		if toDay.Before(fromDay) {
+			return controllers.DateRange{}, huma.Error422UnprocessableEntity("to must not be before from")
+		}
+		dateRange := controllers.NewDateRange(fromDay, toDay)
+		if dateRange.Days() > maxCalendarDays {
+			return controllers.DateRange{}, huma.Error422UnprocessableEntity("the period cannot exceed a year")
+		}
+		return dateRange, nil
+	case month != "":
+		first, err := time.ParseInLocation("2006-01", month, loc)
+		if err != nil {
+			return controllers.DateRange{}, huma.Error422UnprocessableEntity("invalid month", err)
+		}
+		return controllers.MonthRange(first.Year(), first.Month(), loc), nil
+	default:
+		return controllers.WeekRange(now, week), nil
+	}
+}
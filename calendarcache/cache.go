@@ -0,0 +1,210 @@
+// Package calendarcache caches the calendar feeds downloaded from Pepal, in
+// memory and in a Storage backend. Expired entries are revalidated with a
+// conditional GET, concurrent requests for the same calendar share a single
+// download, and the last known copy is served when Pepal is unreachable.
+package calendarcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Entry is a cached calendar feed and the validators Pepal sent with it.
+type Entry struct {
+	Content      []byte    `json:"-"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// FetchFunc downloads a calendar. When previous is not nil, its validators
+// are sent and a nil entry with a nil error means the feed has not changed.
+type FetchFunc func(ctx context.Context, calUUID string, previous *Entry) (*Entry, error)
+
+// call is a download in progress, shared by the requests waiting for it.
+type call struct {
+	done  chan struct{}
+	entry *Entry
+	err   error
+}
+
+// Cache holds the calendar feeds by calendar UUID. It is safe for concurrent
+// use.
+type Cache struct {
+	// OnChange, when set, is called with every feed downloaded with a
+	// content differing from the cached one, including the first download.
+	// It must be set before the cache is used.
+	OnChange func(calUUID string, content []byte)
+
+	fetch   FetchFunc
+	ttl     time.Duration
+	timeout time.Duration
+	storage Storage
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	calls   map[string]*call
+}
+
+// New returns a cache keeping the feeds fresh for ttl. The feeds are also
+// written to storage and reloaded from it after a restart.
+func New(fetch FetchFunc, ttl time.Duration, storage Storage) *Cache {
+	return &Cache{
+		fetch:   fetch,
+		ttl:     ttl,
+		timeout: 30 * time.Second,
+		storage: storage,
+		entries: make(map[string]*Entry),
+		calls:   make(map[string]*call),
+	}
+}
+
+// Get returns the feed of a calendar, downloading or revalidating it when it
+// is missing or older than the TTL.
+func (c *Cache) Get(ctx context.Context, calUUID string) ([]byte, error) {
+	calUUID, err := NormalizeUUID(calUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[calUUID]
+	if ok && time.Since(entry.FetchedAt) < c.ttl {
+		c.mu.Unlock()
+		return entry.Content, nil
+	}
+
+	current, ok := c.calls[calUUID]
+	if !ok {
+		current = &call{done: make(chan struct{})}
+		c.calls[calUUID] = current
+		// The download is shared, so it must not be cancelled along with
+		// the request that happened to start it.
+		go c.refresh(context.WithoutCancel(ctx), calUUID, entry, current)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-current.done:
+	}
+
+	if current.err != nil {
+		return nil, current.err
+	}
+	return current.entry.Content, nil
+}
+
+// refresh downloads or revalidates a feed and wakes up the waiting requests.
+// A feed missing from memory is first looked up in the storage. The storage
+// is only accessed from here, without holding c.mu, so a slow disk does not
+// block the other calendars.
+func (c *Cache) refresh(ctx context.Context, calUUID string, previous *Entry, current *call) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	if previous == nil {
+		previous = c.load(calUUID)
+		if previous != nil && time.Since(previous.FetchedAt) < c.ttl {
+			c.finish(calUUID, previous, nil, current)
+			return
+		}
+	}
+
+	entry, err := c.fetch(ctx, calUUID, previous)
+	switch {
+	case err != nil && previous != nil:
+		log.Warn().Err(err).Str("calUUID", calUUID).Msg("Calendar download failed, serving the cached copy")
+		entry, err = previous, nil
+	case err == nil && entry == nil && previous == nil:
+		err = errors.New("calendar download returned no content")
+	case err == nil && entry == nil:
+		// Not modified: keep the content and restart the TTL
+		revalidated := *previous
+		revalidated.FetchedAt = time.Now()
+		entry = &revalidated
+	}
+
+	if err == nil && entry != previous {
+		c.save(calUUID, entry)
+	}
+	c.finish(calUUID, entry, err, current)
+
+	changed := err == nil && (previous == nil || !bytes.Equal(previous.Content, entry.Content))
+	if changed && c.OnChange != nil {
+		c.OnChange(calUUID, entry.Content)
+	}
+}
+
+// finish keeps the result of a refresh and wakes up the waiting requests.
+func (c *Cache) finish(calUUID string, entry *Entry, err error, current *call) {
+	c.mu.Lock()
+	if err == nil {
+		c.entries[calUUID] = entry
+	}
+	delete(c.calls, calUUID)
+	c.mu.Unlock()
+
+	current.entry, current.err = entry, err
+	close(current.done)
+}
+
+// Expire drops the calendars fetched more than maxAge ago, from memory and
+// from the storage.
+func (c *Cache) Expire(maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+
+	c.mu.Lock()
+	for calUUID, entry := range c.entries {
+		if entry.FetchedAt.Before(cutoff) {
+			delete(c.entries, calUUID)
+		}
+	}
+	c.mu.Unlock()
+	return c.storage.Expire(cutoff)
+}
+
+// RunJanitor expires the calendars older than maxAge every interval until
+// ctx is cancelled.
+func (c *Cache) RunJanitor(ctx context.Context, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		count, err := c.Expire(maxAge)
+		if err != nil {
+			log.Error().Err(err).Msg("Error expiring cached calendars")
+		} else if count > 0 {
+			log.Info().Int("count", count).Msg("Expired cached calendars")
+		}
+	}
+}
+
+// load returns the stored entry of a calendar, or nil if there is none or
+// it cannot be read.
+func (c *Cache) load(calUUID string) *Entry {
+	entry, err := c.storage.Load(calUUID)
+	if err != nil {
+		log.Error().Err(err).Str("calUUID", calUUID).Msg("Error reading calendar cache")
+		return nil
+	}
+	return entry
+}
+
+// save writes an entry to the storage, logging failures since the memory
+// copy is enough to serve requests.
+func (c *Cache) save(calUUID string, entry *Entry) {
+	if err := c.storage.Save(calUUID, entry); err != nil {
+		log.Error().Err(err).Str("calUUID", calUUID).Msg("Error writing calendar cache")
+	}
+}
@@ -0,0 +1,183 @@
+package calendarcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testUUID = "49caac7c643b4be6817db60be4374ee7"
+
+// upstream is a counting FetchFunc serving a feed with an ETag, and
+// answering as a 304 when it is sent back.
+type upstream struct {
+	mu      sync.Mutex
+	content string
+	etag    string
+	err     error
+	// release, when set, holds the downloads until it is closed.
+	release chan struct{}
+
+	fetches     atomic.Int32
+	revalidated atomic.Int32
+}
+
+func (u *upstream) fetch(ctx context.Context, calUUID string, previous *Entry) (*Entry, error) {
+	u.fetches.Add(1)
+	if u.release != nil {
+		<-u.release
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err != nil {
+		return nil, u.err
+	}
+	if previous != nil && previous.ETag == u.etag {
+		u.revalidated.Add(1)
+		return nil, nil
+	}
+	return &Entry{Content: []byte(u.content), ETag: u.etag, FetchedAt: time.Now()}, nil
+}
+
+func (u *upstream) set(content, etag string, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.content, u.etag, u.err = content, etag, err
+}
+
+func get(t *testing.T, c *Cache) string {
+	t.Helper()
+	content, err := c.Get(context.Background(), testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestRevalidation(t *testing.T) {
+	u := &upstream{content: "v1", etag: `"1"`}
+	// Every Get finds the entry expired
+	c := New(u.fetch, time.Nanosecond, NewMemoryStorage())
+	// OnChange runs once the waiting requests are answered
+	changes := make(chan string, 10)
+	c.OnChange = func(calUUID string, content []byte) { changes <- string(content) }
+
+	if content := get(t, c); content != "v1" {
+		t.Errorf("first download = %q", content)
+	}
+	if content := get(t, c); content != "v1" || u.revalidated.Load() != 1 {
+		t.Errorf("revalidation = %q, %d not modified answers", content, u.revalidated.Load())
+	}
+
+	u.set("v2", `"2"`, nil)
+	if content := get(t, c); content != "v2" {
+		t.Errorf("download after a change = %q", content)
+	}
+	for _, want := range []string{"v1", "v2"} {
+		select {
+		case content := <-changes:
+			if content != want {
+				t.Errorf("OnChange content = %q, want %q", content, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnChange not called with %q", want)
+		}
+	}
+	if len(changes) != 0 {
+		t.Errorf("OnChange called for an unchanged feed")
+	}
+	if n := u.fetches.Load(); n != 3 {
+		t.Errorf("%d fetches, want 3", n)
+	}
+}
+
+func TestConcurrentGetsShareOneFetch(t *testing.T) {
+	u := &upstream{content: "v1", etag: `"1"`, release: make(chan struct{})}
+	c := New(u.fetch, time.Hour, NewMemoryStorage())
+
+	var wg sync.WaitGroup
+	results := make([]string, 20)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content, err := c.Get(context.Background(), testUUID)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = string(content)
+		}()
+	}
+	// The requests arriving once the download finished find the entry fresh
+	close(u.release)
+	wg.Wait()
+
+	if n := u.fetches.Load(); n != 1 {
+		t.Errorf("%d fetches for concurrent requests, want 1", n)
+	}
+	for i, content := range results {
+		if content != "v1" {
+			t.Errorf("request %d = %q", i, content)
+		}
+	}
+}
+
+func TestCanceledRequestDoesNotCancelTheFetch(t *testing.T) {
+	u := &upstream{content: "v1", etag: `"1"`, release: make(chan struct{})}
+	c := New(u.fetch, time.Hour, NewMemoryStorage())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Get(ctx, testUUID); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled request: err = %v", err)
+	}
+	close(u.release)
+	if content := get(t, c); content != "v1" || u.fetches.Load() != 1 {
+		t.Errorf("request after the canceled one = %q with %d fetches", content, u.fetches.Load())
+	}
+}
+
+func TestStaleEntryServedWhenUpstreamFails(t *testing.T) {
+	u := &upstream{err: errors.New("Pepal is down")}
+	c := New(u.fetch, time.Nanosecond, NewMemoryStorage())
+
+	if _, err := c.Get(context.Background(), testUUID); err == nil {
+		t.Error("a calendar never downloaded was served while Pepal is down")
+	}
+
+	u.set("v1", `"1"`, nil)
+	get(t, c)
+	u.set("v2", `"2"`, errors.New("Pepal is down"))
+	if content := get(t, c); content != "v1" {
+		t.Errorf("content while Pepal is down = %q, want the cached copy", content)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	u := &upstream{content: "v1", etag: `"1"`}
+	storage := NewMemoryStorage()
+	c := New(u.fetch, time.Hour, storage)
+
+	get(t, c)
+	get(t, c)
+	if n := u.fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches within the TTL, want 1", n)
+	}
+
+	// A restarted cache reloads the fresh entry from the storage
+	restarted := New(u.fetch, time.Hour, storage)
+	if content := get(t, restarted); content != "v1" || u.fetches.Load() != 1 {
+		t.Errorf("after a restart: %q with %d fetches", content, u.fetches.Load())
+	}
+
+	// Past the TTL, the entry is revalidated
+	c.mu.Lock()
+	c.entries[testUUID].FetchedAt = time.Now().Add(-2 * time.Hour)
+	c.mu.Unlock()
+	if content := get(t, c); content != "v1" || u.fetches.Load() != 2 || u.revalidated.Load() != 1 {
+		t.Errorf("past the TTL: %q with %d fetches, %d revalidated", content, u.fetches.Load(), u.revalidated.Load())
+	}
+}
@@ -0,0 +1,185 @@
+package calendarcache
+
+import (
+	"encoding/json"
+	"errors"
+	"helper/v3/atomicfile"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ErrInvalidUUID is returned for calendar UUIDs that are not 32 hexadecimal
+// digits, which could otherwise escape the storage directory or the Pepal
+// calendar URL.
+var ErrInvalidUUID = errors.New("invalid calendar UUID")
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// NormalizeUUID validates a calendar UUID strictly: 32 lower-case
+// hexadecimal digits, as Pepal writes them. Any other spelling is refused
+// rather than rewritten, so a UUID names a single calendar directory.
+func NormalizeUUID(calUUID string) (string, error) {
+	if !uuidPattern.MatchString(calUUID) {
+		return "", ErrInvalidUUID
+	}
+	return calUUID, nil
+}
+
+// Storage persists the cached calendars. The UUIDs it receives have been
+// validated with NormalizeUUID.
+type Storage interface {
+	// Load returns the stored entry of a calendar, or nil if there is none.
+	Load(calUUID string) (*Entry, error)
+	// Save stores the entry of a calendar, replacing the previous one.
+	Save(calUUID string, entry *Entry) error
+	// Expire deletes the entries fetched before cutoff and returns how many
+	// were deleted.
+	Expire(cutoff time.Time) (int, error)
+}
+
+// MemoryStorage keeps the calendars in memory only, for read-only
+// filesystems. Its content is lost on restart.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{entries: make(map[string]Entry)}
+}
+
+func (s *MemoryStorage) Load(calUUID string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[calUUID]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (s *MemoryStorage) Save(calUUID string, entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[calUUID] = *entry
+	return nil
+}
+
+func (s *MemoryStorage) Expire(cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for calUUID, entry := range s.entries {
+		if entry.FetchedAt.Before(cutoff) {
+			delete(s.entries, calUUID)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// DiskStorage keeps each calendar in its own directory, named after its UUID
+// and readable by the service only. Files are written atomically, so
+// concurrent readers never see a partial feed.
+type DiskStorage struct {
+	dir string
+}
+
+// NewDiskStorage returns a DiskStorage rooted at dir.
+func NewDiskStorage(dir string) *DiskStorage {
+	return &DiskStorage{dir: dir}
+}
+
+func (s *DiskStorage) Load(calUUID string) (*Entry, error) {
+	dir, err := s.calendarDir(calUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := os.ReadFile(filepath.Join(dir, "meta.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "calendar.ics"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{Content: content}
+	if err := json.Unmarshal(meta, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *DiskStorage) Save(calUUID string, entry *Entry) error {
+	dir, err := s.calendarDir(calUUID)
+	if err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// The metadata is written last: an entry only exists once it is complete
+	if err := atomicfile.WriteFile(filepath.Join(dir, "calendar.ics"), entry.Content, 0o700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, "meta.json"), meta, 0o700)
+}
+
+func (s *DiskStorage) Expire(cutoff time.Time) (int, error) {
+	dirs, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, d := range dirs {
+		if !d.IsDir() || !uuidPattern.MatchString(d.Name()) {
+			continue
+		}
+		entry, err := s.Load(d.Name())
+		if err != nil {
+			continue
+		}
+		fetchedAt := time.Time{}
+		if entry != nil {
+			fetchedAt = entry.FetchedAt
+		} else if info, err := d.Info(); err == nil {
+			// Incomplete entry, possibly being written: judge it by its age
+			fetchedAt = info.ModTime()
+		}
+		if !fetchedAt.Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.dir, d.Name())); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// calendarDir returns the directory of a calendar, refusing any UUID that
+// does not pass validation.
+func (s *DiskStorage) calendarDir(calUUID string) (string, error) {
+	if !uuidPattern.MatchString(calUUID) {
+		return "", ErrInvalidUUID
+	}
+	return filepath.Join(s.dir, calUUID), nil
+}
@@ -0,0 +1,152 @@
+package calendarcache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeUUID(t *testing.T) {
+	if calUUID, err := NormalizeUUID(testUUID); err != nil || calUUID != testUUID {
+		t.Errorf("NormalizeUUID(%q) = %q, %v", testUUID, calUUID, err)
+	}
+	for _, calUUID := range []string{
+		"",
+		"../x",
+		"../" + testUUID[3:],
+		testUUID[:31] + "/",
+		strings.ToUpper(testUUID),
+		testUUID[:31],
+		testUUID + "0",
+		" " + testUUID,
+		testUUID[:31] + "g",
+		testUUID[:16] + "-" + testUUID[17:],
+	} {
+		if _, err := NormalizeUUID(calUUID); !errors.Is(err, ErrInvalidUUID) {
+			t.Errorf("NormalizeUUID(%q): err = %v, want ErrInvalidUUID", calUUID, err)
+		}
+	}
+}
+
+func TestInvalidUUID(t *testing.T) {
+	u := &upstream{content: "v1"}
+	c := New(u.fetch, time.Hour, NewMemoryStorage())
+	if _, err := c.Get(context.Background(), "../../etc/passwd"); !errors.Is(err, ErrInvalidUUID) {
+		t.Errorf("err = %v, want ErrInvalidUUID", err)
+	}
+	if n := u.fetches.Load(); n != 0 {
+		t.Errorf("%d fetches for an invalid UUID", n)
+	}
+
+	// The storage refuses them too, whoever calls it
+	storage := NewDiskStorage(t.TempDir())
+	if err := storage.Save("../x", &Entry{Content: []byte("x")}); !errors.Is(err, ErrInvalidUUID) {
+		t.Errorf("Save outside the directory: err = %v", err)
+	}
+	if _, err := storage.Load("../x"); !errors.Is(err, ErrInvalidUUID) {
+		t.Errorf("Load outside the directory: err = %v", err)
+	}
+}
+
+// testStorage checks the behaviour shared by the Storage backends.
+func testStorage(t *testing.T, storage Storage) {
+	other := strings.Repeat("0", 32)
+	if entry, err := storage.Load(testUUID); entry != nil || err != nil {
+		t.Errorf("Load of a missing calendar = %+v, %v", entry, err)
+	}
+
+	fetchedAt := time.Date(2024, 6, 13, 9, 0, 0, 0, time.UTC)
+	saved := &Entry{Content: []byte("BEGIN:VCALENDAR"), ETag: `"1"`, LastModified: "Thu, 13 Jun 2024 07:00:00 GMT", FetchedAt: fetchedAt}
+	if err := storage.Save(testUUID, saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Save(other, &Entry{Content: []byte("old"), FetchedAt: fetchedAt.Add(-48 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := storage.Load(testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Content) != string(saved.Content) || entry.ETag != saved.ETag ||
+		entry.LastModified != saved.LastModified || !entry.FetchedAt.Equal(fetchedAt) {
+		t.Errorf("Load = %+v, want %+v", entry, saved)
+	}
+
+	// Only the calendars fetched before the cutoff are evicted
+	count, err := storage.Expire(fetchedAt.Add(-time.Hour))
+	if err != nil || count != 1 {
+		t.Errorf("Expire = %d, %v, want 1", count, err)
+	}
+	if entry, _ := storage.Load(other); entry != nil {
+		t.Error("the expired calendar is still stored")
+	}
+	if entry, _ := storage.Load(testUUID); entry == nil {
+		t.Error("the fresh calendar was expired")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage())
+}
+
+func TestDiskStorage(t *testing.T) {
+	dir := t.TempDir()
+	testStorage(t, NewDiskStorage(dir))
+
+	// The feed and its metadata are kept apart, readable by the service only
+	for _, name := range []string{"calendar.ics", "meta.json"} {
+		info, err := os.Stat(filepath.Join(dir, testUUID, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm&0o077 != 0 {
+			t.Errorf("%s permissions = %v", name, perm)
+		}
+	}
+	meta, err := os.ReadFile(filepath.Join(dir, testUUID, "meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(meta), "BEGIN:VCALENDAR") || !strings.Contains(string(meta), `"etag"`) {
+		t.Errorf("meta.json = %s", meta)
+	}
+
+	// A calendar without its metadata is incomplete: it is not loaded, and
+	// it is evicted by its age
+	incomplete := strings.Repeat("1", 32)
+	if err := os.MkdirAll(filepath.Join(dir, incomplete), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, incomplete, "calendar.ics"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	storage := NewDiskStorage(dir)
+	if entry, err := storage.Load(incomplete); entry != nil || err != nil {
+		t.Errorf("Load of an incomplete calendar = %+v, %v", entry, err)
+	}
+	if count, err := storage.Expire(time.Now().Add(-time.Hour)); err != nil || count != 1 {
+		t.Errorf("Expire = %d, %v, want the calendar of 2024 only", count, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, incomplete)); err != nil {
+		t.Errorf("a calendar being written was expired: %v", err)
+	}
+	if count, err := storage.Expire(time.Now().Add(time.Hour)); err != nil || count != 1 {
+		t.Errorf("Expire of the old incomplete calendar = %d, %v", count, err)
+	}
+
+	// Other files of the directory are left alone
+	if err := os.WriteFile(filepath.Join(dir, "README"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Expire(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "README")); err != nil {
+		t.Errorf("a file outside the calendars was removed: %v", err)
+	}
+}
@@ -0,0 +1,432 @@
+// Package calendarwatch keeps the last parse of each watched calendar and
+// compares every new download with it, reporting the events added, removed
+// or moved to another room, professor or time slot. Users watching a
+// calendar are notified of its changes.
+package calendarwatch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"helper/v3/atomicfile"
+	"helper/v3/calendarcache"
+	"helper/v3/controllers"
+	"helper/v3/models"
+	"helper/v3/notify"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxChangesPerCalendar bounds the changes kept for each calendar.
+const maxChangesPerCalendar = 200
+
+// snapshot is the last parse of a calendar, from the day it was taken on.
+type snapshot struct {
+	Hash      string         `json:"hash"`
+	Events    []models.Event `json:"events"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// state is what the watcher persists between restarts.
+type state struct {
+	Snapshots map[string]snapshot                `json:"snapshots"`
+	Changes   map[string][]models.CalendarChange `json:"changes"`
+	// Watchers holds the users notified of the changes of each calendar.
+	Watchers map[string][]string `json:"watchers"`
+}
+
+// Watcher compares the successive downloads of the calendars. It is safe for
+// concurrent use.
+type Watcher struct {
+	// Notifier, when set, is told about the changes of the watched
+	// calendars.
+	Notifier notify.Notifier
+
+	pepal *controllers.PepalClient
+	path  string
+
+	// updating serialises the updates, so concurrent downloads of a
+	// calendar do not report its changes twice.
+	updating sync.Mutex
+	mu       sync.Mutex
+	state    state
+}
+
+// New returns a watcher persisting its state at path, loading the state left
+// by a previous run if any.
+func New(pepal *controllers.PepalClient, path string) (*Watcher, error) {
+	w := &Watcher{
+		pepal: pepal,
+		path:  path,
+		state: state{
+			Snapshots: make(map[string]snapshot),
+			Changes:   make(map[string][]models.CalendarChange),
+			Watchers:  make(map[string][]string),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading calendar watcher state: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &w.state); err != nil {
+			return nil, fmt.Errorf("error decoding calendar watcher state: %v", err)
+		}
+	}
+	// Drop the calendars nobody watches any more
+	for calUUID := range w.state.Snapshots {
+		if len(w.state.Watchers[calUUID]) == 0 {
+			w.forget(calUUID)
+		}
+	}
+	return w, nil
+}
+
+// Update compares a download of a watched calendar with the previous one and
+// records the changes of the events from today on. The first download of a
+// calendar only becomes the reference for the next ones, and the calendars
+// nobody watches are ignored, so the anonymous downloads are not kept. It can
+// be used as the OnChange hook of the calendar cache.
+func (w *Watcher) Update(calUUID string, content []byte) {
+	calUUID, err := calendarcache.NormalizeUUID(calUUID)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	w.updating.Lock()
+	defer w.updating.Unlock()
+
+	w.mu.Lock()
+	previous, known := w.state.Snapshots[calUUID]
+	watched := len(w.state.Watchers[calUUID]) > 0
+	w.mu.Unlock()
+	if !watched || (known && previous.Hash == hash) {
+		return
+	}
+
+	events, err := controllers.ParseCalendar(string(content), w.pepal.Location)
+	if err != nil {
+		log.Error().Err(err).Str("calUUID", calUUID).Msg("Error parsing calendar for change detection")
+		return
+	}
+	now := time.Now().In(w.pepal.Location)
+	today := now.Format("2006-01-02")
+	events = upcoming(events, today)
+
+	var changes []models.CalendarChange
+	if known {
+		changes = Diff(upcoming(previous.Events, today), events, now)
+	}
+
+	w.mu.Lock()
+	if len(w.state.Watchers[calUUID]) == 0 {
+		// Unwatched while it was parsed
+		w.mu.Unlock()
+		return
+	}
+	w.state.Snapshots[calUUID] = snapshot{Hash: hash, Events: events, UpdatedAt: now}
+	if len(changes) > 0 {
+		all := append(w.state.Changes[calUUID], changes...)
+		if len(all) > maxChangesPerCalendar {
+			all = all[len(all)-maxChangesPerCalendar:]
+		}
+		w.state.Changes[calUUID] = all
+	}
+	watchers := append([]string(nil), w.state.Watchers[calUUID]...)
+	err = w.save()
+	w.mu.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msg("Error saving calendar watcher state")
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+	log.Info().Str("calUUID", calUUID).Int("changes", len(changes)).Msg("Calendar changes found")
+	if w.Notifier == nil {
+		return
+	}
+	for _, username := range watchers {
+		w.Notifier.Notify(notification(username, calUUID, changes))
+	}
+}
+
+// Changes returns the changes found on a calendar, oldest first.
+func (w *Watcher) Changes(calUUID string) []models.CalendarChange {
+	calUUID = strings.ToLower(calUUID)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]models.CalendarChange(nil), w.state.Changes[calUUID]...)
+}
+
+// Watch notifies a user of the changes of a calendar. The first watcher of a
+// calendar downloads it, as the reference its changes are found against.
+func (w *Watcher) Watch(ctx context.Context, username, calUUID string) error {
+	calUUID, err := calendarcache.NormalizeUUID(calUUID)
+	if err != nil {
+		return err
+	}
+	if w.Watching(username, calUUID) {
+		return nil
+	}
+	content, err := w.pepal.FetchCalendar(ctx, calUUID)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	if !slices.Contains(w.state.Watchers[calUUID], username) {
+		w.state.Watchers[calUUID] = append(w.state.Watchers[calUUID], username)
+	}
+	err = w.save()
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// A no-op when the calendar already has this reference
+	w.Update(calUUID, content)
+	return nil
+}
+
+// Unwatch stops notifying a user of the changes of a calendar.
+func (w *Watcher) Unwatch(username, calUUID string) error {
+	calUUID = strings.ToLower(calUUID)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watchers := w.state.Watchers[calUUID]
+	for i, watcher := range watchers {
+		if watcher == username {
+			watchers = append(watchers[:i], watchers[i+1:]...)
+			if len(watchers) == 0 {
+				delete(w.state.Watchers, calUUID)
+				w.forget(calUUID)
+			} else {
+				w.state.Watchers[calUUID] = watchers
+			}
+			return w.save()
+		}
+	}
+	return nil
+}
+
+// Watching reports whether a user is notified of the changes of a calendar.
+func (w *Watcher) Watching(username, calUUID string) bool {
+	calUUID = strings.ToLower(calUUID)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, watcher := range w.state.Watchers[calUUID] {
+		if watcher == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Run downloads the watched calendars every interval until ctx is
+// cancelled, so their changes are found even when nobody reads them.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		calUUIDs := make([]string, 0, len(w.state.Watchers))
+		for calUUID := range w.state.Watchers {
+			calUUIDs = append(calUUIDs, calUUID)
+		}
+		w.mu.Unlock()
+
+		for _, calUUID := range calUUIDs {
+			content, err := w.pepal.FetchCalendar(ctx, calUUID)
+			if err != nil {
+				log.Error().Err(err).Str("calUUID", calUUID).Msg("Error fetching watched calendar")
+				continue
+			}
+			// A no-op when the cache already reported this content
+			w.Update(calUUID, content)
+		}
+	}
+}
+
+// upcoming returns the events from day on.
+func upcoming(events []models.Event, day string) []models.Event {
+	filtered := []models.Event{}
+	for _, event := range events {
+		if event.Day >= day {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
+
+// slot returns the time slot of an event.
+func slot(event models.Event) string {
+	switch {
+	case event.FullDay:
+		return "full_day"
+	case event.Morning:
+		return "morning"
+	case event.Afternoon:
+		return "afternoon"
+	}
+	return ""
+}
+
+// Diff compares two parses of a calendar. Events are paired by UID, then by
+// day and subject, in the same time slot first; a pair whose subject, room,
+// professor or time differs is a changed event, and the events left unpaired
+// are added or removed.
+func Diff(previous, current []models.Event, at time.Time) []models.CalendarChange {
+	paired := make([]bool, len(previous))
+	matched := make([]int, len(current))
+	for i := range matched {
+		matched[i] = -1
+	}
+
+	pair := func(same func(old, event models.Event) bool) {
+		for i, event := range current {
+			if matched[i] >= 0 {
+				continue
+			}
+			for j, old := range previous {
+				if !paired[j] && same(old, event) {
+					paired[j] = true
+					matched[i] = j
+					break
+				}
+			}
+		}
+	}
+	pair(func(old, event models.Event) bool {
+		return old.UID != "" && old.UID == event.UID
+	})
+	pair(func(old, event models.Event) bool {
+		return old.Day == event.Day && old.Subject == event.Subject && slot(old) == slot(event)
+	})
+	pair(func(old, event models.Event) bool {
+		return old.Day == event.Day && old.Subject == event.Subject
+	})
+
+	var changes []models.CalendarChange
+	for i := range current {
+		event := current[i]
+		if matched[i] < 0 {
+			changes = append(changes, models.CalendarChange{Type: models.CalendarEventAdded, Day: event.Day, Event: &event, DetectedAt: at})
+			continue
+		}
+		old := previous[matched[i]]
+		var fields []string
+		if old.Subject != event.Subject {
+			fields = append(fields, "subject")
+		}
+		if old.Room != event.Room || old.Remote != event.Remote {
+			fields = append(fields, "location")
+		}
+		if old.Professor != event.Professor {
+			fields = append(fields, "professor")
+		}
+		if slot(old) != slot(event) || !old.Start.Equal(event.Start) || !old.End.Equal(event.End) {
+			fields = append(fields, "time")
+		}
+		if len(fields) > 0 {
+			changes = append(changes, models.CalendarChange{
+				Type: models.CalendarEventChanged, Day: event.Day, Event: &event, Previous: &old, Fields: fields, DetectedAt: at,
+			})
+		}
+	}
+	for j := range previous {
+		if !paired[j] {
+			old := previous[j]
+			changes = append(changes, models.CalendarChange{Type: models.CalendarEventRemoved, Day: old.Day, Previous: &old, DetectedAt: at})
+		}
+	}
+	return changes
+}
+
+// notification summarises the changes of a calendar for a user.
+func notification(username, calUUID string, changes []models.CalendarChange) notify.Notification {
+	var lines []string
+	for _, change := range changes {
+		switch change.Type {
+		case models.CalendarEventAdded:
+			lines = append(lines, fmt.Sprintf("%s : %s ajouté", change.Day, change.Event.Subject))
+		case models.CalendarEventRemoved:
+			lines = append(lines, fmt.Sprintf("%s : %s supprimé", change.Day, change.Previous.Subject))
+		case models.CalendarEventChanged:
+			var details []string
+			for _, field := range change.Fields {
+				switch field {
+				case "subject":
+					details = append(details, fmt.Sprintf("matière %s → %s", change.Previous.Subject, change.Event.Subject))
+				case "location":
+					details = append(details, fmt.Sprintf("salle %s → %s", place(*change.Previous), place(*change.Event)))
+				case "professor":
+					details = append(details, fmt.Sprintf("professeur %s → %s", change.Previous.Professor, change.Event.Professor))
+				case "time":
+					details = append(details, fmt.Sprintf("horaire %s → %s", timeLabel(*change.Previous), timeLabel(*change.Event)))
+				}
+			}
+			lines = append(lines, fmt.Sprintf("%s : %s, %s", change.Day, change.Event.Subject, strings.Join(details, ", ")))
+		}
+	}
+
+	return notify.Notification{
+		Kind:     notify.KindCalendarChanged,
+		Username: username,
+		Title:    "Changements dans l'emploi du temps",
+		Message:  strings.Join(lines, "\n"),
+		Data:     map[string]any{"calUUID": calUUID, "changes": changes},
+	}
+}
+
+// timeLabel describes when an event takes place, with its times when the
+// feed gives them.
+func timeLabel(event models.Event) string {
+	if event.Start.IsZero() || event.FullDay {
+		return map[string]string{"full_day": "journée", "morning": "matin", "afternoon": "après-midi"}[slot(event)] + " du " + event.Day
+	}
+	return event.Start.Format("02/01 15:04") + "-" + event.End.Format("15:04")
+}
+
+// place returns the room of an event, or "distanciel" for a remote one.
+func place(event models.Event) string {
+	if event.Remote || event.Room == "" {
+		return "distanciel"
+	}
+	return event.Room
+}
+
+// forget drops the reference and the changes of a calendar nobody watches.
+// The caller must hold w.mu.
+func (w *Watcher) forget(calUUID string) {
+	delete(w.state.Snapshots, calUUID)
+	delete(w.state.Changes, calUUID)
+}
+
+// save writes the state to disk. The caller must hold w.mu.
+func (w *Watcher) save() error {
+	data, err := json.MarshalIndent(w.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(w.path, data, 0o700); err != nil {
+		return fmt.Errorf("error writing calendar watcher state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package calendarwatch
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"helper/v3/controllers"
+	"helper/v3/models"
+	"helper/v3/pepaltest"
+)
+
+var paris = func() *time.Location {
+	loc, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}()
+
+// course returns a course of June 2024 from hour to hour+3, in the morning
+// before noon and in the afternoon after.
+func course(day, hour int, subject, room, professor string) models.Event {
+	start := time.Date(2024, 6, day, hour, 0, 0, 0, paris)
+	end := start.Add(3 * time.Hour)
+	return models.Event{
+		Type:      models.EventCourse,
+		Day:       start.Format("2006-01-02"),
+		Start:     start,
+		End:       end,
+		Duration:  180,
+		Morning:   hour < 12,
+		Afternoon: hour >= 12,
+		Location:  room,
+		Room:      room,
+		Professor: professor,
+		Subject:   subject,
+	}
+}
+
+// change is the part of a CalendarChange the tests compare.
+type change struct {
+	Type     models.CalendarChangeType
+	Day      string
+	Subject  string
+	Previous string
+	Fields   []string
+}
+
+func summarise(changes []models.CalendarChange) []change {
+	summary := []change{}
+	for _, c := range changes {
+		s := change{Type: c.Type, Day: c.Day, Fields: c.Fields}
+		if c.Event != nil {
+			s.Subject = c.Event.Subject
+		}
+		if c.Previous != nil {
+			s.Previous = c.Previous.Subject
+		}
+		summary = append(summary, s)
+	}
+	return summary
+}
+
+func TestDiff(t *testing.T) {
+	golang := course(10, 9, "GOLANG", "E 210", "John DOE")
+	java := course(10, 14, "JAVA", "E 104", "Jane ROE")
+
+	moved := golang
+	moved.Location, moved.Room = "E 212", "E 212"
+	remote := golang
+	remote.Location, remote.Room, remote.Remote = "", "", true
+	// Only the spaces of the feed text changed
+	respaced := golang
+	respaced.Location = " E  210 "
+	golangRoe, javaDoe := golang, java
+	golangRoe.Professor, javaDoe.Professor = java.Professor, golang.Professor
+	later := course(10, 14, "GOLANG", "E 210", "John DOE")
+	shifted := golang
+	shifted.Start, shifted.End = golang.Start.Add(30*time.Minute), golang.End.Add(30*time.Minute)
+	nextDay := course(11, 9, "GOLANG", "E 210", "John DOE")
+
+	// The same subject twice on the same day
+	golangAfternoon := course(10, 14, "GOLANG", "E 210", "John DOE")
+	golangAfternoonMoved := golangAfternoon
+	golangAfternoonMoved.Location, golangAfternoonMoved.Room = "E 212", "E 212"
+
+	withUID := func(e models.Event, uid string) models.Event {
+		e.UID = uid
+		return e
+	}
+	renamed := withUID(golang, "c1")
+	renamed.Subject = "GO AVANCÉ"
+
+	for name, test := range map[string]struct {
+		previous, current []models.Event
+		want              []change
+	}{
+		"unchanged": {
+			previous: []models.Event{golang, java},
+			current:  []models.Event{golang, java},
+			want:     []change{},
+		},
+		"room": {
+			previous: []models.Event{golang, java},
+			current:  []models.Event{moved, java},
+			want:     []change{{models.CalendarEventChanged, "2024-06-10", "GOLANG", "GOLANG", []string{"location"}}},
+		},
+		"remote": {
+			previous: []models.Event{golang},
+			current:  []models.Event{remote},
+			want:     []change{{models.CalendarEventChanged, "2024-06-10", "GOLANG", "GOLANG", []string{"location"}}},
+		},
+		"room spacing": {
+			previous: []models.Event{golang},
+			current:  []models.Event{respaced},
+			want:     []change{},
+		},
+		"professor swap": {
+			previous: []models.Event{golang, java},
+			current:  []models.Event{golangRoe, javaDoe},
+			want: []change{
+				{models.CalendarEventChanged, "2024-06-10", "GOLANG", "GOLANG", []string{"professor"}},
+				{models.CalendarEventChanged, "2024-06-10", "JAVA", "JAVA", []string{"professor"}},
+			},
+		},
+		"other slot": {
+			previous: []models.Event{golang},
+			current:  []models.Event{later},
+			want:     []change{{models.CalendarEventChanged, "2024-06-10", "GOLANG", "GOLANG", []string{"time"}}},
+		},
+		"time shift in the slot": {
+			previous: []models.Event{golang},
+			current:  []models.Event{shifted},
+			want:     []change{{models.CalendarEventChanged, "2024-06-10", "GOLANG", "GOLANG", []string{"time"}}},
+		},
+		"added": {
+			previous: []models.Event{golang},
+			current:  []models.Event{golang, java},
+			want:     []change{{models.CalendarEventAdded, "2024-06-10", "JAVA", "", nil}},
+		},
+		"removed": {
+			previous: []models.Event{golang, java},
+			current:  []models.Event{java},
+			want:     []change{{models.CalendarEventRemoved, "2024-06-10", "", "GOLANG", nil}},
+		},
+		"moved to another day": {
+			previous: []models.Event{golang},
+			current:  []models.Event{nextDay},
+			want: []change{
+				{models.CalendarEventAdded, "2024-06-11", "GOLANG", "", nil},
+				{models.CalendarEventRemoved, "2024-06-10", "", "GOLANG", nil},
+			},
+		},
+		"same subject twice, one moved": {
+			previous: []models.Event{golang, golangAfternoon},
+			current:  []models.Event{golang, golangAfternoonMoved},
+			want:     []change{{models.CalendarEventChanged, "2024-06-10", "GOLANG", "GOLANG", []string{"location"}}},
+		},
+		"same subject twice, listed in another order": {
+			previous: []models.Event{golang, golangAfternoon},
+			current:  []models.Event{golangAfternoon, golang},
+			want:     []change{},
+		},
+		"same subject twice, one removed": {
+			previous: []models.Event{golang, golangAfternoon},
+			current:  []models.Event{golangAfternoon},
+			want:     []change{{models.CalendarEventRemoved, "2024-06-10", "", "GOLANG", nil}},
+		},
+		"same subject twice, one added": {
+			previous: []models.Event{golangAfternoon},
+			current:  []models.Event{golang, golangAfternoon},
+			want:     []change{{models.CalendarEventAdded, "2024-06-10", "GOLANG", "", nil}},
+		},
+		"renamed with the same UID": {
+			previous: []models.Event{withUID(golang, "c1")},
+			current:  []models.Event{renamed},
+			want:     []change{{models.CalendarEventChanged, "2024-06-10", "GO AVANCÉ", "GOLANG", []string{"subject"}}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			changes := Diff(test.previous, test.current, time.Now())
+			if got := summarise(changes); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("changes = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	// The removed one of the same subject twice is the one of its slot
+	changes := Diff([]models.Event{golang, golangAfternoon}, []models.Event{golangAfternoon}, time.Now())
+	if len(changes) != 1 || !changes[0].Previous.Morning {
+		t.Errorf("removed = %+v, want the morning course", changes)
+	}
+}
+
+// TestWatcherOnlyKeepsWatchedCalendars checks that the downloads of the
+// calendars nobody watches are not kept, and that a calendar is forgotten
+// with its last watcher.
+func TestWatcherOnlyKeepsWatchedCalendars(t *testing.T) {
+	const calUUID = "49caac7c643b4be6817db60be4374ee7"
+	fake := pepaltest.NewServer()
+	defer fake.Close()
+	start := time.Now().In(paris).Add(24 * time.Hour).Truncate(time.Hour)
+	event := pepaltest.Event{UID: "c1", Summary: "GOLANG", Location: "E 210", Professor: "John DOE", Start: start, End: start.Add(3 * time.Hour)}
+	fake.SetCalendar(calUUID, pepaltest.Calendar(event))
+
+	path := filepath.Join(t.TempDir(), "calendar-watch.json")
+	w, err := New(controllers.NewPepalClient(fake.URL, fake.Client()), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots := func() int {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.state.Snapshots)
+	}
+
+	// An anonymous download
+	w.Update(calUUID, []byte(pepaltest.Calendar(event)))
+	if n := snapshots(); n != 0 {
+		t.Fatalf("%d calendars kept without watcher", n)
+	}
+
+	// Watching takes the reference, and the next download is compared with it
+	if err := w.Watch(context.Background(), "jdoe", calUUID); err != nil {
+		t.Fatal(err)
+	}
+	if n := snapshots(); n != 1 {
+		t.Fatalf("%d calendars kept with a watcher", n)
+	}
+	event.Location = "E 212"
+	w.Update(calUUID, []byte(pepaltest.Calendar(event)))
+	if changes := w.Changes(calUUID); len(changes) != 1 || changes[0].Fields[0] != "location" {
+		t.Errorf("changes = %+v", changes)
+	}
+
+	// The last watcher leaving forgets the calendar, also after a restart
+	if err := w.Unwatch("jdoe", calUUID); err != nil {
+		t.Fatal(err)
+	}
+	if n := snapshots(); n != 0 || len(w.Changes(calUUID)) != 0 {
+		t.Errorf("calendar kept after its last watcher left: %d snapshots", n)
+	}
+	if w, err = New(controllers.NewPepalClient(fake.URL, fake.Client()), path); err != nil || snapshots() != 0 {
+		t.Errorf("calendar kept after a restart: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+// Command fakepepal runs the fake Pepal of the pepaltest package as a
+// standalone server, for developing a frontend without a Pepal account. Point
+// the helper at it with PEPAL_BASE_URL=http://localhost:8081/.
+//
+// The demo user has a morning course whose roll call is open, an afternoon
+// course whose roll call has not opened yet, a few grades and a calendar for
+// the current week.
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"time"
+
+	"helper/v3/models"
+	"helper/v3/pepaltest"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// demoCalendar is the UUID of the calendar of the demo user.
+const demoCalendar = "49caac7c643b4be6817db60be4374ee7"
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8081", "listen address")
+	username := flag.String("user", "demo", "username of the demo user")
+	password := flag.String("password", "demo", "password of the demo user")
+	gzip := flag.Bool("gzip", false, "gzip every response, as Pepal does")
+	sessionTTL := flag.Duration("session-ttl", time.Hour, "lifetime of the sdv cookies")
+	flag.Parse()
+
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "02/01/2006 15:04:05"})
+
+	location, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		location = time.UTC
+	}
+
+	pepal := pepaltest.New()
+	pepal.Gzip = *gzip
+	pepal.SessionTTL = *sessionTTL
+	seed(pepal, *username, *password, time.Now().In(location))
+
+	log.Info().Str("addr", *addr).Str("user", *username).Str("calUUID", demoCalendar).Msg("Fake Pepal started")
+	if err := http.ListenAndServe(*addr, pepal); err != nil {
+		log.Fatal().Err(err).Msg("Fake Pepal stopped")
+	}
+}
+
+// seed creates the demo user and its data around now.
+func seed(pepal *pepaltest.Pepal, username, password string, now time.Time) {
+	pepal.AddUser(username, password)
+	pepal.SetCourses(username,
+		pepaltest.Course{ID: "2275021", Name: "Développement Go", Time: "09:00-12:30", State: models.AttendanceOpen},
+		pepaltest.Course{ID: "2275022", Name: "Bases de données", Time: "13:30-17:30", State: models.AttendanceNotYetOpen},
+	)
+	pepal.SetGrades(username,
+		pepaltest.Grade{Unit: "UE1 - Informatique", Course: "Développement Go", Subject: "TP1", Date: "12/09/2024", Mark: "15,5", Coef: "1", Published: true, Comment: "Bon travail"},
+		pepaltest.Grade{Unit: "UE1 - Informatique", Course: "Développement Go", Subject: "Examen", Date: "03/10/2024", Mark: "12", Coef: "2", Published: true},
+		pepaltest.Grade{Unit: "UE1 - Informatique", Course: "Bases de données", Subject: "QCM", Date: "20/09/2024", Mark: "8/10", Coef: "1"},
+	)
+
+	monday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).
+		AddDate(0, 0, -(int(now.Weekday())+6)%7)
+	var events []pepaltest.Event
+	for day := 0; day < 5; day++ {
+		date := monday.AddDate(0, 0, day)
+		at := func(hour, minute int) time.Time {
+			return time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, date.Location())
+		}
+		if day == 4 {
+			events = append(events, pepaltest.Event{UID: date.Format("20060102") + "-company", Start: at(9, 0), End: at(17, 0)})
+			continue
+		}
+		events = append(events,
+			pepaltest.Event{UID: date.Format("20060102") + "-am", Summary: "Développement Go", Location: "Salle 101", Professor: "M. Martin", Start: at(9, 0), End: at(12, 30)},
+			pepaltest.Event{UID: date.Format("20060102") + "-pm", Summary: "Bases de données", Location: "Salle 204", Professor: "Mme Durand", Start: at(13, 30), End: at(17, 30)},
+		)
+	}
+	pepal.SetCalendar(demoCalendar, pepaltest.Calendar(events...))
+}
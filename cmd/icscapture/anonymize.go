@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// pseudonyms are the properties naming people, replaced by a pseudonym. The
+// same value always gets the same one, so a professor teaching several
+// courses still does in the capture.
+var pseudonyms = map[string]string{
+	"PROF":      "Professeur %d",
+	"ORGANIZER": "mailto:organisateur-%d@example.invalid",
+	"ATTENDEE":  "mailto:participant-%d@example.invalid",
+	"CONTACT":   "Contact %d",
+}
+
+// masked are the free text properties, which may name people: their letters
+// and digits are masked, their escapes and punctuation kept.
+var masked = map[string]bool{
+	"DESCRIPTION": true,
+	"COMMENT":     true,
+}
+
+// anonymizer rewrites the content lines of a feed.
+type anonymizer struct {
+	secrets []string
+	seen    map[string]string
+	counts  map[string]int
+}
+
+// anonymize returns a copy of feed without personal data: the people are
+// replaced by pseudonyms, the free texts masked, the UIDs renumbered and the
+// secrets, such as the calendar UUID, zeroed wherever they appear. The lines
+// left unchanged are copied as they are, folding included; the rewritten ones
+// are folded again at 75 octets.
+func anonymize(feed []byte, secrets []string) []byte {
+	a := &anonymizer{seen: make(map[string]string), counts: make(map[string]int)}
+	for _, secret := range secrets {
+		if secret != "" {
+			a.secrets = append(a.secrets, secret)
+		}
+	}
+
+	newline := "\n"
+	if bytes.Contains(feed, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	lines := strings.SplitAfter(string(feed), "\n")
+
+	var out strings.Builder
+	for i := 0; i < len(lines); {
+		// A content line goes on over the next lines starting with a space
+		// or a tab
+		j := i + 1
+		for j < len(lines) && (strings.HasPrefix(lines[j], " ") || strings.HasPrefix(lines[j], "\t")) {
+			j++
+		}
+		raw := lines[i:j]
+		i = j
+
+		var unfolded strings.Builder
+		for k, line := range raw {
+			line = strings.TrimRight(line, "\r\n")
+			if k > 0 {
+				line = line[1:]
+			}
+			unfolded.WriteString(line)
+		}
+		line := unfolded.String()
+		rewritten := a.line(line)
+		if rewritten == line {
+			out.WriteString(strings.Join(raw, ""))
+			continue
+		}
+		out.WriteString(fold(rewritten, newline))
+		if strings.HasSuffix(raw[len(raw)-1], "\n") {
+			out.WriteString(newline)
+		}
+	}
+	return []byte(out.String())
+}
+
+// line anonymises a single unfolded content line.
+func (a *anonymizer) line(line string) string {
+	for _, secret := range a.secrets {
+		line = strings.ReplaceAll(line, secret, strings.Repeat("0", len(secret)))
+	}
+
+	// The value starts at the first colon outside a quoted parameter
+	quoted, colon := false, -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return line
+	}
+	head, value := line[:colon], line[colon+1:]
+	name := strings.ToUpper(head)
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+
+	switch {
+	case name == "UID":
+		domain := ""
+		if at := strings.LastIndexByte(value, '@'); at >= 0 {
+			domain = value[at:]
+		}
+		return head + ":" + a.pseudonym(name, "event-%d", value) + domain
+	case pseudonyms[name] != "":
+		// The parameters, such as CN, name the person as well
+		return name + ":" + a.pseudonym(name, pseudonyms[name], value)
+	case masked[name]:
+		return head + ":" + mask(value)
+	}
+	return line
+}
+
+// pseudonym returns the pseudonym of a value of a property.
+func (a *anonymizer) pseudonym(name, format, value string) string {
+	key := name + "\x00" + value
+	if pseudonym, ok := a.seen[key]; ok {
+		return pseudonym
+	}
+	a.counts[name]++
+	pseudonym := fmt.Sprintf(format, a.counts[name])
+	a.seen[key] = pseudonym
+	return pseudonym
+}
+
+// mask replaces the letters of a text by x and its digits by 0, keeping its
+// escapes, spaces and punctuation.
+func mask(value string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+			b.WriteRune(r)
+		case r == '\\':
+			escaped = true
+			b.WriteRune(r)
+		case unicode.IsUpper(r):
+			b.WriteByte('X')
+		case unicode.IsLetter(r):
+			b.WriteByte('x')
+		case unicode.IsDigit(r):
+			b.WriteByte('0')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// fold splits a content line into lines of at most 75 octets, the next ones
+// starting with a space, without splitting a character.
+func fold(line, newline string) string {
+	var b strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString(newline + " ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line)
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"helper/v3/ical"
+)
+
+const testUUID = "49caac7c643b4be6817db60be4374ee7"
+
+func TestAnonymize(t *testing.T) {
+	feed := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"X-WR-CALNAME:Calendrier",
+		"URL:https://www.pepal.eu/ical_student/" + testUUID,
+		"BEGIN:VEVENT",
+		"UID:seance-2275021@pepal.eu",
+		"DTSTART;TZID=Europe/Paris:20240610T090000",
+		"SUMMARY:Développement Go",
+		"LOCATION:E 210",
+		"PROF:Jean DUPONT",
+		"ATTENDEE;CN=\"Marie Martin\":mailto:marie.martin@example.com",
+		"DESCRIPTION:Soutenance de Marie Martin\\, salle 12\\nApporter son ordinat",
+		" eur",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:seance-2275022@pepal.eu",
+		"DTSTART;TZID=Europe/Paris:20240611T090000",
+		"SUMMARY:Bases de données",
+		"PROF:Jean DUPONT",
+		"END:VEVENT",
+		"END:VCALENDAR",
+		"",
+	}, "\r\n")
+
+	capture := string(anonymize([]byte(feed), []string{testUUID}))
+	for _, personal := range []string{testUUID, "DUPONT", "Martin", "marie", "2275021"} {
+		if strings.Contains(capture, personal) {
+			t.Errorf("the capture still holds %q:\n%s", personal, capture)
+		}
+	}
+	for _, kept := range []string{
+		"SUMMARY:Développement Go\r\n",
+		"LOCATION:E 210\r\n",
+		"DTSTART;TZID=Europe/Paris:20240610T090000\r\n",
+		"UID:event-1@pepal.eu\r\n",
+		"DESCRIPTION:Xxxxxxxxxx xx Xxxxx Xxxxxx\\, xxxxx 00\\nXxxxxxxx xxx xxxxxxxxxx\r\n",
+	} {
+		if !strings.Contains(capture, kept) {
+			t.Errorf("the capture lost %q:\n%s", kept, capture)
+		}
+	}
+
+	calendar, err := ical.ParseCalendar(strings.NewReader(capture), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := calendar.Events[0].Property("PROF")
+	second, _ := calendar.Events[1].Property("PROF")
+	if first.Text() != "Professeur 1" || second.Text() != first.Text() {
+		t.Errorf("PROF = %q and %q, want the same pseudonym", first.Text(), second.Text())
+	}
+}
+
+func TestFold(t *testing.T) {
+	line := "DESCRIPTION:" + strings.Repeat("é", 60)
+	folded := fold(line, "\r\n")
+	for i, part := range strings.Split(folded, "\r\n") {
+		if len(part) > 75 {
+			t.Errorf("line %d is %d octets long", i, len(part))
+		}
+	}
+	if unfolded := strings.ReplaceAll(folded, "\r\n ", ""); unfolded != line {
+		t.Errorf("unfolded = %q, want %q", unfolded, line)
+	}
+}
@@ -0,0 +1,78 @@
+// Command icscapture saves an anonymised copy of a Pepal calendar feed, to
+// be added to the fixtures of the ical package. The feed is downloaded from
+// the Pepal instance of PEPAL_BASE_URL, or read from a file saved beforehand:
+//
+//	PEPAL_BASE_URL=https://www.pepal.eu/ go run ./cmd/icscapture -uuid <calUUID> -out ical/testdata/capture_week.ics
+//	go run ./cmd/icscapture -in feed.ics -out ical/testdata/capture_week.ics
+//
+// The structure of the feed is kept byte for byte, line folding, escapes,
+// time zones and unknown properties included; only the personal data is
+// replaced (see anonymize). Read the capture before committing it.
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	"helper/v3/controllers"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	calUUID := flag.String("uuid", "", "UUID of the calendar to download from PEPAL_BASE_URL")
+	in := flag.String("in", "", "feed file to read instead of downloading it")
+	out := flag.String("out", "", "file to write the anonymised feed to, the standard output when empty")
+	flag.Parse()
+
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "02/01/2006 15:04:05"})
+
+	var feed []byte
+	var err error
+	switch {
+	case *in != "":
+		feed, err = os.ReadFile(*in)
+	case *calUUID != "":
+		feed, err = download(*calUUID)
+	default:
+		log.Fatal().Msg("Give the calendar with -uuid or -in")
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Cannot read the feed")
+	}
+
+	// The UUID gives access to the calendar of its student: it never appears
+	// in a capture
+	secrets := []string{*calUUID}
+	anonymized := anonymize(feed, secrets)
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Cannot create the capture")
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := w.Write(anonymized); err != nil {
+		log.Fatal().Err(err).Msg("Cannot write the capture")
+	}
+	log.Info().Int("bytes", len(anonymized)).Msg("Feed captured, read it before committing it")
+}
+
+// download fetches a feed from the Pepal instance of PEPAL_BASE_URL.
+func download(calUUID string) ([]byte, error) {
+	pepal := controllers.NewPepalClient(os.Getenv("PEPAL_BASE_URL"), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	entry, err := pepal.DownloadCalendar(ctx, calUUID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Content, nil
+}
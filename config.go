@@ -0,0 +1,307 @@
+package main
+
+import (
+	"helper/v3/calendarcache"
+	"helper/v3/controllers"
+	"helper/v3/history"
+	"helper/v3/notify"
+	"helper/v3/scheduler"
+	"helper/v3/sessions"
+	"helper/v3/vault"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sessionSecret returns the token signing secret from SESSION_SECRET, or a
+// random one, which invalidates the tokens on every restart.
+func sessionSecret() []byte {
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	log.Warn().Msg("SESSION_SECRET is not set, using a random secret")
+	secret, err := sessions.NewSecret()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error generating session secret")
+	}
+	return secret
+}
+
+// sessionTTL returns the session lifetime from SESSION_TTL, 12 hours by default.
+func sessionTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("SESSION_TTL"))
+	if err != nil || ttl <= 0 {
+		return 12 * time.Hour
+	}
+	return ttl
+}
+
+// openVault opens the credential vault at VAULT_PATH (data/vault.json by
+// default) with the keys from VAULT_KEYS. It returns nil, disabling stored
+// credentials, when no key is configured.
+func openVault() *vault.Vault {
+	spec := os.Getenv("VAULT_KEYS")
+	if spec == "" {
+		log.Warn().Msg("VAULT_KEYS is not set, stored credentials are disabled")
+		return nil
+	}
+
+	keyring, err := vault.ParseKeyring(spec)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error parsing VAULT_KEYS")
+	}
+
+	path := os.Getenv("VAULT_PATH")
+	if path == "" {
+		path = "data/vault.json"
+	}
+
+	v, err := vault.Open(path, keyring)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error opening credential vault")
+	}
+	return v
+}
+
+// schedulerConfig returns the presence scheduler settings, reading the
+// polling interval, jitter and course margin from SCHEDULER_INTERVAL,
+// SCHEDULER_JITTER and SCHEDULER_MARGIN.
+func schedulerConfig() scheduler.Config {
+	config := scheduler.DefaultConfig
+	if interval, err := time.ParseDuration(os.Getenv("SCHEDULER_INTERVAL")); err == nil && interval > 0 {
+		config.Interval = interval
+	}
+	if jitter, err := time.ParseDuration(os.Getenv("SCHEDULER_JITTER")); err == nil && jitter >= 0 {
+		config.Jitter = jitter
+	}
+	if margin, err := time.ParseDuration(os.Getenv("SCHEDULER_MARGIN")); err == nil && margin >= 0 {
+		config.Margin = margin
+	}
+	return config
+}
+
+// schedulerPath returns the scheduler state file from SCHEDULER_PATH,
+// data/scheduler.json by default.
+func schedulerPath() string {
+	if path := os.Getenv("SCHEDULER_PATH"); path != "" {
+		return path
+	}
+	return "data/scheduler.json"
+}
+
+// selectorsPath returns the selector file of the Pepal parsers from
+// SELECTORS_PATH. When it is not set, the selectors built into the server are
+// used.
+func selectorsPath() string {
+	return os.Getenv("SELECTORS_PATH")
+}
+
+// selectorsReloadInterval returns how often the selector file is checked for
+// changes, from SELECTORS_RELOAD_INTERVAL, 30 seconds by default.
+func selectorsReloadInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("SELECTORS_RELOAD_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return 30 * time.Second
+	}
+	return interval
+}
+
+// schoolLocation returns the school time zone from SCHOOL_TIMEZONE,
+// Europe/Paris by default.
+func schoolLocation() *time.Location {
+	name := os.Getenv("SCHOOL_TIMEZONE")
+	if name == "" {
+		name = controllers.DefaultSchoolTimezone
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		log.Fatal().Err(err).Str("timezone", name).Msg("Error loading SCHOOL_TIMEZONE")
+	}
+	return location
+}
+
+// calendarCacheTTL returns how long a downloaded calendar is served before
+// being revalidated, from CALENDAR_CACHE_TTL, 15 minutes by default.
+func calendarCacheTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("CALENDAR_CACHE_TTL"))
+	if err != nil || ttl < 0 {
+		return 15 * time.Minute
+	}
+	return ttl
+}
+
+// calendarStorage returns the backend of the calendar cache: the directory
+// CALENDAR_CACHE_DIR (assets by default), or memory only when
+// CALENDAR_STORAGE is "memory", for read-only filesystems.
+func calendarStorage() calendarcache.Storage {
+	switch storage := os.Getenv("CALENDAR_STORAGE"); storage {
+	case "memory":
+		return calendarcache.NewMemoryStorage()
+	case "", "disk":
+		dir := os.Getenv("CALENDAR_CACHE_DIR")
+		if dir == "" {
+			dir = "assets"
+		}
+		return calendarcache.NewDiskStorage(dir)
+	default:
+		log.Fatal().Str("storage", storage).Msg("CALENDAR_STORAGE must be disk or memory")
+		return nil
+	}
+}
+
+// calendarMaxAge returns how long an unused calendar is kept in the cache,
+// from CALENDAR_MAX_AGE, 7 days by default.
+func calendarMaxAge() time.Duration {
+	maxAge, err := time.ParseDuration(os.Getenv("CALENDAR_MAX_AGE"))
+	if err != nil || maxAge <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return maxAge
+}
+
+// gradeWatchInterval returns the delay between two polls of the grade
+// watcher from GRADES_WATCH_INTERVAL, 30 minutes by default.
+func gradeWatchInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("GRADES_WATCH_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return 30 * time.Minute
+	}
+	return interval
+}
+
+// gradeWatchPath returns the grade watcher state file from GRADES_WATCH_PATH,
+// data/grades.json by default.
+func gradeWatchPath() string {
+	if path := os.Getenv("GRADES_WATCH_PATH"); path != "" {
+		return path
+	}
+	return "data/grades.json"
+}
+
+// calendarWatchPath returns the calendar change detection state file from
+// CALENDAR_WATCH_PATH, data/calendars.json by default.
+func calendarWatchPath() string {
+	if path := os.Getenv("CALENDAR_WATCH_PATH"); path != "" {
+		return path
+	}
+	return "data/calendars.json"
+}
+
+// calendarWatchInterval returns how often the watched calendars are
+// downloaded from CALENDAR_WATCH_INTERVAL, 1 hour by default.
+func calendarWatchInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("CALENDAR_WATCH_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return time.Hour
+	}
+	return interval
+}
+
+// historyPath returns the attendance history file from HISTORY_PATH,
+// data/history.json by default.
+func historyPath() string {
+	if path := os.Getenv("HISTORY_PATH"); path != "" {
+		return path
+	}
+	return "data/history.json"
+}
+
+// absenceThresholds returns the absence rates, in percent, past which the
+// school sanctions a student (ABSENCE_THRESHOLD) and from which they are
+// warned (ABSENCE_WARNING).
+func absenceThresholds() history.Thresholds {
+	thresholds := history.DefaultThresholds
+	if limit, err := strconv.ParseFloat(os.Getenv("ABSENCE_THRESHOLD"), 64); err == nil && limit > 0 {
+		thresholds.Limit = limit
+		if thresholds.Warning >= limit {
+			thresholds.Warning = limit * 0.8
+		}
+	}
+	if warning, err := strconv.ParseFloat(os.Getenv("ABSENCE_WARNING"), 64); err == nil && warning > 0 {
+		thresholds.Warning = warning
+	}
+	return thresholds
+}
+
+// notifyDrivers returns the notification channel drivers. Email is only
+// available when SMTP_ADDR (host:port) is set, sending from SMTP_FROM and
+// authenticating with SMTP_USERNAME and SMTP_PASSWORD if given.
+func notifyDrivers(config notify.Config) map[string]notify.Driver {
+	client := notify.PublicClient(15 * time.Second)
+	if config.AllowPrivate {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	chat := &notify.ChatDriver{Client: client}
+	drivers := map[string]notify.Driver{
+		notify.ChannelWebhook: &notify.WebhookDriver{Client: client},
+		notify.ChannelDiscord: chat,
+		notify.ChannelSlack:   chat,
+	}
+
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return drivers
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatal().Err(err).Msg("SMTP_ADDR must be host:port")
+	}
+	driver := &notify.SMTPDriver{Addr: addr, From: os.Getenv("SMTP_FROM")}
+	if driver.From == "" {
+		driver.From = "pepal-helper@" + host
+	}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		driver.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	drivers[notify.ChannelEmail] = driver
+	return drivers
+}
+
+// notifyConfig returns the delivery settings. NOTIFY_ALLOW_HTTP accepts
+// webhook URLs without TLS and NOTIFY_ALLOW_PRIVATE webhooks on private
+// addresses, for local tests.
+func notifyConfig() notify.Config {
+	config := notify.DefaultConfig
+	config.AllowHTTP = os.Getenv("NOTIFY_ALLOW_HTTP") == "true"
+	config.AllowPrivate = os.Getenv("NOTIFY_ALLOW_PRIVATE") == "true"
+	return config
+}
+
+// notifyPaths returns the notification channels file from NOTIFY_PATH
+// (data/notifications.json by default) and the dead-letter log from
+// NOTIFY_DEAD_LETTER_PATH (data/dead-letters.jsonl by default).
+func notifyPaths() (string, string) {
+	path := os.Getenv("NOTIFY_PATH")
+	if path == "" {
+		path = "data/notifications.json"
+	}
+	deadLetterPath := os.Getenv("NOTIFY_DEAD_LETTER_PATH")
+	if deadLetterPath == "" {
+		deadLetterPath = "data/dead-letters.jsonl"
+	}
+	return path, deadLetterPath
+}
+
+// diagnosticsPath returns the file keeping the pages the parsers could not
+// read, from DIAGNOSTICS_PATH (data/diagnostics.json by default).
+func diagnosticsPath() string {
+	if path := os.Getenv("DIAGNOSTICS_PATH"); path != "" {
+		return path
+	}
+	return "data/diagnostics.json"
+}
+
+// adminToken returns the token of the admin endpoints from ADMIN_TOKEN. They
+// are disabled when it is not set.
+func adminToken() string {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		log.Warn().Msg("ADMIN_TOKEN is not set, the admin endpoints are disabled")
+	}
+	return token
+}
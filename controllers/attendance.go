@@ -1,334 +1,303 @@
 package controllers
 
 import (
-	"bytes"
-	"compress/gzip"
+	"context"
 	"errors"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 
 	"helper/v3/models"
 
+	"github.com/PuerkitoBio/goquery"
 	"golang.org/x/net/html"
-
-	"github.com/joho/godotenv"
 )
 
-// ExtractCourseIDs parses the HTML content and extracts course IDs, names, and periods.
-func ExtractCourseIDs(htmlContent string) ([]models.Course, error) {
-	doc, err := html.Parse(strings.NewReader(htmlContent))
+// ExtractCourseIDs parses the HTML content and extracts course IDs, names, and
+// time slots. The times are read on day, in its location. A day without
+// course gives an empty list; a page without the course table, or without
+// any row in it, is a ParseFailure.
+func (s *Selectors) ExtractCourseIDs(htmlContent string, day time.Time) ([]models.Course, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
 	if err != nil {
 		return nil, err
 	}
 
-	var courses []models.Course
-	var f func(*html.Node)
-	f = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "tr" {
-			var course models.Course
-			var isCourseRow bool
-			tdIndex := 0
-			for c := n.FirstChild; c != nil; c = c.NextSibling {
-				if c.Type == html.ElementNode && c.Data == "td" {
-					tdIndex++
-					for td := c.FirstChild; td != nil; td = td.NextSibling {
-						if td.Type == html.TextNode {
-							if tdIndex == 1 && strings.Contains(td.Data, ":") {
-								isCourseRow = true
-								period := determinePeriod(td.Data)
-								course.Period = period
-							} else if tdIndex == 2 {
-								course.Name = strings.TrimSpace(td.Data)
-							}
-						} else if td.Type == html.ElementNode && td.Data == "a" {
-							for _, attr := range td.Attr {
-								if attr.Key == "href" && strings.Contains(attr.Val, "/presences/s/") {
-									parts := strings.Split(attr.Val, "/")
-									if len(parts) > 3 {
-										course.ID = parts[3]
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-			if isCourseRow && course.ID != "" {
-				courses = append(courses, course)
-			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
-		}
+	sel := s.Courses
+	tables := doc.FindMatcher(sel.table)
+	if tables.Length() == 0 {
+		return nil, &Error{Code: CodeParseFailure, Message: "no course table found"}
 	}
-	f(doc)
-
-	if len(courses) == 0 {
-		return nil, errors.New("no course IDs found")
+	rows := tables.FindMatcher(sel.row)
+	if rows.Length() == 0 {
+		return nil, &Error{Code: CodeParseFailure, Message: "no row in the course table"}
 	}
 
+	courses := []models.Course{}
+	rows.Each(func(i int, row *goquery.Selection) {
+		cells := row.ChildrenMatcher(sel.cell)
+		timeSlot := ownText(cells.Eq(sel.TimeColumn))
+		if !strings.Contains(timeSlot, ":") {
+			return
+		}
+
+		var course models.Course
+		course.Start, course.End, course.Period = parseTimeSlot(timeSlot, day)
+		course.Label = PeriodLabel(course.Period, "")
+		course.Name = ownText(cells.Eq(sel.NameColumn))
+		row.FindMatcher(sel.link).EachWithBreak(func(i int, link *goquery.Selection) bool {
+			if match := sel.id.FindStringSubmatch(link.AttrOr("href", "")); match != nil {
+				course.ID = match[1]
+				return false
+			}
+			return true
+		})
+		if course.ID != "" {
+			courses = append(courses, course)
+		}
+	})
+
 	return courses, nil
 }
 
-// determinePeriod determines whether the course is in the morning or afternoon.
-func determinePeriod(timeRange string) string {
+// The lunch break separates the morning from the afternoon. A course starting
+// before noon and ending after the break runs through both half-days.
+const (
+	noon           = 12 * time.Hour
+	afternoonStart = 13 * time.Hour
+)
+
+// parseTimeSlot reads an "HH:MM-HH:MM" cell into the times of the course on
+// day and its period. The times are zero when the cell cannot be read.
+func parseTimeSlot(timeRange string, day time.Time) (time.Time, time.Time, models.CoursePeriod) {
 	times := strings.Split(timeRange, "-")
 	if len(times) != 2 {
-		return ""
+		return time.Time{}, time.Time{}, ""
 	}
 
 	startTime, err := time.Parse("15:04", strings.TrimSpace(times[0]))
 	if err != nil {
-		return ""
-	}
-
-	if startTime.Hour() < 12 {
-		return "Matin"
-	} else {
-		return "Après-midi"
+		return time.Time{}, time.Time{}, ""
 	}
-}
-
-func GetCourseIDs(cookie string) ([]models.Course, error) {
-	godotenv.Load()
-	apiURL := os.Getenv("PEPAL_BASE_URL") + "presences"
-
-	// Create an HTTP client
-	client := &http.Client{}
-
-	// Create the GET request
-	req, err := http.NewRequest("GET", apiURL, nil)
+	endTime, err := time.Parse("15:04", strings.TrimSpace(times[1]))
 	if err != nil {
-		return nil, err
+		endTime = startTime
 	}
 
-	// Set the headers for the GET request
-	req.Header.Set("Host", "www.pepal.eu")
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Cookie", "sdv="+cookie)
-
-	// Send the GET request
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	year, month, date := day.Date()
+	at := func(t time.Time) time.Time {
+		return time.Date(year, month, date, t.Hour(), t.Minute(), 0, 0, day.Location())
 	}
-	defer resp.Body.Close()
+	start, end := at(startTime), at(endTime)
 
-	// Read the response body
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	sinceMidnight := func(t time.Time) time.Duration {
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
 	}
-	bodyString := string(bodyBytes)
-
-	// Check if the user is not logged in
-	if strings.Contains(bodyString, "form class=\"login-form\"") {
-		return nil, errors.New("user not logged in")
+	switch {
+	case sinceMidnight(startTime) >= noon:
+		return start, end, models.PeriodAfternoon
+	case sinceMidnight(endTime) > afternoonStart:
+		return start, end, models.PeriodFullDay
+	default:
+		return start, end, models.PeriodMorning
 	}
-
-	// Extract course IDs
-	return ExtractCourseIDs(bodyString)
 }
 
-func GetAttendanceStatus(cookie, courseID string) (string, error) {
-	godotenv.Load()
-
-	// Verify if the course ID is part of the day's courses
-	courses, err := GetCourseIDs(cookie)
-	if err != nil {
-		return "", err
-	}
+// periodLabels names the periods in the supported languages, French first
+// as on Pepal.
+var periodLabels = map[string]map[models.CoursePeriod]string{
+	"fr": {
+		models.PeriodMorning:   "Matin",
+		models.PeriodAfternoon: "Après-midi",
+		models.PeriodFullDay:   "Journée",
+	},
+	"en": {
+		models.PeriodMorning:   "Morning",
+		models.PeriodAfternoon: "Afternoon",
+		models.PeriodFullDay:   "All day",
+	},
+}
 
-	validCourse := false
-	for _, course := range courses {
-		if course.ID == courseID {
-			validCourse = true
-			break
+// PeriodLabel names a period in the first supported language of an
+// Accept-Language header, French by default.
+func PeriodLabel(period models.CoursePeriod, acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		lang := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		lang = strings.ToLower(strings.SplitN(lang, "-", 2)[0])
+		if labels, ok := periodLabels[lang]; ok {
+			return labels[period]
 		}
 	}
+	return periodLabels["fr"][period]
+}
 
-	if !validCourse {
-		return "", errors.New("invalid course ID for the current day")
-	}
-
-	// Load the attendance page for the course
-	apiURL := os.Getenv("PEPAL_BASE_URL") + "presences/s/" + courseID
-
-	// Create an HTTP client
-	client := &http.Client{}
-
-	// Create the GET request
-	req, err := http.NewRequest("GET", apiURL, nil)
+// GetCourseIDs retrieves the courses of the day from the presences page, and
+// remembers them for the next attendance requests of the user.
+func (c *PepalClient) GetCourseIDs(ctx context.Context, auth *Auth) ([]models.Course, error) {
+	_, bodyString, err := c.fetch(ctx, "GET", "presences", auth, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// Set the headers for the GET request
-	req.Header.Set("Host", "www.pepal.eu")
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Cookie", "sdv="+cookie)
-
-	// Send the GET request
-	resp, err := client.Do(req)
+	// Extract course IDs
+	courses, err := c.Selectors().ExtractCourseIDs(bodyString, time.Now().In(c.Location))
 	if err != nil {
-		return "", err
+		c.recordParseFailure(auth, ParserCourses, "presences", bodyString, err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	c.rememberCourses(auth, courses)
+	return courses, nil
+}
 
-	// Read the response body
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+// GetAttendanceStatus retrieves the attendance status of one of the day's courses.
+func (c *PepalClient) GetAttendanceStatus(ctx context.Context, auth *Auth, courseID string) (models.AttendanceStatus, error) {
+	_, status, err := c.Snapshot(auth).Attendance(ctx, courseID)
+	return status, err
+}
+
+// recordAttendance passes the final attendance of one of the day's courses
+// to the History recorder, if any.
+func (c *PepalClient) recordAttendance(auth *Auth, course models.Course, outcome models.AttendanceOutcome, at time.Time) {
+	if c.History == nil || auth.Username == "" {
+		return
 	}
-	bodyString := string(bodyBytes)
+	c.History.RecordAttendance(auth.Username, at.In(c.Location).Format("2006-01-02"), course, outcome, at)
+}
 
-	// Check if the user is not logged in
-	doc, err := html.Parse(strings.NewReader(bodyString))
+// ParseAttendanceStatus extracts the attendance status from the panel of a
+// course attendance page. A panel whose text is not recognised gives the
+// Unknown state; a page without any panel is an error.
+func (s *Selectors) ParseAttendanceStatus(htmlContent string) (models.AttendanceStatus, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
 	if err != nil {
-		return "", err
+		return models.AttendanceStatus{}, err
 	}
 
-	// Extract the attendance status
-	var status string
-	var f func(*html.Node)
-	f = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "div" {
-			for _, attr := range n.Attr {
-				if attr.Key == "class" && strings.Contains(attr.Val, "panel-body") {
-					textContent := getTextContent(n)
-					if strings.Contains(textContent, "L'appel n'est pas encore ouvert") {
-						status = "Closed"
-					} else if strings.Contains(textContent, "L'appel est clôturé") {
-						if strings.Contains(textContent, "Vous avez été noté présent") {
-							status = "Present"
-						} else {
-							status = "Closed"
-						}
-					} else if strings.Contains(textContent, "Valider la présence en retard") {
-						status = "Late"
-					} else if strings.Contains(textContent, "Valider la présence") {
-						status = "Open"
-					}
-				}
-			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
-		}
+	status := models.AttendanceStatus{
+		State:      models.AttendanceUnknown,
+		ObservedAt: time.Now(),
 	}
-	f(doc)
 
-	if status == "" {
-		return "", errors.New("unable to determine attendance status")
+	panels := doc.FindMatcher(s.Attendance.panel)
+	if panels.Length() == 0 {
+		return models.AttendanceStatus{}, &Error{Code: CodeParseFailure, Message: "unable to determine attendance status"}
 	}
+	panels.Each(func(i int, panel *goquery.Selection) {
+		textContent := visibleText(panel)
+		state := s.attendanceState(textContent)
+		if i == 0 || state != models.AttendanceUnknown {
+			status.State = state
+			status.RawText = strings.Join(strings.Fields(textContent), " ")
+		}
+	})
 
 	return status, nil
 }
 
-// getTextContent retrieves the concatenated text content of a node.
-func getTextContent(n *html.Node) string {
-	var textContent string
-	var f func(*html.Node)
-	f = func(n *html.Node) {
-		if n.Type == html.TextNode {
-			textContent += n.Data
+// visibleText returns the text of a selection without the source of its
+// scripts and styles, which are not shown on the page.
+func visibleText(s *goquery.Selection) string {
+	var text strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			text.WriteString(n.Data)
+		case n.Type == html.ElementNode && (n.Data == "script" || n.Data == "style"):
+			return
 		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
 		}
 	}
-	f(n)
-	return textContent
+	for _, n := range s.Nodes {
+		walk(n)
+	}
+	return text.String()
 }
 
-func SetPresence(cookie, courseID string) error {
-	godotenv.Load()
-
-	// Call GetAttendanceStatus to check if the attendance is open
-	status, err := GetAttendanceStatus(cookie, courseID)
-	if err != nil {
-		return err
+// errUnknownAttendance reports an attendance panel whose text matches none of
+// the known roll call states.
+var errUnknownAttendance = errors.New("unrecognised attendance panel text")
+
+// attendanceState maps the text of an attendance panel to its state with the
+// first matching rule.
+func (s *Selectors) attendanceState(textContent string) models.AttendanceState {
+	for _, rule := range s.Attendance.States {
+		matches := true
+		for _, text := range rule.Contains {
+			if !strings.Contains(textContent, text) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return rule.State
+		}
 	}
-	fmt.Print(status)
+	return models.AttendanceUnknown
+}
 
-	if status != "Open" {
-		log.Printf("Cannot set presence: %s", status)
-		return errors.New("cannot set presence: " + status)
-	}
+// SetPresence marks the user present for the course if the roll call is open.
+// When allowLate is set, a presence can also be validated late once Pepal only
+// offers the late validation. It returns whether the presence was recorded on
+// time or late.
+func (c *PepalClient) SetPresence(ctx context.Context, auth *Auth, courseID string, allowLate bool) (models.PresenceTiming, error) {
+	timing, _, err := c.Snapshot(auth).SetPresence(ctx, courseID, allowLate)
+	return timing, err
+}
 
-	// Set the presence
-	postURL := os.Getenv("PEPAL_BASE_URL") + "student/upload.php"
+// presenceForm returns the fields posted to student/upload.php to validate
+// the presence in the given state, Open or LateOpen. They are read from the
+// button of the panel whose text gives that state, and from the inputs of its
+// form, so the late validation posts the action of the late button and not
+// the one of another button of the page. An on-time presence without a button
+// action defaults to the on-time action; a late one is an error, as no action
+// can be guessed for it.
+func (s *Selectors) presenceForm(htmlContent, courseID string, state models.AttendanceState) (url.Values, error) {
+	sel := s.Attendance
 	data := url.Values{}
-	data.Set("act", "set_present")
+	data.Set("act", sel.DefaultAct)
 	data.Set("seance_pk", courseID)
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	req, err := http.NewRequest("POST", postURL, strings.NewReader(data.Encode()))
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
 	if err != nil {
-		log.Printf("Error creating POST request for setting presence: %v", err)
-		return err
+		return nil, newParseError("error parsing the attendance page", err)
 	}
 
-	// Define the headers for the POST request
-	req.Header.Set("Host", "www.pepal.eu")
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Cookie", "sdv="+cookie)
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Connection", "keep-alive")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error sending POST request for setting presence: %v", err)
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Failed to set presence: %v", resp.Status)
-		return errors.New("failed to set presence")
-	}
-
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading response body for setting presence: %v", err)
-		return err
-	}
-
-	// Check if the response is compressed
-	var bodyString string
-	if strings.Contains(resp.Header.Get("Content-Encoding"), "gzip") {
-		reader, err := gzip.NewReader(bytes.NewReader(bodyBytes))
-		if err != nil {
-			log.Printf("Error creating gzip reader: %v", err)
-			return err
+	var button *goquery.Selection
+	doc.FindMatcher(sel.panel).FindMatcher(sel.button).EachWithBreak(func(i int, n *goquery.Selection) bool {
+		text := n.Text()
+		if goquery.NodeName(n) == "input" {
+			text = n.AttrOr("value", "")
 		}
-		defer reader.Close()
-		unzippedBodyBytes, err := io.ReadAll(reader)
-		if err != nil {
-			log.Printf("Error reading unzipped response body: %v", err)
-			return err
+		if s.attendanceState(text) == state {
+			button = n
+			return false
 		}
-		bodyString = string(unzippedBodyBytes)
-	} else {
-		bodyString = string(bodyBytes)
+		return true
+	})
+
+	act := ""
+	if button != nil {
+		act = button.AttrOr(sel.ActAttribute, "")
+		for _, attr := range button.Get(0).Attr {
+			if act != "" {
+				break
+			}
+			if match := sel.act.FindStringSubmatch(attr.Val); match != nil {
+				act = match[1]
+			}
+		}
+		button.Closest("form").FindMatcher(sel.input).Each(func(i int, input *goquery.Selection) {
+			data.Set(input.AttrOr("name", ""), input.AttrOr("value", ""))
+		})
 	}
-
-	if !strings.Contains(bodyString, "location.reload();") {
-		log.Println("Presence not marked successfully")
-		return errors.New("presence not marked successfully")
+	switch {
+	case act != "":
+		data.Set("act", act)
+	case state != models.AttendanceOpen:
+		return nil, &Error{Code: CodeParseFailure, Message: "no action found for the " + string(state) + " presence button"}
 	}
-
-	return nil
+	return data, nil
 }
@@ -1,155 +1,222 @@
 package controllers
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"helper/v3/calendarcache"
+	"helper/v3/ical"
 	"helper/v3/models"
-	"io"
 	"log"
 	"net/http"
-	"os"
+	"sort"
 	"strings"
 	"time"
 )
 
 // FetchAndParseCalendar télécharge, lit et analyse le fichier .ics, et retourne les événements de la semaine en cours
-func FetchAndParseCalendar(calUUID string) ([]models.Event, error) {
-	err := FetchCalendar(calUUID)
+func (c *PepalClient) FetchAndParseCalendar(ctx context.Context, calUUID string) ([]models.Event, error) {
+	return c.FetchCalendarRange(ctx, calUUID, WeekRange(time.Now().In(c.Location), 0))
+}
+
+// FetchCalendarRange télécharge, lit et analyse le fichier .ics, et retourne les événements de la période dateRange
+func (c *PepalClient) FetchCalendarRange(ctx context.Context, calUUID string, dateRange DateRange) ([]models.Event, error) {
+	content, err := c.FetchCalendar(ctx, calUUID)
 	if err != nil {
 		return nil, err
 	}
 
-	filePath := "assets/" + calUUID + ".ics"
-	content, err := ReadCalendar(filePath)
+	events, err := ParseCalendar(string(content), c.Location)
 	if err != nil {
 		return nil, err
 	}
 
-	events, err := ParseCalendar(content)
+	return FilterEvents(events, dateRange), nil
+}
+
+// FetchCalendar retourne le contenu du fichier .ics, depuis le cache Calendars s'il est configuré
+func (c *PepalClient) FetchCalendar(ctx context.Context, calUUID string) ([]byte, error) {
+	calUUID, err := calendarcache.NormalizeUUID(calUUID)
 	if err != nil {
 		return nil, err
 	}
+	if c.Calendars != nil {
+		return c.Calendars.Get(ctx, calUUID)
+	}
 
-	weeklyEvents := FilterWeeklyEvents(events)
-	return weeklyEvents, nil
+	entry, err := c.DownloadCalendar(ctx, calUUID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Content, nil
 }
 
-// FetchCalendar télécharge le fichier situé à l'URL formée avec le calUUID et le sauvegarde dans le dossier assets
-func FetchCalendar(calUUID string) error {
-	baseURL := "https://www.pepal.eu/ical_student/"
-	url := baseURL + calUUID
-
-	resp, err := http.Get(url)
+// DownloadCalendar télécharge le fichier situé à l'URL formée avec le calUUID.
+// Si previous n'est pas nil, la requête est conditionnelle (ETag, Last-Modified) et une entrée nil signifie que le fichier n'a pas changé.
+func (c *PepalClient) DownloadCalendar(ctx context.Context, calUUID string, previous *calendarcache.Entry) (*calendarcache.Entry, error) {
+	calUUID, err := calendarcache.NormalizeUUID(calUUID)
 	if err != nil {
-		return fmt.Errorf("erreur lors de la requête GET: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("échec de la requête: %s", resp.Status)
+	req, err := c.newRequest(ctx, "GET", "ical_student/"+calUUID, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("erreur lors de la création de la requête: %v", err)
+	}
+	if previous != nil {
+		if previous.ETag != "" {
+			req.Header.Set("If-None-Match", previous.ETag)
+		}
+		if previous.LastModified != "" {
+			req.Header.Set("If-Modified-Since", previous.LastModified)
+		}
 	}
 
-	out, err := os.Create("assets/" + calUUID + ".ics")
+	resp, content, err := c.do(c.HTTPClient, req)
 	if err != nil {
-		return fmt.Errorf("erreur lors de la création du fichier: %v", err)
+		return nil, fmt.Errorf("erreur lors de la requête GET: %w", err)
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return fmt.Errorf("erreur lors de l'écriture du fichier: %v", err)
+	if resp.StatusCode == http.StatusNotModified && previous != nil {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &Error{Code: CodeUpstreamUnavailable, Message: "échec de la requête: " + resp.Status}
 	}
 
-	log.Printf("Fichier %s.ics téléchargé avec succès dans le dossier assets\n", calUUID)
-	return nil
+	log.Printf("Calendrier %s téléchargé avec succès\n", calUUID)
+	return &calendarcache.Entry{
+		Content:      []byte(content),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now(),
+	}, nil
 }
 
-// ReadCalendar lit le contenu du fichier .ics
-func ReadCalendar(filePath string) (string, error) {
-	file, err := os.Open(filePath)
+// ParseCalendar analyse le contenu du fichier .ics et retourne la liste des événements, triés par horaire de début.
+// Les horaires sont ramenés dans le fuseau de l'école loc, qui sert aussi à lire les horaires sans fuseau.
+func ParseCalendar(content string, loc *time.Location) ([]models.Event, error) {
+	calendar, err := ical.ParseCalendar(strings.NewReader(content), loc)
 	if err != nil {
-		return "", fmt.Errorf("erreur lors de l'ouverture du fichier: %v", err)
+		return nil, newParseError("erreur lors de l'analyse du calendrier", err)
 	}
-	defer file.Close()
-
-	var content string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		content += scanner.Text() + "\n"
+	// Un fuseau inconnu ne fait pas échouer le calendrier : ses horaires sont lus dans celui de l'école
+	for _, warning := range calendar.Warnings {
+		log.Printf("Calendrier lu avec un fuseau de repli : %s\n", warning)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("erreur lors de la lecture du fichier: %v", err)
-	}
+	var events []models.Event
+	for _, vevent := range calendar.Events {
+		startDate := vevent.Start.Time.In(loc)
+		endDate := vevent.End.Time.In(loc)
+		if vevent.End.Time.IsZero() {
+			// Sans DTEND, une date dure un jour et un horaire n'a pas de durée
+			endDate = startDate
+			if vevent.Start.DateOnly {
+				endDate = startDate.AddDate(0, 0, 1)
+			}
+		}
 
-	return content, nil
-}
+		currentEvent := models.Event{
+			UID:         vevent.UID,
+			Type:        models.EventCourse,
+			Day:         startDate.Format("2006-01-02"),
+			Start:       startDate,
+			End:         endDate,
+			Duration:    int(endDate.Sub(startDate).Minutes()),
+			Subject:     vevent.Summary,
+			Location:    vevent.Location,
+			Room:        strings.Join(strings.Fields(vevent.Location), " "),
+			Description: vevent.Description,
+			Categories:  vevent.Categories,
+		}
+		currentEvent.Remote = currentEvent.Location == ""
+		if prof, ok := vevent.Property("PROF"); ok {
+			currentEvent.Professor = prof.Text()
+		}
 
-// ParseCalendar analyse le contenu du fichier .ics et retourne une liste d'événements
-func ParseCalendar(content string) ([]models.Event, error) {
-	var events []models.Event
-	lines := strings.Split(content, "\n")
-	var currentEvent models.Event
-	var startDate time.Time
-	var endDate time.Time
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "BEGIN:VEVENT") {
-			currentEvent = models.Event{}
-		} else if strings.HasPrefix(line, "SUMMARY:") {
-			currentEvent.Subject = strings.TrimPrefix(line, "SUMMARY:")
-		} else if strings.HasPrefix(line, "DTSTART:") {
-			startDate, _ = time.Parse("20060102T150405", strings.TrimPrefix(line, "DTSTART:"))
-		} else if strings.HasPrefix(line, "DTEND:") {
-			endDate, _ = time.Parse("20060102T150405", strings.TrimPrefix(line, "DTEND:"))
-		} else if strings.HasPrefix(line, "LOCATION:") {
-			currentEvent.Location = strings.TrimPrefix(line, "LOCATION:")
-			currentEvent.Remote = currentEvent.Location == ""
-		} else if strings.HasPrefix(line, "PROF:") {
-			currentEvent.Professor = strings.TrimPrefix(line, "PROF:")
-		} else if strings.HasPrefix(line, "END:VEVENT") {
-			if currentEvent.Subject == "" {
-				currentEvent.Subject = "entreprise"
+		if currentEvent.Subject == "" {
+			currentEvent.Type = models.EventCompany
+			currentEvent.Subject = "entreprise"
+			currentEvent.FullDay = true
+			currentEvent.Remote = false
+			currentEvent.Professor = ""
+		} else {
+			if startDate.Hour() < 12 {
+				currentEvent.Morning = true
+			} else {
+				currentEvent.Afternoon = true
+			}
+			if vevent.Start.DateOnly || (startDate.Hour() == 9 && endDate.Hour() == 16) {
 				currentEvent.FullDay = true
 				currentEvent.Morning = false
 				currentEvent.Afternoon = false
-				currentEvent.Remote = false
-				currentEvent.Professor = ""
-			} else {
-				currentEvent.Day = startDate.Format("2006-01-02")
-				if startDate.Hour() < 12 {
-					currentEvent.Morning = true
-				} else {
-					currentEvent.Afternoon = true
-				}
-				if startDate.Hour() == 9 && endDate.Hour() == 16 {
-					currentEvent.FullDay = true
-					currentEvent.Morning = false
-					currentEvent.Afternoon = false
-				}
 			}
-			events = append(events, currentEvent)
 		}
+		events = append(events, currentEvent)
 	}
 
+	// Les événements sont triés par horaire de début, pour être affichés dans l'ordre de la journée
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Start.Before(events[j].Start)
+	})
+
 	return events, nil
 }
 
-// FilterWeeklyEvents filtre les événements pour ne garder que ceux de la semaine en cours
-func FilterWeeklyEvents(events []models.Event) []models.Event {
-	var weeklyEvents []models.Event
-	now := time.Now()
-	year, week := now.ISOWeek()
+// FilterWeeklyEvents filtre les événements pour ne garder que ceux de la semaine de now
+func FilterWeeklyEvents(events []models.Event, now time.Time) []models.Event {
+	return FilterEvents(events, WeekRange(now, 0))
+}
+
+// DateRange est une période de jours, bornes incluses
+type DateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// NewDateRange retourne la période du jour from au jour to, ramenés à minuit dans le fuseau de from
+func NewDateRange(from, to time.Time) DateRange {
+	return DateRange{From: startOfDay(from), To: startOfDay(to.In(from.Location()))}
+}
+
+// WeekRange retourne la semaine ISO (du lundi au dimanche) décalée de offset semaines par rapport à celle de now
+func WeekRange(now time.Time, offset int) DateRange {
+	daysSinceMonday := (int(now.Weekday()) + 6) % 7
+	monday := startOfDay(now).AddDate(0, 0, 7*offset-daysSinceMonday)
+	return DateRange{From: monday, To: monday.AddDate(0, 0, 6)}
+}
+
+// MonthRange retourne le mois month de l'année year dans le fuseau loc
+func MonthRange(year int, month time.Month, loc *time.Location) DateRange {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	return DateRange{From: first, To: first.AddDate(0, 1, -1)}
+}
+
+// Days retourne le nombre de jours de la période
+func (r DateRange) Days() int {
+	return int(r.To.Sub(r.From).Round(24*time.Hour)/(24*time.Hour)) + 1
+}
+
+// Contains indique si le jour day, au format 2006-01-02, fait partie de la période
+func (r DateRange) Contains(day string) bool {
+	return day >= r.From.Format("2006-01-02") && day <= r.To.Format("2006-01-02")
+}
+
+// FilterEvents filtre les événements pour ne garder que ceux de la période dateRange
+func FilterEvents(events []models.Event, dateRange DateRange) []models.Event {
+	var filtered []models.Event
 	for _, event := range events {
-		eventTime, _ := time.Parse("2006-01-02", event.Day)
-		eventYear, eventWeek := eventTime.ISOWeek()
-		if eventYear == year && eventWeek == week {
-			weeklyEvents = append(weeklyEvents, event)
+		if dateRange.Contains(event.Day) {
+			filtered = append(filtered, event)
 		}
 	}
-	return weeklyEvents
+	return filtered
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
 }
 
 // CalendarToJSON convertit une liste d'événements en JSON
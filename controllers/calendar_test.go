@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"helper/v3/models"
+)
+
+func TestParseCalendar(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+		// Listés dans le désordre, pour vérifier le tri
+		"BEGIN:VEVENT\r\nUID:c2\r\nSUMMARY:JAVA\r\nLOCATION:E 104\r\nPROF:Jane ROE\r\n" +
+		"DTSTART:20240613T120000Z\r\nDTEND:20240613T150000Z\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:c1\r\nSUMMARY:GOLANG\r\nLOCATION: E  210 \r\nPROF:John DOE\r\n" +
+		"DTSTART;TZID=Europe/Paris:20240613T090000\r\nDTEND;TZID=Europe/Paris:20240613T123000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:c3\r\nSUMMARY:Soutenance\r\nDTSTART;TZID=Europe/Paris:20240614T100000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:e1\r\nDTSTART;VALUE=DATE:20240612\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	events, err := ParseCalendar(content, paris)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 6, day, hour, minute, 0, 0, paris)
+	}
+	want := []struct {
+		uid        string
+		eventType  models.EventType
+		start, end time.Time
+		duration   int
+		location   string
+		room       string
+		remote     bool
+	}{
+		// Une date sans DTEND dure un jour
+		{"e1", models.EventCompany, at(12, 0, 0), at(13, 0, 0), 24 * 60, "", "", false},
+		{"c1", models.EventCourse, at(13, 9, 0), at(13, 12, 30), 210, " E  210 ", "E 210", false},
+		// Les horaires UTC sont ramenés dans le fuseau de l'école
+		{"c2", models.EventCourse, at(13, 14, 0), at(13, 17, 0), 180, "E 104", "E 104", false},
+		// Un horaire sans DTEND n'a pas de durée
+		{"c3", models.EventCourse, at(14, 10, 0), at(14, 10, 0), 0, "", "", true},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("%d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.UID != w.uid || e.Type != w.eventType {
+			t.Errorf("event %d = %s (%s), want %s (%s)", i, e.UID, e.Type, w.uid, w.eventType)
+			continue
+		}
+		if !e.Start.Equal(w.start) || !e.End.Equal(w.end) || e.Duration != w.duration {
+			t.Errorf("%s: %v - %v (%d min), want %v - %v (%d min)", e.UID, e.Start, e.End, e.Duration, w.start, w.end, w.duration)
+		}
+		if e.Start.Location() != paris {
+			t.Errorf("%s: start in %s, want the school time zone", e.UID, e.Start.Location())
+		}
+		if e.Location != w.location || e.Room != w.room || e.Remote != w.remote {
+			t.Errorf("%s: location %q, room %q, remote %v, want %q, %q, %v", e.UID, e.Location, e.Room, e.Remote, w.location, w.room, w.remote)
+		}
+	}
+	if e := events[1]; e.Day != "2024-06-13" || !e.Morning || e.Afternoon || e.Professor != "John DOE" {
+		t.Errorf("c1 = %+v", e)
+	}
+}
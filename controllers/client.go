@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"helper/v3/calendarcache"
+	"helper/v3/models"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	// Embed the time zone database so the school time zone resolves even on
+	// systems without one, such as the Alpine image.
+	_ "time/tzdata"
+)
+
+// DefaultTimeout bounds every request made by a client created with a nil
+// http.Client, so a slow Pepal cannot hang a caller without a deadline.
+const DefaultTimeout = 30 * time.Second
+
+// DefaultSchoolTimezone is the time zone the Pepal schools are in.
+const DefaultSchoolTimezone = "Europe/Paris"
+
+// PepalClient performs every request made to Pepal. It holds the base URL of
+// the Pepal instance, the HTTP client used to reach it and the headers sent
+// with each request, so it can be pointed at a local fake Pepal in tests.
+type PepalClient struct {
+	// BaseURL is the root of the Pepal instance, with a trailing slash
+	// (e.g. "https://www.pepal.eu/").
+	BaseURL string
+	// HTTPClient sends the requests. Its Jar is never used: the sdv cookie is
+	// set explicitly on each request.
+	HTTPClient *http.Client
+	// Header holds the default headers added to every request.
+	Header http.Header
+	// Location is the time zone of the school. Calendar events are normalised
+	// to it before being split into mornings and afternoons.
+	Location *time.Location
+	// Calendars caches the calendar feeds. When nil, every calendar request
+	// downloads the feed again.
+	Calendars *calendarcache.Cache
+	// History, when set, is told the final attendance of every course whose
+	// roll call is read or validated.
+	History AttendanceRecorder
+	// Diagnostics, when set, is given the pages of the day's courses and of
+	// the roll calls that could not be read.
+	Diagnostics ParseFailureRecorder
+	// CourseMemoTTL is how long the courses of the day read for a user are
+	// reused by the attendance requests, DefaultCourseMemoTTL when zero.
+	CourseMemoTTL time.Duration
+
+	// selectors replace the built-in selectors once set.
+	selectors atomic.Pointer[Selectors]
+
+	memoMu sync.Mutex
+	memo   map[string]courseMemo
+}
+
+// AttendanceRecorder keeps the final attendance of the users' courses.
+type AttendanceRecorder interface {
+	RecordAttendance(username, day string, course models.Course, outcome models.AttendanceOutcome, at time.Time)
+	// RecordMissed counts as an absence a course whose roll call was not seen
+	// closed by the end of its day, unless its outcome is already known.
+	RecordMissed(username, day string, course models.Course, at time.Time)
+}
+
+// The parsers reported to the Diagnostics recorder.
+const (
+	ParserCourses    = "courses"
+	ParserAttendance = "attendance"
+)
+
+// ParseFailureRecorder keeps the Pepal pages the parsers could not read.
+type ParseFailureRecorder interface {
+	RecordParseFailure(parser, path, username, page string, err error)
+}
+
+// recordParseFailure passes a page a parser could not read to the
+// Diagnostics recorder, if any.
+func (c *PepalClient) recordParseFailure(auth *Auth, parser, path, page string, err error) {
+	if c.Diagnostics == nil {
+		return
+	}
+	c.Diagnostics.RecordParseFailure(parser, path, auth.Username, page, err)
+}
+
+// NewPepalClient returns a client for the Pepal instance at baseURL. A nil
+// httpClient is replaced by a new http.Client using DefaultTimeout.
+func NewPepalClient(baseURL string, httpClient *http.Client) *PepalClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	if baseURL != "" && !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	header := http.Header{}
+	header.Set("Accept", "*/*")
+
+	location, err := time.LoadLocation(DefaultSchoolTimezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	return &PepalClient{
+		BaseURL:    baseURL,
+		HTTPClient: httpClient,
+		Header:     header,
+		Location:   location,
+	}
+}
+
+// newRequest builds a request for the given path, relative to BaseURL, bound to
+// ctx. When form is not nil it is sent url-encoded as the request body.
+func (c *PepalClient) newRequest(ctx context.Context, method, path, cookie string, form url.Values) (*http.Request, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range c.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: "sdv", Value: cookie})
+	}
+
+	return req, nil
+}
+
+// do sends the request and returns the response along with its decoded body.
+// Pepal not answering is an UpstreamUnavailable error.
+func (c *PepalClient) do(client *http.Client, req *http.Request) (*http.Response, string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", newUpstreamError("error contacting Pepal", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, "", newUpstreamError("error reading the Pepal answer", err)
+	}
+	return resp, body, nil
+}
+
+// Auth carries the sdv cookie sent to Pepal on behalf of a user.
+type Auth struct {
+	Cookie string
+	// Username identifies the user in the attendance history. It is never
+	// sent to Pepal and may be empty.
+	Username string
+	// Renew, when set, logs the user in again and returns a fresh cookie. It
+	// is called when Pepal answers with its login page, after which the
+	// request is retried once.
+	Renew func(ctx context.Context) (string, error)
+}
+
+// CookieAuth returns an Auth for a bare sdv cookie, without renewal.
+func CookieAuth(cookie string) *Auth {
+	return &Auth{Cookie: cookie}
+}
+
+// LoginFunc logs a user in to Pepal and returns a fresh sdv cookie.
+type LoginFunc func(ctx context.Context, username string) (string, error)
+
+// Logins keeps the sdv cookies of the users a background job acts for, and
+// renews them through a login function. It is safe for concurrent use.
+type Logins struct {
+	login LoginFunc
+
+	mu      sync.Mutex
+	cookies map[string]string
+}
+
+// NewLogins returns a cookie cache renewing the sessions with login.
+func NewLogins(login LoginFunc) *Logins {
+	return &Logins{login: login, cookies: make(map[string]string)}
+}
+
+// Auth returns the Pepal credentials of a user, renewed through the login
+// function when the cached cookie is missing or expired.
+func (l *Logins) Auth(username string) *Auth {
+	l.mu.Lock()
+	cookie := l.cookies[username]
+	l.mu.Unlock()
+
+	auth := CookieAuth(cookie)
+	auth.Username = username
+	auth.Renew = func(ctx context.Context) (string, error) {
+		return l.login(ctx, username)
+	}
+	return auth
+}
+
+// Remember keeps the cookie of auth, renewed or not, for the next Auth of its
+// user.
+func (l *Logins) Remember(auth *Auth) {
+	if auth.Cookie == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cookies[auth.Username] = auth.Cookie
+}
+
+// Forget drops the cookie of a user.
+func (l *Logins) Forget(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.cookies, username)
+}
+
+// fetch sends an authenticated request and returns the page body. When Pepal
+// answers with the login page, the session is renewed and the request retried
+// once if auth allows it; otherwise ErrNotLoggedIn is returned.
+func (c *PepalClient) fetch(ctx context.Context, method, path string, auth *Auth, form url.Values) (*http.Response, string, error) {
+	resp, body, err := c.fetchOnce(ctx, method, path, auth.Cookie, form)
+	if !errors.Is(err, ErrNotLoggedIn) || auth.Renew == nil {
+		return resp, body, err
+	}
+
+	cookie, err := auth.Renew(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	auth.Cookie = cookie
+
+	return c.fetchOnce(ctx, method, path, auth.Cookie, form)
+}
+
+// fetchOnce sends a single request, returning ErrNotLoggedIn when Pepal
+// answers with the login page.
+func (c *PepalClient) fetchOnce(ctx context.Context, method, path, cookie string, form url.Values) (*http.Response, string, error) {
+	req, err := c.newRequest(ctx, method, path, cookie, form)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, body, err := c.do(c.HTTPClient, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if c.Selectors().IsLoginPage(body) {
+		return nil, "", ErrNotLoggedIn
+	}
+	return resp, body, nil
+}
+
+// readBody reads the response body, decompressing it when the server sent it
+// gzip-encoded without the transport doing so transparently.
+func readBody(resp *http.Response) (string, error) {
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.Contains(resp.Header.Get("Content-Encoding"), "gzip") {
+		return string(bodyBytes), nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(bodyBytes))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	unzippedBodyBytes, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(unzippedBodyBytes), nil
+}
+
+// IsLoginPage reports whether the page is Pepal's login form.
+func (s *Selectors) IsLoginPage(body string) bool {
+	return strings.Contains(body, s.Login.Form)
+}
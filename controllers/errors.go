@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+)
+
+// Code identifies a kind of failure of a Pepal request, so the API clients
+// can react to it without matching on the message.
+type Code string
+
+const (
+	// CodeAuthExpired: Pepal answered with its login page, the sdv cookie
+	// is missing or expired.
+	CodeAuthExpired Code = "auth_expired"
+	// CodeInvalidCredentials: Pepal refused the username or password.
+	CodeInvalidCredentials Code = "invalid_credentials"
+	// CodeCourseNotToday: the course is not one of the user's courses of
+	// the day.
+	CodeCourseNotToday Code = "course_not_today"
+	// CodeAttendanceNotOpen: the roll call of the course does not accept a
+	// presence.
+	CodeAttendanceNotOpen Code = "attendance_not_open"
+	// CodeUpstreamUnavailable: Pepal could not be reached or answered with
+	// an error status.
+	CodeUpstreamUnavailable Code = "upstream_unavailable"
+	// CodeParseFailure: the page Pepal answered with could not be read.
+	CodeParseFailure Code = "parse_failure"
+)
+
+// Error is a failure of a known kind. Two Errors of the same Code match with
+// errors.Is, so the sentinels below match every error of their kind.
+type Error struct {
+	Code    Code
+	Message string
+	// Err is the cause of the failure, if any.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// The sentinels of the kinds of failure, for errors.Is.
+var (
+	// ErrNotLoggedIn is returned when Pepal answers with its login page
+	// instead of the requested one.
+	ErrNotLoggedIn         = &Error{Code: CodeAuthExpired, Message: "user not logged in"}
+	ErrInvalidCredentials  = &Error{Code: CodeInvalidCredentials, Message: "invalid username or password"}
+	ErrCourseNotToday      = &Error{Code: CodeCourseNotToday, Message: "invalid course ID for the current day"}
+	ErrAttendanceNotOpen   = &Error{Code: CodeAttendanceNotOpen, Message: "the roll call is not open"}
+	ErrUpstreamUnavailable = &Error{Code: CodeUpstreamUnavailable, Message: "Pepal is unavailable"}
+	ErrParseFailure        = &Error{Code: CodeParseFailure, Message: "unreadable Pepal page"}
+)
+
+// newUpstreamError reports a request Pepal could not answer. A cancellation by
+// the caller is returned as it is: Pepal is not at fault.
+func newUpstreamError(message string, err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &Error{Code: CodeUpstreamUnavailable, Message: message, Err: err}
+}
+
+// newParseError reports a Pepal page a parser could not read.
+func newParseError(message string, err error) error {
+	return &Error{Code: CodeParseFailure, Message: message, Err: err}
+}
@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"helper/v3/models"
+)
+
+// Refresh the golden files after a deliberate parser change, or after adding
+// a fixture, with:
+//
+//	go test ./controllers -run TestFixtures -update
+//
+// and review the diff before committing it.
+var update = flag.Bool("update", false, "rewrite the golden files of the Pepal page fixtures")
+
+// fixtureDay is the day of the presences fixtures.
+var fixtureDay = time.Date(2024, 6, 13, 0, 0, 0, 0, mustLoadLocation(DefaultSchoolTimezone))
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// parseError is the golden output of a page a parser refuses.
+type parseError struct {
+	Error string `json:"error"`
+}
+
+// scrapers maps each fixture directory of testdata to the parser of its
+// pages. The parsers return what is compared with the golden file.
+var scrapers = map[string]func(page string) any{
+	"courses": func(page string) any {
+		courses, err := DefaultSelectors().ExtractCourseIDs(page, fixtureDay)
+		if err != nil {
+			return parseError{err.Error()}
+		}
+		return courses
+	},
+	"attendance": func(page string) any {
+		status, err := DefaultSelectors().ParseAttendanceStatus(page)
+		if err != nil {
+			return parseError{err.Error()}
+		}
+		// The observation time is the time of the test run, and only the
+		// open roll calls have a presence form
+		result := struct {
+			State     models.AttendanceState `json:"status"`
+			RawText   string                 `json:"raw_text"`
+			Form      map[string][]string    `json:"presence_form,omitempty"`
+			FormError string                 `json:"presence_form_error,omitempty"`
+		}{State: status.State, RawText: status.RawText}
+		if status.State == models.AttendanceOpen || status.State == models.AttendanceLateOpen {
+			form, err := DefaultSelectors().presenceForm(page, "2275021", status.State)
+			if err != nil {
+				result.FormError = err.Error()
+			}
+			result.Form = form
+		}
+		return result
+	},
+	"grades": func(page string) any {
+		grades, err := DefaultSelectors().ParseGrades(page)
+		if err != nil {
+			return parseError{err.Error()}
+		}
+		return struct {
+			Grades   []models.Grade  `json:"grades"`
+			Averages models.Averages `json:"averages"`
+		}{grades, ComputeAverages(grades)}
+	},
+	"login": func(page string) any {
+		return struct {
+			Result    LoginResult `json:"result"`
+			LoginPage bool        `json:"login_page"`
+		}{DefaultSelectors().ParseLoginResult(page), DefaultSelectors().IsLoginPage(page)}
+	},
+}
+
+// TestFixtures runs every parser on the Pepal pages of its testdata directory
+// and compares the result with the .golden.json file next to the page. The
+// pages are written after the known Pepal templates, not captured: a failure
+// means a parser regression or, once a page is replaced by a redacted
+// capture, a change of the Pepal templates.
+func TestFixtures(t *testing.T) {
+	for dir, parse := range scrapers {
+		pages, err := filepath.Glob(filepath.Join("testdata", dir, "*.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pages) == 0 {
+			t.Errorf("no fixture in testdata/%s", dir)
+		}
+
+		for _, path := range pages {
+			name := dir + "/" + strings.TrimSuffix(filepath.Base(path), ".html")
+			t.Run(name, func(t *testing.T) {
+				page, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := json.MarshalIndent(parse(string(page)), "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, '\n')
+
+				golden := strings.TrimSuffix(path, ".html") + ".golden.json"
+				if *update {
+					if err := os.WriteFile(golden, got, 0o644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v (run with -update to create it)", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("output differs from %s:\n--- got\n%s\n--- want\n%s", golden, got, want)
+				}
+			})
+		}
+	}
+}
+
+// TestFixturesHavePages catches the golden files left behind by a removed or
+// renamed fixture.
+func TestFixturesHavePages(t *testing.T) {
+	goldens, err := filepath.Glob(filepath.Join("testdata", "*", "*.golden.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, golden := range goldens {
+		if _, err := os.Stat(strings.TrimSuffix(golden, ".golden.json") + ".html"); err != nil {
+			t.Errorf("%s has no page: %v", golden, err)
+		}
+	}
+}
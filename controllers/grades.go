@@ -1,14 +1,15 @@
 package controllers
 
 import (
-	"fmt"
+	"context"
 	"helper/v3/models"
+	"math"
 	"net/http"
-	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/joho/godotenv"
 	"github.com/rs/zerolog/log"
 )
 
@@ -20,53 +21,63 @@ type Grade struct {
 }
 
 // FetchGrades retrieves the grades from the Pepal grades page.
-func FetchGrades(cookie string) ([]models.Grade, error) {
-	godotenv.Load()
-	apiURL := os.Getenv("PEPAL_BASE_URL") + "?my=notes"
-
-	// Create an HTTP client
-	client := &http.Client{}
-
-	// Create the GET request
-	req, err := http.NewRequest("GET", apiURL, nil)
-	if err != nil {
-		log.Error().Err(err).Msg("Error creating request")
-		return nil, fmt.Errorf("error creating request: %v", err)
-	}
-
-	// Set the request headers
-	req.Header.Set("Cookie", "sdv="+cookie)
-
-	// Send the request
-	resp, err := client.Do(req)
+func (c *PepalClient) FetchGrades(ctx context.Context, auth *Auth) ([]models.Grade, error) {
+	resp, bodyString, err := c.fetch(ctx, "GET", "?my=notes", auth, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
 	// Check the HTTP status code
 	if resp.StatusCode != http.StatusOK {
 		log.Error().Str("status", resp.Status).Msg("Failed to load page")
-		return nil, fmt.Errorf("failed to load page: %s", resp.Status)
+		return nil, &Error{Code: CodeUpstreamUnavailable, Message: "failed to load page: " + resp.Status}
+	}
+
+	grades, err := c.Selectors().ParseGrades(bodyString)
+	if err != nil {
+		return nil, err
 	}
 
+	log.Info().Int("gradeCount", len(grades)).Msg("Fetched grades successfully")
+	return grades, nil
+}
+
+// ParseGrades extracts the grades from the table of the Pepal grades page.
+// The unit header rows start a teaching unit and the course ones a course; a
+// page with a single kind of header uses it for both.
+func (s *Selectors) ParseGrades(htmlContent string) ([]models.Grade, error) {
 	// Use goquery to parse the HTML
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
 	if err != nil {
 		log.Error().Err(err).Msg("Error reading HTML")
-		return nil, fmt.Errorf("error reading HTML: %v", err)
+		return nil, newParseError("error reading HTML", err)
 	}
+	sel := s.Grades
+
+	// The coefficient has its own column when the header shows one
+	coefColumn := -1
+	doc.FindMatcher(sel.header).Each(func(i int, th *goquery.Selection) {
+		if strings.Contains(strings.ToLower(th.Text()), strings.ToLower(sel.CoefficientHeader)) {
+			coefColumn = i
+		}
+	})
 
 	// Extract the grades
 	var grades []models.Grade
-	var currentCourse string
+	var currentUnit, currentCourse string
 	var lastGrade *models.Grade
 
-	doc.Find("table.table-bordered tbody tr").Each(func(i int, s *goquery.Selection) {
+	doc.FindMatcher(sel.row).Each(func(i int, s *goquery.Selection) {
 		var grade models.Grade
+		var coefficient string
 
-		// Detect courses
-		if s.HasClass("warning") || s.HasClass("info") {
+		// Detect teaching units and courses
+		if s.HasClass(sel.UnitClass) {
+			currentUnit = strings.TrimSpace(s.Find("td").First().Text())
+			currentCourse = currentUnit
+			return
+		}
+		if s.HasClass(sel.CourseClass) {
 			currentCourse = strings.TrimSpace(s.Find("td").First().Text())
 			return
 		}
@@ -74,18 +85,25 @@ func FetchGrades(cookie string) ([]models.Grade, error) {
 		s.Children().Each(func(j int, td *goquery.Selection) {
 			text := strings.TrimSpace(td.Text())
 			switch j {
-			case 0:
-				grade.Subject = strings.TrimSpace(strings.Replace(text, "PUBLIE", "", -1))
-			case 2:
+			case sel.SubjectColumn:
+				grade.Subject = strings.TrimSpace(strings.Replace(text, sel.Published, "", -1))
+				grade.Published = strings.Contains(text, sel.Published)
+			case sel.DateColumn:
 				grade.Date = text
-			case 3:
+			case sel.GradeColumn:
 				grade.Grade = text
 			}
+			if j == coefColumn {
+				coefficient = text
+			}
 		})
 
 		// Add the grade if the required fields are present
 		if grade.Subject != "" && grade.Date != "" && grade.Grade != "" {
 			grade.Course = currentCourse
+			grade.Unit = currentUnit
+			grade.Status, grade.Value, grade.Scale = ParseGradeValue(stripCoefficient(grade.Grade))
+			grade.Coefficient = ParseCoefficient(coefficient, grade.Grade, grade.Subject)
 			grades = append(grades, grade)
 			lastGrade = &grades[len(grades)-1]
 		} else if lastGrade != nil && grade.Subject == "" && grade.Date == "" && grade.Grade == "" {
@@ -94,6 +112,191 @@ func FetchGrades(cookie string) ([]models.Grade, error) {
 		}
 	})
 
-	log.Info().Int("gradeCount", len(grades)).Msg("Fetched grades successfully")
 	return grades, nil
 }
+
+// gradePattern matches a mark, with a comma or dot decimal separator and an
+// optional scale: "15", "15,5", "7.5/10", "12 / 20".
+var gradePattern = regexp.MustCompile(`^(\d+(?:[.,]\d+)?)\s*(?:/\s*(\d+(?:[.,]\d+)?))?$`)
+
+// coefPattern matches a coefficient written next to a grade or a subject:
+// "coef 2", "Coef. : 1,5", "coefficient 3".
+var coefPattern = regexp.MustCompile(`(?i)\(?\s*coef[a-z]*\.?\s*:?\s*(\d+(?:[.,]\d+)?)\s*\)?`)
+
+// absentMarkers and notGradedMarkers are the texts Pepal shows instead of a mark.
+var (
+	absentMarkers    = []string{"ABS", "ABI", "ABJ", "ABSENT"}
+	notGradedMarkers = []string{"NN", "NC", "NE", "DISP", "DISPENSE", "EXC", "-", "*"}
+)
+
+// ParseGradeValue reads the mark of a grade. Marks without a scale are on
+// 20. The value is nil when the grade holds no mark.
+func ParseGradeValue(text string) (models.GradeStatus, *float64, float64) {
+	text = strings.TrimSpace(text)
+	upper := strings.ToUpper(strings.TrimSuffix(text, "."))
+	for _, marker := range absentMarkers {
+		if upper == marker {
+			return models.GradeAbsent, nil, 0
+		}
+	}
+	for _, marker := range notGradedMarkers {
+		if upper == marker {
+			return models.GradeNotGraded, nil, 0
+		}
+	}
+
+	match := gradePattern.FindStringSubmatch(text)
+	if match == nil {
+		return models.GradeNotGraded, nil, 0
+	}
+	value := parseDecimal(match[1])
+	scale := 20.0
+	if match[2] != "" {
+		scale = parseDecimal(match[2])
+	}
+	if scale <= 0 || value > scale {
+		return models.GradeNotGraded, nil, 0
+	}
+	return models.GradeGraded, &value, scale
+}
+
+// ParseCoefficient returns the coefficient of a grade: the number of the
+// coefficient column if there is one, or else the first "coef" mention found
+// in texts. It defaults to 1.
+func ParseCoefficient(column string, texts ...string) float64 {
+	if coefficient := parseDecimal(strings.TrimSpace(column)); coefficient > 0 {
+		return coefficient
+	}
+	for _, text := range texts {
+		if match := coefPattern.FindStringSubmatch(text); match != nil {
+			if coefficient := parseDecimal(match[1]); coefficient > 0 {
+				return coefficient
+			}
+		}
+	}
+	return 1
+}
+
+// stripCoefficient removes a coefficient mention from the text of a grade.
+func stripCoefficient(text string) string {
+	return strings.TrimSpace(coefPattern.ReplaceAllString(text, ""))
+}
+
+// parseDecimal parses a number written with a comma or a dot.
+func parseDecimal(text string) float64 {
+	value, _ := strconv.ParseFloat(strings.Replace(text, ",", ".", 1), 64)
+	return value
+}
+
+// ComputeAverages returns the averages of the graded grades, on 20, per
+// course, per teaching unit and overall. A course average weighs its grades
+// by their coefficient. A unit average is the mean of the averages of its
+// courses and the overall average the mean of the averages of the units, a
+// course outside any unit counting as a unit: Pepal shows no coefficient for
+// the courses and units, so each weighs the same. Courses are told apart by
+// unit, absent and ungraded grades are left out, and so are the courses and
+// units without any graded grade.
+func ComputeAverages(grades []models.Grade) models.Averages {
+	type courseKey struct{ unit, course string }
+	var courses []*weightedSum
+	var units []string
+	byCourse := make(map[courseKey]*weightedSum)
+	unitCourses := make(map[string][]*weightedSum)
+
+	for _, grade := range grades {
+		key := courseKey{grade.Unit, grade.Course}
+		course, ok := byCourse[key]
+		if !ok {
+			course = &weightedSum{name: grade.Course, unit: grade.Unit}
+			byCourse[key] = course
+			courses = append(courses, course)
+			if _, ok := unitCourses[grade.Unit]; !ok && grade.Unit != "" {
+				units = append(units, grade.Unit)
+			}
+			unitCourses[grade.Unit] = append(unitCourses[grade.Unit], course)
+		}
+
+		if grade.Status != models.GradeGraded || grade.Value == nil || grade.Scale <= 0 {
+			continue
+		}
+		course.add(*grade.Value/grade.Scale*20, grade.Coefficient)
+	}
+
+	averages := models.Averages{
+		Units:   []models.Average{},
+		Courses: []models.Average{},
+	}
+	overall := &mean{}
+	for _, course := range courses {
+		average := course.average(course.name)
+		average.Unit = course.unit
+		averages.Courses = append(averages.Courses, average)
+		if course.unit == "" {
+			overall.add(average)
+		}
+	}
+	for _, name := range units {
+		unit := &mean{}
+		for _, course := range unitCourses[name] {
+			unit.add(course.average(course.name))
+		}
+		average := unit.average(name)
+		averages.Units = append(averages.Units, average)
+		overall.add(average)
+	}
+	averages.Overall = overall.average("overall")
+	return averages
+}
+
+// weightedSum accumulates the marks of a course.
+type weightedSum struct {
+	name        string
+	unit        string
+	sum         float64
+	coefficient float64
+	grades      int
+}
+
+func (w *weightedSum) add(mark, coefficient float64) {
+	w.sum += mark * coefficient
+	w.coefficient += coefficient
+	w.grades++
+}
+
+// average returns the weighted average, rounded to the hundredth.
+func (w *weightedSum) average(name string) models.Average {
+	average := models.Average{Name: name, Grades: w.grades, Coefficient: w.coefficient}
+	if w.coefficient > 0 {
+		value := math.Round(w.sum/w.coefficient*100) / 100
+		average.Average = &value
+	}
+	return average
+}
+
+// mean accumulates the averages of the courses of a unit, or of the units,
+// each counting once.
+type mean struct {
+	sum         float64
+	count       int
+	grades      int
+	coefficient float64
+}
+
+func (m *mean) add(average models.Average) {
+	m.grades += average.Grades
+	m.coefficient += average.Coefficient
+	if average.Average != nil {
+		m.sum += *average.Average
+		m.count++
+	}
+}
+
+// average returns the mean of the averages, rounded to the hundredth.
+func (m *mean) average(name string) models.Average {
+	average := models.Average{Name: name, Grades: m.grades, Coefficient: m.coefficient}
+	if m.count > 0 {
+		value := math.Round(m.sum/float64(m.count)*100) / 100
+		average.Average = &value
+	}
+	return average
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"testing"
+
+	"helper/v3/models"
+)
+
+func TestComputeAverages(t *testing.T) {
+	grade := func(unit, course string, value, coefficient float64) models.Grade {
+		return models.Grade{Unit: unit, Course: course, Status: models.GradeGraded, Value: &value, Scale: 20, Coefficient: coefficient}
+	}
+	absent := models.Grade{Unit: "UE 2", Course: "Anglais", Status: models.GradeAbsent, Scale: 20, Coefficient: 1}
+	averages := ComputeAverages([]models.Grade{
+		// A course with many grades weighs as much as one with a single grade
+		grade("UE 1", "Go", 10, 1),
+		grade("UE 1", "Go", 12, 1),
+		grade("UE 1", "Go", 14, 2),
+		grade("UE 1", "SQL", 18, 1),
+		// The same course name in another unit
+		grade("UE 2", "Go", 8, 1),
+		absent,
+		// A course outside any unit counts as a unit
+		grade("", "Projet", 16, 1),
+	})
+
+	want := map[string]float64{"UE 1/Go": 12.5, "UE 1/SQL": 18, "UE 2/Go": 8, "/Projet": 16}
+	if len(averages.Courses) != 5 {
+		t.Fatalf("courses = %+v", averages.Courses)
+	}
+	for _, course := range averages.Courses {
+		value, ok := want[course.Unit+"/"+course.Name]
+		switch {
+		case !ok && course.Average != nil:
+			t.Errorf("course %s/%s has an average", course.Unit, course.Name)
+		case ok && (course.Average == nil || *course.Average != value):
+			t.Errorf("course %s/%s = %+v, want %v", course.Unit, course.Name, course, value)
+		}
+	}
+
+	// UE 1: (12.5 + 18) / 2, UE 2: 8, the absence left out
+	if len(averages.Units) != 2 || *averages.Units[0].Average != 15.25 || *averages.Units[1].Average != 8 || averages.Units[0].Grades != 4 {
+		t.Errorf("units = %+v", averages.Units)
+	}
+	// (15.25 + 8 + 16) / 3
+	if average := averages.Overall.Average; average == nil || *average != 13.08 || averages.Overall.Grades != 6 {
+		t.Errorf("overall = %+v", averages.Overall)
+	}
+
+	if averages := ComputeAverages(nil); averages.Overall.Average != nil || averages.Units == nil || averages.Courses == nil {
+		t.Errorf("averages without grade = %+v", averages)
+	}
+}
@@ -1,34 +1,68 @@
 package controllers
 
 import (
-	"bytes"
-	"errors"
-	"io"
+	"context"
 	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
-	"os"
 	"strings"
+)
+
+// sdvJar is a cookie jar that remembers the sdv cookie as Pepal set it, with
+// its expiry, which the standard jar does not hand back.
+type sdvJar struct {
+	*cookiejar.Jar
+	sdv *http.Cookie
+}
+
+func (j *sdvJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	for _, cookie := range cookies {
+		if cookie.Name == "sdv" {
+			j.sdv = cookie
+		}
+	}
+	j.Jar.SetCookies(u, cookies)
+}
 
-	"github.com/joho/godotenv"
+// LoginResult is what the page Pepal answers to the login form tells.
+type LoginResult string
+
+const (
+	// LoginDenied: Pepal refused the username or password.
+	LoginDenied LoginResult = "denied"
+	// LoginForm: Pepal showed its login form again.
+	LoginForm LoginResult = "login_form"
+	// LoginAccepted: neither a refusal nor the login form. The login
+	// succeeded if Pepal also set the sdv cookie.
+	LoginAccepted LoginResult = "accepted"
 )
 
-func Login(username, password string) (string, error) {
-	godotenv.Load()
-	apiURL := os.Getenv("PEPAL_BASE_URL") + "include/php/ident.php"
+// ParseLoginResult reads the page Pepal answers to the login form.
+func (s *Selectors) ParseLoginResult(body string) LoginResult {
+	switch {
+	case strings.Contains(body, s.Login.Denied):
+		return LoginDenied
+	case s.IsLoginPage(body):
+		return LoginForm
+	default:
+		return LoginAccepted
+	}
+}
 
+// Login authenticates against Pepal and returns the sdv session cookie.
+func (c *PepalClient) Login(ctx context.Context, username, password string) (*http.Cookie, error) {
 	// Create a cookie jar to manage cookies
-	jar, err := cookiejar.New(nil)
+	cookieJar, err := cookiejar.New(nil)
 	if err != nil {
 		log.Printf("Error creating cookie jar: %v", err)
-		return "", err
+		return nil, err
 	}
+	jar := &sdvJar{Jar: cookieJar}
 
-	// Create an HTTP client with the cookie jar
-	client := &http.Client{
-		Jar: jar,
-	}
+	// Use a copy of the HTTP client with the cookie jar
+	client := *c.HTTPClient
+	client.Jar = jar
 
 	// Create the POST data
 	data := url.Values{}
@@ -36,54 +70,37 @@ func Login(username, password string) (string, error) {
 	data.Set("pass", password)
 
 	// Create the POST request
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBufferString(data.Encode()))
+	req, err := c.newRequest(ctx, "POST", "include/php/ident.php", "", data)
 	if err != nil {
 		log.Printf("Error creating POST request: %v", err)
-		return "", err
+		return nil, err
 	}
 
-	// Set the headers for the POST request
-	req.Header.Set("Host", "www.pepal.eu")
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
 	// Send the POST request
-	resp, err := client.Do(req)
+	resp, bodyString, err := c.do(&client, req)
 	if err != nil {
 		log.Printf("Error sending POST request: %v", err)
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return "", err
-	}
-
-	bodyString := string(body)
-
-	// Check for the "Accès refusé !" message
-	if strings.Contains(bodyString, "Accès refusé !") {
+	// Check for the access denied message
+	if c.Selectors().ParseLoginResult(bodyString) == LoginDenied {
 		log.Println("Incorrect username or password")
-		return "", errors.New("identifiant et/ou mot de passe incorrect(s)")
+		return nil, ErrInvalidCredentials
 	}
 
 	// Check for the "Connexion réussie" message
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("Login failed with status: %v", resp.Status)
-		return "", errors.New("login failed")
+		return nil, &Error{Code: CodeUpstreamUnavailable, Message: "login failed: " + resp.Status}
 	}
 
 	// Check for the "Connexion réussie" message
-	for _, cookie := range jar.Cookies(req.URL) {
-		if cookie.Name == "sdv" {
-			log.Println("Login successful")
-			return cookie.Value, nil
-		}
+	if jar.sdv != nil && jar.sdv.Value != "" {
+		log.Println("Login successful")
+		return jar.sdv, nil
 	}
 
 	log.Println("Cookie not found")
-	return "", errors.New("cookie not found")
+	return nil, &Error{Code: CodeParseFailure, Message: "cookie not found"}
 }
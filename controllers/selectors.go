@@ -0,0 +1,334 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"helper/v3/models"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/html"
+)
+
+// SelectorsVersion is the version of the selector file format this server
+// reads. It changes when the fields of the file do, not when the selectors
+// are edited.
+const SelectorsVersion = 1
+
+// defaultSelectors is the selector file matching the Pepal templates this
+// server was built against.
+//
+//go:embed selectors.json
+var defaultSelectors []byte
+
+// DefaultSelectors returns the selectors built into the server. They must not
+// be modified.
+var DefaultSelectors = sync.OnceValue(func() *Selectors {
+	selectors, err := ParseSelectors(defaultSelectors)
+	if err != nil {
+		panic("controllers: invalid built-in selectors: " + err.Error())
+	}
+	return selectors
+})
+
+// Selectors tell the parsers where the data is on the Pepal pages, so a
+// change of the Pepal markup can be followed by editing the selector file
+// instead of the code. The CSS selectors use the goquery syntax, the columns
+// count the cells of a row from 0, and the other texts are searched for as
+// they are. Once parsed, Selectors are read-only and safe for concurrent use.
+type Selectors struct {
+	Version    int                 `json:"version"`
+	Login      LoginSelectors      `json:"login"`
+	Courses    CourseSelectors     `json:"courses"`
+	Attendance AttendanceSelectors `json:"attendance"`
+	Grades     GradeSelectors      `json:"grades"`
+}
+
+// LoginSelectors recognise the pages Pepal answers with when the user is not
+// logged in. Both are searched for in the raw page.
+type LoginSelectors struct {
+	// Form is only found on the login page.
+	Form string `json:"form"`
+	// Denied is only found on the answer to a wrong password.
+	Denied string `json:"denied"`
+}
+
+// CourseSelectors locate the courses of the day on the presences page.
+type CourseSelectors struct {
+	// Table matches the table of the courses. A page without it, or without
+	// any row in it, cannot be read; an empty table is a day without course.
+	Table string `json:"table"`
+	// Row matches a course, and Cell its cells.
+	Row  string `json:"row"`
+	Cell string `json:"cell"`
+	// TimeColumn holds the "HH:MM-HH:MM" time slot; rows without a time
+	// there are skipped. NameColumn holds the name of the course.
+	TimeColumn int `json:"time_column"`
+	NameColumn int `json:"name_column"`
+	// Link matches the link of the row to the attendance page, and ID reads
+	// the course ID in its href with its first group.
+	Link string `json:"link"`
+	ID   string `json:"id"`
+
+	table, row, cell, link goquery.Matcher
+	id                     *regexp.Regexp
+}
+
+// AttendanceSelectors read the roll call panel of an attendance page.
+type AttendanceSelectors struct {
+	// Panel matches the roll call panel.
+	Panel string `json:"panel"`
+	// States give the state of the roll call from the text of the panel.
+	// The first one whose texts are all in the panel wins; a panel matching
+	// none is Unknown.
+	States []StateRule `json:"states"`
+	// Button matches the buttons of the panel; the one whose text gives the
+	// state being validated is the presence button.
+	Button string `json:"button"`
+	// Input matches the fields of the form of the presence button, posted
+	// with the presence.
+	Input string `json:"input"`
+	// ActAttribute and ActPattern find the action of the presence button,
+	// as its attribute or in its other attributes. DefaultAct is posted for
+	// an on-time presence when the button shows none.
+	ActAttribute string `json:"act_attribute"`
+	ActPattern   string `json:"act_pattern"`
+	DefaultAct   string `json:"default_act"`
+	// Saved is found in the answer to a presence Pepal recorded.
+	Saved string `json:"saved"`
+
+	panel, button, input goquery.Matcher
+	act                  *regexp.Regexp
+}
+
+// StateRule maps the texts of a roll call panel to its state.
+type StateRule struct {
+	State    models.AttendanceState `json:"state"`
+	Contains []string               `json:"contains"`
+}
+
+// GradeSelectors locate the grades on the grades page.
+type GradeSelectors struct {
+	// Header matches the header cells of the grade table; the one holding
+	// CoefficientHeader, in any case, is the coefficient column if any.
+	Header            string `json:"header"`
+	CoefficientHeader string `json:"coefficient_header"`
+	// Row matches the rows of the grade table. The rows with UnitClass
+	// start a teaching unit and those with CourseClass a course.
+	Row         string `json:"row"`
+	UnitClass   string `json:"unit_class"`
+	CourseClass string `json:"course_class"`
+	// The columns of a grade.
+	SubjectColumn int `json:"subject_column"`
+	DateColumn    int `json:"date_column"`
+	GradeColumn   int `json:"grade_column"`
+	// Published marks the subject of a published grade.
+	Published string `json:"published"`
+
+	header, row goquery.Matcher
+}
+
+// ParseSelectors reads and checks a selector file. Unknown fields and
+// versions are refused, so a typo cannot silently disable a parser.
+func ParseSelectors(data []byte) (*Selectors, error) {
+	var s Selectors
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		return nil, fmt.Errorf("error decoding selectors: %v", err)
+	}
+	if s.Version != SelectorsVersion {
+		return nil, fmt.Errorf("unsupported selectors version %d, expected %d", s.Version, SelectorsVersion)
+	}
+
+	var errs []error
+	css := func(field, selector string) goquery.Matcher {
+		matcher, err := cascadia.Compile(selector)
+		if err != nil || selector == "" {
+			errs = append(errs, fmt.Errorf("%s: invalid selector %q", field, selector))
+		}
+		return matcher
+	}
+	pattern := func(field, expr string) *regexp.Regexp {
+		re, err := regexp.Compile(expr)
+		if err != nil || expr == "" || (re != nil && re.NumSubexp() < 1) {
+			errs = append(errs, fmt.Errorf("%s: invalid pattern %q, it needs a group", field, expr))
+		}
+		return re
+	}
+	required := func(field, text string) {
+		if strings.TrimSpace(text) == "" {
+			errs = append(errs, fmt.Errorf("%s: missing", field))
+		}
+	}
+	column := func(field string, index int) {
+		if index < 0 {
+			errs = append(errs, fmt.Errorf("%s: negative column", field))
+		}
+	}
+
+	required("login.form", s.Login.Form)
+	required("login.denied", s.Login.Denied)
+
+	s.Courses.table = css("courses.table", s.Courses.Table)
+	s.Courses.row = css("courses.row", s.Courses.Row)
+	s.Courses.cell = css("courses.cell", s.Courses.Cell)
+	s.Courses.link = css("courses.link", s.Courses.Link)
+	s.Courses.id = pattern("courses.id", s.Courses.ID)
+	column("courses.time_column", s.Courses.TimeColumn)
+	column("courses.name_column", s.Courses.NameColumn)
+
+	s.Attendance.panel = css("attendance.panel", s.Attendance.Panel)
+	s.Attendance.button = css("attendance.button", s.Attendance.Button)
+	s.Attendance.input = css("attendance.input", s.Attendance.Input)
+	s.Attendance.act = pattern("attendance.act_pattern", s.Attendance.ActPattern)
+	required("attendance.act_attribute", s.Attendance.ActAttribute)
+	required("attendance.default_act", s.Attendance.DefaultAct)
+	required("attendance.saved", s.Attendance.Saved)
+	if len(s.Attendance.States) == 0 {
+		errs = append(errs, errors.New("attendance.states: missing"))
+	}
+	for i, rule := range s.Attendance.States {
+		switch rule.State {
+		case models.AttendanceNotYetOpen, models.AttendanceOpen, models.AttendanceLateOpen,
+			models.AttendanceClosedPresent, models.AttendanceClosedAbsent:
+		default:
+			errs = append(errs, fmt.Errorf("attendance.states[%d]: unknown state %q", i, rule.State))
+		}
+		if len(rule.Contains) == 0 {
+			errs = append(errs, fmt.Errorf("attendance.states[%d]: no text", i))
+		}
+		for _, text := range rule.Contains {
+			required(fmt.Sprintf("attendance.states[%d].contains", i), text)
+		}
+	}
+
+	s.Grades.header = css("grades.header", s.Grades.Header)
+	s.Grades.row = css("grades.row", s.Grades.Row)
+	required("grades.coefficient_header", s.Grades.CoefficientHeader)
+	required("grades.unit_class", s.Grades.UnitClass)
+	required("grades.course_class", s.Grades.CourseClass)
+	required("grades.published", s.Grades.Published)
+	column("grades.subject_column", s.Grades.SubjectColumn)
+	column("grades.date_column", s.Grades.DateColumn)
+	column("grades.grade_column", s.Grades.GradeColumn)
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// LoadSelectors reads and checks the selector file at path.
+func LoadSelectors(path string) (*Selectors, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading selectors: %v", err)
+	}
+	return ParseSelectors(data)
+}
+
+// Selectors returns the selectors the parsers of the client use, the
+// built-in ones unless others were set.
+func (c *PepalClient) Selectors() *Selectors {
+	if selectors := c.selectors.Load(); selectors != nil {
+		return selectors
+	}
+	return DefaultSelectors()
+}
+
+// SetSelectors replaces the selectors of the client. The requests already
+// reading a page finish with the previous ones.
+func (c *PepalClient) SetSelectors(selectors *Selectors) {
+	c.selectors.Store(selectors)
+}
+
+// SelectorFile is a selector file as it was loaded, so its later changes
+// can be told apart.
+type SelectorFile struct {
+	Path      string
+	Selectors *Selectors
+
+	modTime time.Time
+	size    int64
+	// reloaded, when set, is called with the result of each reload.
+	reloaded func(err error)
+}
+
+// LoadSelectorFile reads and checks the selector file at path, recording its
+// version for WatchSelectors. The file is stated before it is read, so a
+// change made meanwhile is reloaded by the watcher rather than missed.
+func LoadSelectorFile(path string) (*SelectorFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading selectors: %v", err)
+	}
+	selectors, err := LoadSelectors(path)
+	if err != nil {
+		return nil, err
+	}
+	return &SelectorFile{Path: path, Selectors: selectors, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// WatchSelectors reloads the selector file every interval when it differs
+// from the version loaded, until ctx is done. A file that cannot be read or
+// is invalid is logged and leaves the selectors in use, so a mistake while
+// editing it does not stop the parsers.
+func (c *PepalClient) WatchSelectors(ctx context.Context, file *SelectorFile, interval time.Duration) {
+	path := file.Path
+	modTime, size := file.modTime, file.size
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Error checking selectors")
+			continue
+		}
+		if info.ModTime().Equal(modTime) && info.Size() == size {
+			continue
+		}
+		modTime, size = info.ModTime(), info.Size()
+
+		selectors, err := LoadSelectors(path)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Error reloading selectors, keeping the previous ones")
+		} else {
+			c.SetSelectors(selectors)
+			log.Info().Str("path", path).Msg("Selectors reloaded")
+		}
+		if file.reloaded != nil {
+			file.reloaded(err)
+		}
+	}
+}
+
+// ownText returns the text of the first element of a selection, without the
+// text of its child elements.
+func ownText(s *goquery.Selection) string {
+	var text strings.Builder
+	for _, n := range s.First().Contents().Nodes {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+	}
+	return strings.TrimSpace(text.String())
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"helper/v3/models"
+)
+
+func TestParseSelectorsRefusesInvalidFiles(t *testing.T) {
+	for name, edit := range map[string]func(string) string{
+		"unknown field": func(s string) string {
+			return strings.Replace(s, `"row": "tr"`, `"rows": "tr"`, 1)
+		},
+		"version": func(s string) string {
+			return strings.Replace(s, `"version": 1`, `"version": 2`, 1)
+		},
+		"selector": func(s string) string {
+			return strings.Replace(s, `"panel": "div[class*='panel-body']"`, `"panel": "div[class*="`, 1)
+		},
+		"pattern without group": func(s string) string {
+			return strings.Replace(s, `"id": "/presences/s/([^/?#]+)"`, `"id": "/presences/s/"`, 1)
+		},
+		"state": func(s string) string {
+			return strings.Replace(s, `"state": "Open"`, `"state": "Opened"`, 1)
+		},
+		"missing text": func(s string) string {
+			return strings.Replace(s, `"saved": "location.reload();"`, `"saved": ""`, 1)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := edit(string(defaultSelectors))
+			if data == string(defaultSelectors) {
+				t.Fatal("the edit did not apply to the built-in selectors")
+			}
+			if _, err := ParseSelectors([]byte(data)); err == nil {
+				t.Error("invalid selectors accepted")
+			}
+		})
+	}
+}
+
+// TestWatchSelectors follows a change of the wording of the roll call by
+// editing the selector file, and keeps the selectors in use when the file is
+// broken.
+func TestWatchSelectors(t *testing.T) {
+	page := `<div class="panel-body">La présence est ouverte</div>`
+	path := filepath.Join(t.TempDir(), "selectors.json")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := func(c *PepalClient) models.AttendanceState {
+		t.Helper()
+		status, err := c.Selectors().ParseAttendanceStatus(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.State
+	}
+	write(string(defaultSelectors))
+	c := NewPepalClient("", nil)
+	if state(c) != models.AttendanceUnknown {
+		t.Fatalf("state with the built-in selectors = %s", state(c))
+	}
+	file, err := LoadSelectorFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetSelectors(file.Selectors)
+	reloads := make(chan error)
+	file.reloaded = func(err error) { reloads <- err }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.WatchSelectors(ctx, file, time.Millisecond)
+	reload := func() error {
+		t.Helper()
+		select {
+		case err := <-reloads:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("the selector file was not reloaded")
+			return nil
+		}
+	}
+
+	write(strings.Replace(string(defaultSelectors), `"Valider la présence"]`, `"La présence est ouverte"]`, 1))
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	if state(c) != models.AttendanceOpen {
+		t.Errorf("state after the reload = %s", state(c))
+	}
+
+	// A broken file is refused and the previous selectors are kept
+	write(`{"version": 1`)
+	if err := reload(); err == nil {
+		t.Error("a broken file was loaded")
+	}
+	if state(c) != models.AttendanceOpen {
+		t.Errorf("a broken file replaced the selectors: state = %s", state(c))
+	}
+}
@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"helper/v3/models"
+)
+
+// DefaultCourseMemoTTL is how long the courses of the day read for a user are
+// reused before the presences page is loaded again.
+const DefaultCourseMemoTTL = 2 * time.Minute
+
+// courseMemo is the list of the day's courses last read for a user.
+type courseMemo struct {
+	courses []models.Course
+	day     string
+	at      time.Time
+}
+
+// memoKey identifies the user of auth in the course memo.
+func memoKey(auth *Auth) string {
+	if auth.Username != "" {
+		return "user:" + auth.Username
+	}
+	return "cookie:" + auth.Cookie
+}
+
+// rememberCourses keeps the courses of the day read for a user.
+func (c *PepalClient) rememberCourses(auth *Auth, courses []models.Course) {
+	now := time.Now()
+	c.memoMu.Lock()
+	defer c.memoMu.Unlock()
+	if c.memo == nil {
+		c.memo = make(map[string]courseMemo)
+	}
+	for key, memo := range c.memo {
+		if now.Sub(memo.at) > c.courseMemoTTL() {
+			delete(c.memo, key)
+		}
+	}
+	// The caller keeps its slice: the memo holds its own copy
+	c.memo[memoKey(auth)] = courseMemo{
+		courses: append([]models.Course{}, courses...),
+		day:     now.In(c.Location).Format("2006-01-02"),
+		at:      now,
+	}
+}
+
+// rememberedCourses returns the courses of the day read for a user less
+// than CourseMemoTTL ago, if any.
+func (c *PepalClient) rememberedCourses(auth *Auth) ([]models.Course, bool) {
+	now := time.Now()
+	c.memoMu.Lock()
+	defer c.memoMu.Unlock()
+	memo, ok := c.memo[memoKey(auth)]
+	if !ok || now.Sub(memo.at) > c.courseMemoTTL() || memo.day != now.In(c.Location).Format("2006-01-02") {
+		return nil, false
+	}
+	return memo.courses, true
+}
+
+func (c *PepalClient) courseMemoTTL() time.Duration {
+	if c.CourseMemoTTL != 0 {
+		return c.CourseMemoTTL
+	}
+	return DefaultCourseMemoTTL
+}
+
+// attendance is an attendance page read during a snapshot.
+type attendance struct {
+	course models.Course
+	status models.AttendanceStatus
+	page   string
+}
+
+// Snapshot reads the day's courses and attendance pages of a user at most
+// once, so a single API call or scheduler poll does not load the same Pepal
+// page twice. The courses also come from the memo of the recent reads. A
+// Snapshot is meant to live for one call and is not safe for concurrent use.
+type Snapshot struct {
+	client  *PepalClient
+	auth    *Auth
+	courses []models.Course
+	// fresh is set once the courses were loaded from Pepal by this snapshot.
+	fresh bool
+	pages map[string]attendance
+}
+
+// Snapshot starts a snapshot of the attendance of the user of auth.
+func (c *PepalClient) Snapshot(auth *Auth) *Snapshot {
+	return &Snapshot{client: c, auth: auth, pages: make(map[string]attendance)}
+}
+
+// Courses returns the courses of the day, from the memo when they were read
+// recently.
+func (s *Snapshot) Courses(ctx context.Context) ([]models.Course, error) {
+	if s.courses != nil {
+		return s.courses, nil
+	}
+	if courses, ok := s.client.rememberedCourses(s.auth); ok {
+		s.courses = courses
+		return courses, nil
+	}
+	return s.reloadCourses(ctx)
+}
+
+// reloadCourses loads the courses of the day from Pepal.
+func (s *Snapshot) reloadCourses(ctx context.Context) ([]models.Course, error) {
+	courses, err := s.client.GetCourseIDs(ctx, s.auth)
+	if err != nil {
+		return nil, err
+	}
+	s.courses = courses
+	s.fresh = true
+	return courses, nil
+}
+
+// course returns one of the day's courses. A course missing from remembered
+// courses is looked up again on Pepal before being refused.
+func (s *Snapshot) course(ctx context.Context, courseID string) (models.Course, error) {
+	courses, err := s.Courses(ctx)
+	if err != nil {
+		return models.Course{}, err
+	}
+	for {
+		// Verify if the course ID is part of the day's courses
+		for _, course := range courses {
+			if course.ID == courseID {
+				return course, nil
+			}
+		}
+		if s.fresh {
+			return models.Course{}, ErrCourseNotToday
+		}
+		if courses, err = s.reloadCourses(ctx); err != nil {
+			return models.Course{}, err
+		}
+	}
+}
+
+// Attendance returns one of the day's courses and its attendance status.
+func (s *Snapshot) Attendance(ctx context.Context, courseID string) (models.Course, models.AttendanceStatus, error) {
+	read, err := s.attendancePage(ctx, courseID)
+	return read.course, read.status, err
+}
+
+// attendancePage loads the attendance page of one of the day's courses,
+// once per snapshot.
+func (s *Snapshot) attendancePage(ctx context.Context, courseID string) (attendance, error) {
+	if read, ok := s.pages[courseID]; ok {
+		return read, nil
+	}
+
+	course, err := s.course(ctx, courseID)
+	if err != nil {
+		return attendance{}, err
+	}
+
+	// Load the attendance page for the course
+	_, bodyString, err := s.client.fetch(ctx, "GET", "presences/s/"+courseID, s.auth, nil)
+	if err != nil {
+		return attendance{}, err
+	}
+
+	status, err := s.client.Selectors().ParseAttendanceStatus(bodyString)
+	if err != nil {
+		s.client.recordParseFailure(s.auth, ParserAttendance, "presences/s/"+courseID, bodyString, err)
+		return attendance{}, err
+	}
+	if status.State == models.AttendanceUnknown {
+		s.client.recordParseFailure(s.auth, ParserAttendance, "presences/s/"+courseID, bodyString, errUnknownAttendance)
+	}
+
+	switch status.State {
+	case models.AttendanceClosedPresent:
+		s.client.recordAttendance(s.auth, course, models.OutcomePresent, status.ObservedAt)
+	case models.AttendanceClosedAbsent:
+		s.client.recordAttendance(s.auth, course, models.OutcomeAbsent, status.ObservedAt)
+	}
+
+	read := attendance{course: course, status: status, page: bodyString}
+	s.pages[courseID] = read
+	return read, nil
+}
+
+// SetPresence marks the user present for the course if the roll call is
+// open, or late when allowLate is set and only the late validation is
+// offered. With the courses remembered, it takes three requests: the
+// attendance page, whose form is reused, the validation, and the attendance
+// page again, whose status is returned.
+func (s *Snapshot) SetPresence(ctx context.Context, courseID string, allowLate bool) (models.PresenceTiming, models.AttendanceStatus, error) {
+	// Check if the attendance is open, keeping the page to read its form
+	read, err := s.attendancePage(ctx, courseID)
+	if err != nil {
+		return "", models.AttendanceStatus{}, err
+	}
+
+	var timing models.PresenceTiming
+	switch {
+	case read.status.State == models.AttendanceOpen:
+		timing = models.PresenceOnTime
+	case read.status.State == models.AttendanceLateOpen && allowLate:
+		timing = models.PresenceLate
+	default:
+		log.Printf("Cannot set presence: %s", read.status.State)
+		return "", models.AttendanceStatus{}, &Error{Code: CodeAttendanceNotOpen, Message: "cannot set presence: " + string(read.status.State)}
+	}
+
+	// Set the presence
+	selectors := s.client.Selectors()
+	data, err := selectors.presenceForm(read.page, courseID, read.status.State)
+	if err != nil {
+		s.client.recordParseFailure(s.auth, ParserAttendance, "presences/s/"+courseID, read.page, err)
+		log.Printf("Cannot set presence: %v", err)
+		return "", models.AttendanceStatus{}, err
+	}
+
+	resp, bodyString, err := s.client.fetch(ctx, "POST", "student/upload.php", s.auth, data)
+	if err != nil {
+		log.Printf("Error sending POST request for setting presence: %v", err)
+		return "", models.AttendanceStatus{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to set presence: %v", resp.Status)
+		return "", models.AttendanceStatus{}, &Error{Code: CodeUpstreamUnavailable, Message: "failed to set presence: " + resp.Status}
+	}
+
+	if !strings.Contains(bodyString, selectors.Attendance.Saved) {
+		log.Println("Presence not marked successfully")
+		return "", models.AttendanceStatus{}, &Error{Code: CodeParseFailure, Message: "presence not marked successfully"}
+	}
+
+	// Record the timing first, as Pepal does not tell a late presence apart
+	// once the roll call is closed
+	outcome := models.OutcomePresent
+	if timing == models.PresenceLate {
+		outcome = models.OutcomeLate
+	}
+	s.client.recordAttendance(s.auth, read.course, outcome, time.Now())
+
+	// The page is outdated: read the status Pepal now shows
+	delete(s.pages, courseID)
+	read, err = s.attendancePage(ctx, courseID)
+	if err != nil {
+		log.Printf("Presence set, but the attendance status could not be read again: %v", err)
+		return "", models.AttendanceStatus{}, err
+	}
+	return timing, read.status, nil
+}
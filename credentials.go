@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"helper/v3/models"
+	"helper/v3/vault"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+var errVaultDisabled = huma.Error501NotImplemented("stored credentials are disabled on this server")
+
+// addCredentialRoutes registers the endpoints managing the credentials kept
+// in the vault for the user of the session.
+func (a *app) addCredentialRoutes(api huma.API) {
+	// Enrol Credentials
+	register(api, huma.Operation{
+		OperationID: "enrolCredentials",
+		Method:      http.MethodPost,
+		Path:        "/credentials",
+		Summary:     "Enrol Credentials",
+		Description: "Store the Pepal password of the session user, encrypted, after checking it against Pepal",
+		Middlewares: huma.Middlewares{withTimeout(15 * time.Second)},
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		Body  struct {
+			Password string `json:"password" example:"mypassword" doc:"Password"`
+		}
+	}) (*models.GenericOutput, error) {
+		username, err := a.checkCredentials(ctx, input.Token, input.Body.Password)
+		if err != nil {
+			return nil, err
+		}
+		if a.vault.Has(username) {
+			return nil, huma.Error409Conflict("credentials are already stored, rotate them instead")
+		}
+		if err := a.vault.Put(username, input.Body.Password); err != nil {
+			return nil, err
+		}
+		resp := &models.GenericOutput{}
+		resp.Body.Message = "Credentials stored"
+		return resp, nil
+	})
+
+	// Rotate Credentials
+	register(api, huma.Operation{
+		OperationID: "rotateCredentials",
+		Method:      http.MethodPut,
+		Path:        "/credentials",
+		Summary:     "Rotate Credentials",
+		Description: "Replace the stored Pepal password of the session user, after checking it against Pepal",
+		Middlewares: huma.Middlewares{withTimeout(15 * time.Second)},
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		Body  struct {
+			Password string `json:"password" example:"mynewpassword" doc:"New password"`
+		}
+	}) (*models.GenericOutput, error) {
+		username, err := a.checkCredentials(ctx, input.Token, input.Body.Password)
+		if err != nil {
+			return nil, err
+		}
+		if !a.vault.Has(username) {
+			return nil, huma.Error404NotFound(vault.ErrNotFound.Error())
+		}
+		if err := a.vault.Put(username, input.Body.Password); err != nil {
+			return nil, err
+		}
+		resp := &models.GenericOutput{}
+		resp.Body.Message = "Credentials rotated"
+		return resp, nil
+	})
+
+	// Delete Credentials
+	register(api, huma.Operation{
+		OperationID: "deleteCredentials",
+		Method:      http.MethodDelete,
+		Path:        "/credentials",
+		Summary:     "Delete Credentials",
+		Description: "Delete the stored Pepal password of the session user and revoke their sessions, which could otherwise log in again with it",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.GenericOutput, error) {
+		if a.vault == nil {
+			return nil, errVaultDisabled
+		}
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.vault.Delete(session.Username); err != nil {
+			if errors.Is(err, vault.ErrNotFound) {
+				return nil, huma.Error404NotFound(err.Error())
+			}
+			return nil, err
+		}
+		a.sessions.RevokeUser(session.Username)
+		resp := &models.GenericOutput{}
+		resp.Body.Message = "Credentials deleted"
+		return resp, nil
+	})
+}
+
+// checkCredentials resolves the session user and checks the password against
+// Pepal before it is stored.
+func (a *app) checkCredentials(ctx context.Context, token, password string) (string, error) {
+	if a.vault == nil {
+		return "", errVaultDisabled
+	}
+	session, err := a.session(token)
+	if err != nil {
+		return "", err
+	}
+	if _, err := a.pepal.Login(ctx, session.Username, password); err != nil {
+		return "", err
+	}
+	return session.Username, nil
+}
@@ -0,0 +1,322 @@
+// Package diagnostics keeps the Pepal pages the parsers could not read, so a
+// change of the Pepal templates can be told apart from a known page without
+// data, such as a maintenance page.
+// Each page is redacted and tagged with a fingerprint of its structure; the
+// failures on a structure that was not acknowledged as expected count as
+// parser drift, are published as expvar metrics and raise an alert.
+package diagnostics
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"helper/v3/atomicfile"
+	"helper/v3/models"
+	"helper/v3/notify"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultLimit bounds the captures kept, one per parser and fingerprint.
+const DefaultLimit = 100
+
+// maxPageSize bounds the redacted page kept in a capture.
+const maxPageSize = 256 << 10
+
+// saveDelay is how long the counters of the known captures wait before being
+// saved, so a burst of failures on the same pages is written once.
+const saveDelay = 30 * time.Second
+
+// ErrNotFound is returned for unknown captures and fingerprints.
+var ErrNotFound = errors.New("no capture for this ID or fingerprint")
+
+// The parser failures since the server started, by parser, served with the
+// other expvar variables.
+var (
+	failureMetric = expvar.NewMap("pepal_parser_failures")
+	driftMetric   = expvar.NewMap("pepal_parser_drift")
+)
+
+// state is the persisted part of the store.
+type state struct {
+	Captures []models.ParseCapture `json:"captures"`
+	// Known holds the acknowledged fingerprints and their note.
+	Known map[string]string `json:"known"`
+}
+
+// Store keeps the captures. It is safe for concurrent use.
+type Store struct {
+	// Notifier, when set, receives a parser drift alert for AlertUser the
+	// first time a page with an unknown structure fails to parse.
+	Notifier  notify.Notifier
+	AlertUser string
+
+	path  string
+	limit int
+
+	mu    sync.Mutex
+	state state
+	stats map[string]*models.ParserStats
+	// dirty is set when the state has changes to save, and timer saves
+	// them after saveDelay.
+	dirty bool
+	timer *time.Timer
+	// saveMu serialises the writes of the state file.
+	saveMu sync.Mutex
+}
+
+// Open returns a store persisting at most limit captures at path, loading
+// the ones left by a previous run if any.
+func Open(path string, limit int) (*Store, error) {
+	s := &Store{
+		path:  path,
+		limit: limit,
+		state: state{Known: make(map[string]string)},
+		stats: make(map[string]*models.ParserStats),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading diagnostics: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("error decoding diagnostics: %v", err)
+		}
+		if s.state.Known == nil {
+			s.state.Known = make(map[string]string)
+		}
+	}
+	return s, nil
+}
+
+// RecordParseFailure captures a page a parser could not read. path is the
+// Pepal page it comes from and username the user who viewed it, whose name is
+// redacted from the page. Only the first page of a fingerprint is redacted
+// and kept, and saved at once; the next failures on it only update the
+// counters, saved after saveDelay.
+func (s *Store) RecordParseFailure(parser, path, username, page string, err error) {
+	fingerprint := Fingerprint(page)
+	id := parser + "-" + fingerprint
+	now := time.Now()
+
+	s.mu.Lock()
+	_, known := s.state.Known[fingerprint]
+	drift := !known
+
+	stats := s.parserStats(parser)
+	stats.Failures++
+	failureMetric.Add(parser, 1)
+	if drift {
+		stats.Drift++
+		driftMetric.Add(parser, 1)
+	}
+
+	var capture *models.ParseCapture
+	for i := range s.state.Captures {
+		if s.state.Captures[i].ID == id {
+			capture = &s.state.Captures[i]
+			break
+		}
+	}
+	isNew := capture == nil
+	if isNew {
+		redacted := Redact(page, username)
+		if len(redacted) > maxPageSize {
+			redacted = redacted[:maxPageSize]
+		}
+		s.state.Captures = append(s.state.Captures, models.ParseCapture{
+			ID:          id,
+			Parser:      parser,
+			Fingerprint: fingerprint,
+			FirstSeen:   now,
+			Page:        redacted,
+		})
+		capture = &s.state.Captures[len(s.state.Captures)-1]
+	}
+	capture.Drift = drift
+	capture.Note = s.state.Known[fingerprint]
+	capture.Path = path
+	capture.Error = err.Error()
+	capture.Count++
+	capture.LastSeen = now
+	alert := *capture
+	alert.Page = ""
+	s.prune()
+	if !isNew {
+		s.saveLater()
+	}
+	s.mu.Unlock()
+
+	if isNew {
+		if err := s.save(); err != nil {
+			log.Error().Err(err).Msg("Error saving diagnostics")
+		}
+	}
+
+	if !drift {
+		return
+	}
+	logEvent := log.Warn().Str("parser", parser).Str("fingerprint", fingerprint).Str("path", path).Err(err)
+	if !isNew {
+		logEvent.Msg("Parser failure on a page with an unknown structure")
+		return
+	}
+	logEvent.Msg("Parser drift: new page structure captured")
+	if s.Notifier != nil && s.AlertUser != "" {
+		s.Notifier.Notify(notify.Notification{
+			Kind:     notify.KindParserDrift,
+			Username: s.AlertUser,
+			Title:    "Page Pepal non reconnue (" + parser + ")",
+			Message:  "Une page " + path + " de structure inconnue n'a pas pu être analysée (" + err.Error() + "). Capture " + id + ".",
+			Data:     alert,
+		})
+	}
+}
+
+// parserStats returns the counters of a parser. The caller must hold s.mu.
+func (s *Store) parserStats(parser string) *models.ParserStats {
+	stats, ok := s.stats[parser]
+	if !ok {
+		stats = &models.ParserStats{Parser: parser}
+		s.stats[parser] = stats
+	}
+	return stats
+}
+
+// prune drops the captures seen least recently past the limit. The caller
+// must hold s.mu.
+func (s *Store) prune() {
+	if s.limit <= 0 || len(s.state.Captures) <= s.limit {
+		return
+	}
+	sort.SliceStable(s.state.Captures, func(i, j int) bool {
+		return s.state.Captures[i].LastSeen.After(s.state.Captures[j].LastSeen)
+	})
+	s.state.Captures = s.state.Captures[:s.limit]
+}
+
+// Captures returns the captures without their page, most recent first.
+func (s *Store) Captures() []models.ParseCapture {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	captures := make([]models.ParseCapture, 0, len(s.state.Captures))
+	for _, capture := range s.state.Captures {
+		capture.Page = ""
+		captures = append(captures, capture)
+	}
+	sort.SliceStable(captures, func(i, j int) bool {
+		return captures[i].LastSeen.After(captures[j].LastSeen)
+	})
+	return captures
+}
+
+// Capture returns a capture with its redacted page.
+func (s *Store) Capture(id string) (models.ParseCapture, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, capture := range s.state.Captures {
+		if capture.ID == id {
+			return capture, nil
+		}
+	}
+	return models.ParseCapture{}, ErrNotFound
+}
+
+// Stats returns the failure counters of the parsers since the server
+// started.
+func (s *Store) Stats() []models.ParserStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]models.ParserStats, 0, len(s.stats))
+	for _, parserStats := range s.stats {
+		stats = append(stats, *parserStats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Parser < stats[j].Parser
+	})
+	return stats
+}
+
+// Acknowledge marks the pages of a fingerprint as expected, such as a Pepal
+// maintenance page: their failures no longer count as drift. The fingerprint must have been captured.
+func (s *Store) Acknowledge(fingerprint, note string) error {
+	s.mu.Lock()
+	found := false
+	for i := range s.state.Captures {
+		if s.state.Captures[i].Fingerprint == fingerprint {
+			s.state.Captures[i].Drift = false
+			s.state.Captures[i].Note = note
+			found = true
+		}
+	}
+	if !found {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	s.state.Known[fingerprint] = note
+	s.mu.Unlock()
+	return s.save()
+}
+
+// Flush saves the changes waiting for saveDelay, such as on shutdown.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	dirty := s.dirty
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// saveLater saves the state after saveDelay, unless a save is already
+// planned. The caller must hold s.mu.
+func (s *Store) saveLater() {
+	s.dirty = true
+	if s.timer != nil {
+		return
+	}
+	s.timer = time.AfterFunc(saveDelay, func() {
+		s.mu.Lock()
+		s.timer = nil
+		s.mu.Unlock()
+		if err := s.save(); err != nil {
+			log.Error().Err(err).Msg("Error saving diagnostics")
+		}
+	})
+}
+
+// save writes the state to disk. The state is copied under s.mu, so the
+// failures are not blocked while it is written; the caller must not hold it.
+func (s *Store) save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	current := state{Captures: slices.Clone(s.state.Captures), Known: maps.Clone(s.state.Known)}
+	s.dirty = false
+	s.mu.Unlock()
+
+	data, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(s.path, data, 0o700); err != nil {
+		return fmt.Errorf("error writing diagnostics: %v", err)
+	}
+	return nil
+}
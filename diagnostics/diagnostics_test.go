@@ -0,0 +1,136 @@
+package diagnostics
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"helper/v3/notify"
+)
+
+func presencesPage(rows ...string) string {
+	var b strings.Builder
+	b.WriteString(`<html><body><nav><a class="dropdown-toggle">DOE Jane</a></nav><table class="table"><tbody>`)
+	for _, row := range rows {
+		b.WriteString(`<tr><td>09:00-12:00</td><td>` + row + `</td><td><a href="/presences/s/2275021">Appel</a></td></tr>`)
+	}
+	b.WriteString(`</tbody></table></body></html>`)
+	return b.String()
+}
+
+func TestFingerprintIgnoresDataAndRepeatedRows(t *testing.T) {
+	one := Fingerprint(presencesPage("Développement Go"))
+	three := Fingerprint(presencesPage("Anglais", "Réseaux", "Projet"))
+	if one == "" || one != three {
+		t.Errorf("fingerprints differ: %q and %q", one, three)
+	}
+
+	empty := Fingerprint(`<html><body><nav><a class="dropdown-toggle">DOE Jane</a></nav><div class="alert alert-info">Aucune séance</div></body></html>`)
+	if empty == one {
+		t.Errorf("a page without table has the fingerprint of the course list")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	page := `<html><head><meta name="csrf-token" content="a1b2c3d4e5f6a7b8c9d0e1f2"></head><body>
+<!-- rendu pour jdoe -->
+<a class="dropdown-toggle" href="/profil?id=123456">DOE Jane</a>
+<p>Bonjour jdoe (jane.doe@example.com), étudiant 20241234</p>
+<div class="panel-body">
+<p>L'appel n'est pas encore ouvert.</p>
+<input type="hidden" name="token" value="0123456789abcdef0123">
+<a href="#" data-act="set_present" onclick="send({act: 'set_present', key: 'ABCDEFGHIJKLMNOPQRSTUV'})">Valider</a>
+</div>
+</body></html>`
+
+	redacted := Redact(page, "JDoe")
+	for _, secret := range []string{"jdoe", "DOE Jane", "jane.doe", "20241234", "123456", "0123456789abcdef0123", "ABCDEFGHIJKLMNOPQRSTUV", "a1b2c3d4e5f6", "rendu pour"} {
+		if strings.Contains(redacted, secret) {
+			t.Errorf("redacted page still contains %q:\n%s", secret, redacted)
+		}
+	}
+	for _, kept := range []string{"L&#39;appel n&#39;est pas encore ouvert.", `data-act="set_present"`, `act: &#39;set_present&#39;`, `name="token"`, `class="panel-body"`, "/profil?id=x"} {
+		if !strings.Contains(redacted, kept) {
+			t.Errorf("redacted page lost %q:\n%s", kept, redacted)
+		}
+	}
+	if Fingerprint(redacted) != Fingerprint(page) {
+		t.Errorf("redaction changed the page structure")
+	}
+}
+
+type recorder struct {
+	mu            sync.Mutex
+	notifications []notify.Notification
+}
+
+func (r *recorder) Notify(n notify.Notification) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifications = append(r.notifications, n)
+}
+
+func TestRecordParseFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "diagnostics.json")
+	store, err := Open(path, DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts := &recorder{}
+	store.Notifier = alerts
+	store.AlertUser = "admin"
+
+	errNoCourse := errors.New("no course table found")
+	store.RecordParseFailure("courses", "presences", "jdoe", presencesPage("Go"), errNoCourse)
+	store.RecordParseFailure("courses", "presences", "asmith", presencesPage("SQL", "Réseaux"), errNoCourse)
+
+	captures := store.Captures()
+	if len(captures) != 1 || captures[0].Count != 2 || !captures[0].Drift || captures[0].Page != "" {
+		t.Fatalf("captures = %+v", captures)
+	}
+	if len(alerts.notifications) != 1 || alerts.notifications[0].Kind != notify.KindParserDrift || alerts.notifications[0].Username != "admin" {
+		t.Errorf("alerts = %+v", alerts.notifications)
+	}
+
+	// The capture keeps the first page, and the second failure is only saved
+	// later
+	capture, err := store.Capture(captures[0].ID)
+	if err != nil || !strings.Contains(capture.Page, "Go") || strings.Contains(capture.Page, "SQL") || strings.Contains(capture.Page, "jdoe") {
+		t.Errorf("capture = %+v, %v", capture, err)
+	}
+	saved, err := Open(path, DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if captures := saved.Captures(); len(captures) != 1 || captures[0].Count != 1 {
+		t.Errorf("saved captures = %+v", captures)
+	}
+
+	if err := store.Acknowledge("unknown", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("acknowledging an unknown fingerprint: %v", err)
+	}
+	if err := store.Acknowledge(capture.Fingerprint, "Page de maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	store.RecordParseFailure("courses", "presences", "jdoe", presencesPage("Go"), errNoCourse)
+
+	stats := store.Stats()
+	if len(stats) != 1 || stats[0].Failures != 3 || stats[0].Drift != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// The captures and acknowledged fingerprints survive a restart
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(path, DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captures = reopened.Captures()
+	if len(captures) != 1 || captures[0].Drift || captures[0].Note != "Page de maintenance" || captures[0].Count != 3 {
+		t.Errorf("captures after restart = %+v", captures)
+	}
+}
@@ -0,0 +1,208 @@
+package diagnostics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	// tokenPattern matches session identifiers, CSRF tokens and the like.
+	tokenPattern = regexp.MustCompile(`[A-Za-z0-9_\-]{20,}`)
+	// numberPattern matches student, phone and course numbers, but not the
+	// times, dates and marks the parsers read.
+	numberPattern = regexp.MustCompile(`\d{5,}`)
+	// stringPattern matches the string literals of a script.
+	stringPattern = regexp.MustCompile(`'[^'\n]*'|"[^"\n]*"`)
+	// keptLiteralPattern matches the script literals kept as they are: the
+	// identifiers, such as the act values of the presence buttons, and the
+	// paths of the pages they post to.
+	keptLiteralPattern = regexp.MustCompile(`^(?:[A-Za-z_][A-Za-z0-9_]{0,30}|/[A-Za-z0-9_./\-]*)$`)
+)
+
+// keptAttributes are the attributes whose value is kept, once scrubbed of
+// tokens, as the parsers rely on them.
+var keptAttributes = map[string]bool{
+	"class": true, "id": true, "type": true, "name": true, "colspan": true,
+	"rowspan": true, "data-act": true, "data-toggle": true, "data-dismiss": true,
+	"role": true, "lang": true, "charset": true, "rel": true, "method": true,
+}
+
+// Redact removes the sensitive data of a Pepal page while keeping its
+// structure and the texts the parsers look for:
+//   - form values, unknown attributes and the query values of links are
+//     dropped;
+//   - the user menu, which shows the name of the student, is emptied;
+//   - the username, email addresses, long numbers and tokens are replaced
+//     in the remaining texts;
+//   - the string literals of scripts are dropped, except identifiers and
+//     paths;
+//   - comments are removed.
+func Redact(page, username string) string {
+	r := newRedactor(username)
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		return r.text(page)
+	}
+
+	var walk func(n *html.Node, userMenu bool)
+	walk = func(n *html.Node, userMenu bool) {
+		switch n.Type {
+		case html.CommentNode:
+			n.Parent.RemoveChild(n)
+			return
+		case html.TextNode:
+			switch {
+			case n.Parent != nil && n.Parent.Type == html.ElementNode && n.Parent.Data == "script":
+				n.Data = r.script(n.Data)
+			case userMenu && strings.TrimSpace(n.Data) != "":
+				n.Data = "[name]"
+			default:
+				n.Data = r.text(n.Data)
+			}
+		case html.ElementNode:
+			userMenu = userMenu || isUserMenu(n)
+			attrs := n.Attr[:0]
+			for _, attr := range n.Attr {
+				switch {
+				case attr.Key == "href" || attr.Key == "src" || attr.Key == "action":
+					attr.Val = r.url(attr.Val)
+				case keptAttributes[attr.Key]:
+					attr.Val = r.text(attr.Val)
+				case strings.HasPrefix(attr.Key, "on"):
+					attr.Val = r.script(attr.Val)
+				default:
+					attr.Val = "[redacted]"
+				}
+				attrs = append(attrs, attr)
+			}
+			n.Attr = attrs
+		}
+
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			walk(c, userMenu)
+			c = next
+		}
+	}
+	walk(doc, false)
+
+	var b strings.Builder
+	if err := html.Render(&b, doc); err != nil {
+		return r.text(page)
+	}
+	return b.String()
+}
+
+// isUserMenu reports whether an element holds the name of the logged in
+// student, as the user menu of the Pepal header does.
+func isUserMenu(n *html.Node) bool {
+	for _, class := range classes(n) {
+		if strings.Contains(class, "user") || class == "dropdown-toggle" {
+			return true
+		}
+	}
+	return false
+}
+
+// redactor scrubs the texts of a page viewed by a user.
+type redactor struct {
+	// user matches the username, nil when it is unknown.
+	user *regexp.Regexp
+}
+
+func newRedactor(username string) redactor {
+	if username == "" {
+		return redactor{}
+	}
+	return redactor{user: regexp.MustCompile(`(?i)` + regexp.QuoteMeta(username))}
+}
+
+func (r redactor) text(text string) string {
+	if r.user != nil {
+		text = r.user.ReplaceAllString(text, "[user]")
+	}
+	text = emailPattern.ReplaceAllString(text, "[email]")
+	text = tokenPattern.ReplaceAllString(text, "[token]")
+	return numberPattern.ReplaceAllString(text, "[number]")
+}
+
+func (r redactor) script(script string) string {
+	script = stringPattern.ReplaceAllStringFunc(script, func(literal string) string {
+		value := literal[1 : len(literal)-1]
+		if keptLiteralPattern.MatchString(value) {
+			return literal
+		}
+		return literal[:1] + "[redacted]" + literal[:1]
+	})
+	return r.text(script)
+}
+
+// url keeps the path of a link and the names of its query parameters.
+func (r redactor) url(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[redacted]"
+	}
+	query := u.Query()
+	for key := range query {
+		query[key] = []string{"x"}
+	}
+	u.RawQuery = query.Encode()
+	u.User = nil
+	u.Fragment = ""
+	return r.text(u.String())
+}
+
+// Fingerprint hashes the structure of a page: its elements and their
+// classes, ignoring the texts, the other attributes and the repetitions of
+// a sibling, so the pages of a template share a fingerprint whatever their
+// data and number of rows.
+func Fingerprint(page string) string {
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(signature(doc)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// signature describes an element and its descendants.
+func signature(n *html.Node) string {
+	var children []string
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		child := signature(c)
+		if len(children) > 0 && children[len(children)-1] == child {
+			continue
+		}
+		children = append(children, child)
+	}
+
+	name := n.Data
+	if n.Type == html.ElementNode {
+		sorted := classes(n)
+		sort.Strings(sorted)
+		if len(sorted) > 0 {
+			name += "." + strings.Join(sorted, ".")
+		}
+	}
+	return name + "(" + strings.Join(children, ",") + ")"
+}
+
+func classes(n *html.Node) []string {
+	for _, attr := range n.Attr {
+		if attr.Key == "class" {
+			return strings.Fields(attr.Val)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"helper/v3/calendarcache"
+	"helper/v3/controllers"
+	"net/http"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// problem is the RFC 7807 body of every error of the API. Code is stable, so
+// the clients can react to an error without matching on its detail: it is the
+// code of the typed Pepal errors, or else the status text in snake case, such
+// as "not_found".
+type problem struct {
+	huma.ErrorModel
+	Code string `json:"code" example:"auth_expired" doc:"Stable machine-readable error code"`
+}
+
+// problemTypes is the prefix of the problem type of the typed Pepal errors,
+// followed by their code. The other errors have no type, meaning about:blank.
+const problemTypes = "/problems/"
+
+// problemStatus maps the codes of the typed Pepal errors to their status.
+var problemStatus = map[controllers.Code]int{
+	controllers.CodeAuthExpired:         http.StatusUnauthorized,
+	controllers.CodeInvalidCredentials:  http.StatusUnauthorized,
+	controllers.CodeCourseNotToday:      http.StatusNotFound,
+	controllers.CodeAttendanceNotOpen:   http.StatusConflict,
+	controllers.CodeUpstreamUnavailable: http.StatusServiceUnavailable,
+	controllers.CodeParseFailure:        http.StatusBadGateway,
+}
+
+// newHumaError is the constructor of the Huma errors wrapped by newProblem.
+var newHumaError = huma.NewError
+
+func init() {
+	huma.NewError = newProblem
+}
+
+// newProblem builds every error Huma returns, adding the code derived from
+// the status.
+func newProblem(status int, msg string, errs ...error) huma.StatusError {
+	p := &problem{Code: strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))}
+	if model, ok := newHumaError(status, msg, errs...).(*huma.ErrorModel); ok {
+		p.ErrorModel = *model
+	}
+	return p
+}
+
+// apiError turns the typed errors of a handler into their problem. The other
+// errors are returned as they are, and those without a status become 500s.
+func apiError(err error) error {
+	var typed *controllers.Error
+	switch {
+	case errors.As(err, &typed):
+		status, ok := problemStatus[typed.Code]
+		if !ok {
+			status = http.StatusInternalServerError
+		}
+		p := newProblem(status, err.Error()).(*problem)
+		p.Type = problemTypes + string(typed.Code)
+		p.Code = string(typed.Code)
+		return p
+	case errors.Is(err, calendarcache.ErrInvalidUUID):
+		return huma.Error422UnprocessableEntity(err.Error())
+	}
+	return err
+}
+
+// register registers an operation like huma.Register, with its typed errors
+// turned into their problem.
+func register[I, O any](api huma.API, op huma.Operation, handler func(context.Context, *I) (*O, error)) {
+	huma.Register(api, op, func(ctx context.Context, input *I) (*O, error) {
+		output, err := handler(ctx, input)
+		if err != nil {
+			return nil, apiError(err)
+		}
+		return output, nil
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"helper/v3/gradewatch"
+	"helper/v3/models"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+var errGradeWatchDisabled = huma.Error501NotImplemented("the grade watcher is disabled on this server")
+
+// addGradeWatchRoutes registers the endpoints subscribing the session user
+// to the grade watcher and listing the changes it found.
+func (a *app) addGradeWatchRoutes(api huma.API) {
+	// Watch Grades
+	register(api, huma.Operation{
+		OperationID: "watchGrades",
+		Method:      http.MethodPost,
+		Path:        "/grades/watch",
+		Summary:     "Watch Grades",
+		Description: "Poll the grades of the session user in the background and report the new, changed and commented grades. Requires stored credentials.",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.GradeWatchOutput, error) {
+		if a.grades == nil {
+			return nil, errGradeWatchDisabled
+		}
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		if !a.vault.Has(session.Username) {
+			return nil, huma.Error412PreconditionFailed("store your credentials with /credentials first")
+		}
+		subscription, err := a.grades.Subscribe(session.Username)
+		if err != nil {
+			return nil, err
+		}
+		return gradeWatchOutput(subscription), nil
+	})
+
+	// Get Grade Watch
+	register(api, huma.Operation{
+		OperationID: "getGradeWatch",
+		Method:      http.MethodGet,
+		Path:        "/grades/watch",
+		Summary:     "Get Grade Watch",
+		Description: "Get the grade watcher subscription of the session user",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.GradeWatchOutput, error) {
+		if a.grades == nil {
+			return nil, errGradeWatchDisabled
+		}
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		subscription, err := a.grades.Subscription(session.Username)
+		if err != nil {
+			return nil, gradeWatchError(err)
+		}
+		return gradeWatchOutput(subscription), nil
+	})
+
+	// Stop Watching Grades
+	register(api, huma.Operation{
+		OperationID: "unwatchGrades",
+		Method:      http.MethodDelete,
+		Path:        "/grades/watch",
+		Summary:     "Stop Watching Grades",
+		Description: "Stop polling the grades of the session user",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.GenericOutput, error) {
+		if a.grades == nil {
+			return nil, errGradeWatchDisabled
+		}
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.grades.Unsubscribe(session.Username); err != nil {
+			return nil, gradeWatchError(err)
+		}
+		resp := &models.GenericOutput{}
+		resp.Body.Message = "Grade watcher disabled"
+		return resp, nil
+	})
+
+	// Get Grade Events
+	register(api, huma.Operation{
+		OperationID: "getGradeEvents",
+		Method:      http.MethodGet,
+		Path:        "/grades/events",
+		Summary:     "Get Grade Events",
+		Description: "Get the grade changes found by the grade watcher for the session user",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.GradeEventsOutput, error) {
+		if a.grades == nil {
+			return nil, errGradeWatchDisabled
+		}
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		resp := &models.GradeEventsOutput{}
+		resp.Body.Events = a.grades.Events(session.Username)
+		return resp, nil
+	})
+}
+
+func gradeWatchOutput(subscription gradewatch.Subscription) *models.GradeWatchOutput {
+	resp := &models.GradeWatchOutput{}
+	resp.Body.WatchingSince = subscription.CreatedAt
+	resp.Body.LastPoll = subscription.LastPoll
+	return resp
+}
+
+func gradeWatchError(err error) error {
+	if errors.Is(err, gradewatch.ErrNotWatching) {
+		return huma.Error404NotFound(err.Error())
+	}
+	return err
+}
@@ -0,0 +1,317 @@
+// Package gradewatch polls the grades of the users who opted in and reports
+// the grades published, changed or commented since the previous poll, so
+// students no longer have to refresh Pepal while waiting for their results.
+package gradewatch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"helper/v3/atomicfile"
+	"helper/v3/controllers"
+	"helper/v3/models"
+	"helper/v3/notify"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNotWatching is returned when the grades of a user are not watched.
+var ErrNotWatching = errors.New("the grades of the user are not watched")
+
+// maxEventsPerUser bounds the events kept for each user.
+const maxEventsPerUser = 200
+
+// Subscription is a user whose grades are watched.
+type Subscription struct {
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	LastPoll  time.Time `json:"last_poll,omitempty"`
+}
+
+// state is what the watcher persists between restarts.
+type state struct {
+	Subscriptions map[string]Subscription        `json:"subscriptions"`
+	Snapshots     map[string][]models.Grade      `json:"snapshots"`
+	Events        map[string][]models.GradeEvent `json:"events"`
+}
+
+// Watcher polls the grades of the subscribed users. It is safe for
+// concurrent use.
+type Watcher struct {
+	// Notifier, when set, is told about every grade event.
+	Notifier notify.Notifier
+
+	pepal    *controllers.PepalClient
+	logins   *controllers.Logins
+	path     string
+	interval time.Duration
+
+	mu    sync.Mutex
+	state state
+}
+
+// New returns a watcher polling every interval and persisting its state at
+// path, loading the state left by a previous run if any.
+func New(pepal *controllers.PepalClient, login controllers.LoginFunc, path string, interval time.Duration) (*Watcher, error) {
+	w := &Watcher{
+		pepal:    pepal,
+		logins:   controllers.NewLogins(login),
+		path:     path,
+		interval: interval,
+		state: state{
+			Subscriptions: make(map[string]Subscription),
+			Snapshots:     make(map[string][]models.Grade),
+			Events:        make(map[string][]models.GradeEvent),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading grade watcher state: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &w.state); err != nil {
+			return nil, fmt.Errorf("error decoding grade watcher state: %v", err)
+		}
+	}
+	return w, nil
+}
+
+// Subscribe starts watching the grades of a user. The first poll only
+// takes the snapshot the next ones are compared to.
+func (w *Watcher) Subscribe(username string) (Subscription, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	subscription, ok := w.state.Subscriptions[username]
+	if !ok {
+		subscription = Subscription{Username: username, CreatedAt: time.Now()}
+		w.state.Subscriptions[username] = subscription
+	}
+	return subscription, w.save()
+}
+
+// Unsubscribe stops watching the grades of a user and forgets their
+// snapshot. Their events are kept.
+func (w *Watcher) Unsubscribe(username string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.state.Subscriptions[username]; !ok {
+		return ErrNotWatching
+	}
+	delete(w.state.Subscriptions, username)
+	delete(w.state.Snapshots, username)
+	w.logins.Forget(username)
+	return w.save()
+}
+
+// Subscription returns the subscription of a user.
+func (w *Watcher) Subscription(username string) (Subscription, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	subscription, ok := w.state.Subscriptions[username]
+	if !ok {
+		return Subscription{}, ErrNotWatching
+	}
+	return subscription, nil
+}
+
+// Events returns the grade events of a user, oldest first.
+func (w *Watcher) Events(username string) []models.GradeEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]models.GradeEvent(nil), w.state.Events[username]...)
+}
+
+// Run polls until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) {
+	log.Info().Dur("interval", w.interval).Msg("Grade watcher started")
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("Grade watcher stopped")
+			return
+		case <-ticker.C:
+		}
+		w.pollAll(ctx)
+	}
+}
+
+// pollAll polls the subscribed users one after the other, as grades are not
+// urgent enough to burst requests to Pepal.
+func (w *Watcher) pollAll(ctx context.Context) {
+	w.mu.Lock()
+	usernames := make([]string, 0, len(w.state.Subscriptions))
+	for username := range w.state.Subscriptions {
+		usernames = append(usernames, username)
+	}
+	w.mu.Unlock()
+
+	for _, username := range usernames {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := w.poll(ctx, username); err != nil {
+			log.Error().Err(err).Str("username", username).Msg("Grade watcher poll failed")
+		}
+	}
+}
+
+// poll fetches the grades of a user and records the changes since the
+// previous snapshot.
+func (w *Watcher) poll(ctx context.Context, username string) error {
+	auth := w.logins.Auth(username)
+	grades, err := w.pepal.FetchGrades(ctx, auth)
+	w.rememberCookie(auth)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	events, err := w.update(username, grades, now)
+	if err != nil {
+		return err
+	}
+	if w.Notifier != nil {
+		for _, event := range events {
+			w.Notifier.Notify(notification(username, event))
+		}
+	}
+	return nil
+}
+
+// update stores the new snapshot of the grades of a user and returns the
+// changes since the previous one.
+func (w *Watcher) update(username string, grades []models.Grade, now time.Time) ([]models.GradeEvent, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	subscription, ok := w.state.Subscriptions[username]
+	if !ok {
+		// Unsubscribed while polling
+		return nil, nil
+	}
+	previous, ok := w.state.Snapshots[username]
+	if len(grades) == 0 && len(previous) > 0 {
+		// Grades are not removed once published: an empty page after a full
+		// one is a maintenance or error page, and taking it as the snapshot
+		// would report every grade as new on the next poll
+		log.Warn().Str("username", username).Msg("Grades page without grades, snapshot kept")
+		return nil, nil
+	}
+	var events []models.GradeEvent
+	if ok {
+		events = Diff(previous, grades, now)
+		for _, event := range events {
+			log.Info().Str("username", username).Str("type", string(event.Type)).
+				Str("subject", event.Grade.Subject).Msg("Grade change found")
+		}
+		all := append(w.state.Events[username], events...)
+		if len(all) > maxEventsPerUser {
+			all = all[len(all)-maxEventsPerUser:]
+		}
+		w.state.Events[username] = all
+	}
+	if grades == nil {
+		grades = []models.Grade{}
+	}
+	w.state.Snapshots[username] = grades
+	subscription.LastPoll = now
+	w.state.Subscriptions[username] = subscription
+	return events, w.save()
+}
+
+// notification describes a grade event for the user.
+func notification(username string, event models.GradeEvent) notify.Notification {
+	grade := event.Grade
+	n := notify.Notification{Username: username, Data: event, At: event.At}
+	switch event.Type {
+	case models.GradeEventNew:
+		n.Kind = notify.KindGradeNew
+		n.Title = "Nouvelle note en " + grade.Course
+		n.Message = fmt.Sprintf("%s (%s) : %s", grade.Subject, grade.Date, grade.Grade)
+	case models.GradeEventChanged:
+		n.Kind = notify.KindGradeChanged
+		n.Title = "Note modifiée en " + grade.Course
+		n.Message = fmt.Sprintf("%s (%s) : %s → %s", grade.Subject, grade.Date, event.Previous.Grade, grade.Grade)
+	case models.GradeEventCommentAdded:
+		n.Kind = notify.KindGradeComment
+		n.Title = "Nouveau commentaire en " + grade.Course
+		n.Message = fmt.Sprintf("%s (%s) : %s", grade.Subject, grade.Date, grade.Comment)
+	}
+	return n
+}
+
+// gradeKeys identify the grades across polls by unit, course, subject and
+// date. Grades sharing all four, such as two marks of the same exam, are told
+// apart by their rank among them, in the order of the rows of the course.
+func gradeKeys(grades []models.Grade) []string {
+	keys := make([]string, len(grades))
+	seen := make(map[string]int, len(grades))
+	for i, grade := range grades {
+		key := grade.Unit + "\x00" + grade.Course + "\x00" + grade.Subject + "\x00" + grade.Date
+		keys[i] = key + "\x00" + strconv.Itoa(seen[key])
+		seen[key]++
+	}
+	return keys
+}
+
+// Diff compares two snapshots of the grades of a user. A grade is new when
+// it appears published or gets published; a published grade whose mark
+// changes is changed; a comment added or edited on a published grade is
+// reported as well. Unpublished grades are ignored until their publication.
+func Diff(previous, current []models.Grade, at time.Time) []models.GradeEvent {
+	known := make(map[string]models.Grade, len(previous))
+	for i, key := range gradeKeys(previous) {
+		known[key] = previous[i]
+	}
+	keys := gradeKeys(current)
+
+	var events []models.GradeEvent
+	for i, grade := range current {
+		if !grade.Published {
+			continue
+		}
+		old, ok := known[keys[i]]
+		switch {
+		case !ok || !old.Published:
+			events = append(events, models.GradeEvent{Type: models.GradeEventNew, Grade: grade, At: at})
+		case old.Grade != grade.Grade:
+			events = append(events, models.GradeEvent{Type: models.GradeEventChanged, Grade: grade, Previous: &old, At: at})
+		case grade.Comment != "" && old.Comment != grade.Comment:
+			events = append(events, models.GradeEvent{Type: models.GradeEventCommentAdded, Grade: grade, Previous: &old, At: at})
+		}
+	}
+	return events
+}
+
+// rememberCookie keeps the cookie of a user for the next poll, unless they
+// unsubscribed meanwhile.
+func (w *Watcher) rememberCookie(auth *controllers.Auth) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.state.Subscriptions[auth.Username]; ok {
+		w.logins.Remember(auth)
+	}
+}
+
+// save writes the state to disk. The caller must hold w.mu.
+func (w *Watcher) save() error {
+	data, err := json.MarshalIndent(w.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(w.path, data, 0o700); err != nil {
+		return fmt.Errorf("error writing grade watcher state: %v", err)
+	}
+	return nil
+}
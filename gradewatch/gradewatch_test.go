@@ -0,0 +1,137 @@
+package gradewatch
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"helper/v3/models"
+)
+
+// event is the part of a GradeEvent the tests compare.
+type event struct {
+	Type     models.GradeEventType
+	Unit     string
+	Subject  string
+	Grade    string
+	Previous string
+}
+
+func summarise(events []models.GradeEvent) []event {
+	summary := []event{}
+	for _, e := range events {
+		s := event{Type: e.Type, Unit: e.Grade.Unit, Subject: e.Grade.Subject, Grade: e.Grade.Grade}
+		if e.Previous != nil {
+			s.Previous = e.Previous.Grade
+		}
+		summary = append(summary, s)
+	}
+	return summary
+}
+
+func TestDiff(t *testing.T) {
+	grade := func(unit, subject, mark string) models.Grade {
+		return models.Grade{Unit: unit, Course: "GOLANG", Subject: subject, Date: "13/06/2024", Grade: mark, Published: true}
+	}
+	tp := grade("UE 1", "TP", "12")
+	exam := grade("UE 1", "Examen", "15")
+	unpublished := exam
+	unpublished.Published = false
+	commented := exam
+	commented.Comment = "Bon travail"
+
+	for name, test := range map[string]struct {
+		previous, current []models.Grade
+		want              []event
+	}{
+		"unchanged": {
+			previous: []models.Grade{tp, exam},
+			current:  []models.Grade{tp, exam},
+			want:     []event{},
+		},
+		"new": {
+			previous: []models.Grade{tp},
+			current:  []models.Grade{tp, exam},
+			want:     []event{{models.GradeEventNew, "UE 1", "Examen", "15", ""}},
+		},
+		"unpublished": {
+			previous: []models.Grade{tp},
+			current:  []models.Grade{tp, unpublished},
+			want:     []event{},
+		},
+		"published": {
+			previous: []models.Grade{tp, unpublished},
+			current:  []models.Grade{tp, exam},
+			want:     []event{{models.GradeEventNew, "UE 1", "Examen", "15", ""}},
+		},
+		"changed": {
+			previous: []models.Grade{tp, exam},
+			current:  []models.Grade{tp, grade("UE 1", "Examen", "16")},
+			want:     []event{{models.GradeEventChanged, "UE 1", "Examen", "16", "15"}},
+		},
+		"comment": {
+			previous: []models.Grade{tp, exam},
+			current:  []models.Grade{tp, commented},
+			want:     []event{{models.GradeEventCommentAdded, "UE 1", "Examen", "15", "15"}},
+		},
+		"same subject and date twice, second changed": {
+			previous: []models.Grade{tp, grade("UE 1", "TP", "8")},
+			current:  []models.Grade{tp, grade("UE 1", "TP", "9")},
+			want:     []event{{models.GradeEventChanged, "UE 1", "TP", "9", "8"}},
+		},
+		"same subject and date twice, second added": {
+			previous: []models.Grade{tp},
+			current:  []models.Grade{tp, grade("UE 1", "TP", "12")},
+			want:     []event{{models.GradeEventNew, "UE 1", "TP", "12", ""}},
+		},
+		"same course in two units": {
+			previous: []models.Grade{tp},
+			current:  []models.Grade{tp, grade("UE 2", "TP", "14")},
+			want:     []event{{models.GradeEventNew, "UE 2", "TP", "14", ""}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := summarise(Diff(test.previous, test.current, time.Now()))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("events = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestEmptyPageKeepsSnapshot checks that a grades page without grades, such
+// as a maintenance page, neither replaces the snapshot nor makes the next
+// poll report every grade again.
+func TestEmptyPageKeepsSnapshot(t *testing.T) {
+	w, err := New(nil, nil, filepath.Join(t.TempDir(), "grades.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Subscribe("jdoe"); err != nil {
+		t.Fatal(err)
+	}
+	exam := models.Grade{Unit: "UE 1", Course: "GOLANG", Subject: "Examen", Date: "13/06/2024", Grade: "15", Published: true}
+
+	for i, step := range []struct {
+		grades []models.Grade
+		want   int
+	}{
+		// An empty first snapshot is kept, as long as there was no grade
+		{nil, 0},
+		{[]models.Grade{exam}, 1},
+		{nil, 0},
+		{[]models.Grade{exam}, 0},
+	} {
+		events, err := w.update("jdoe", step.grades, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != step.want {
+			t.Errorf("poll %d: events = %+v, want %d", i, summarise(events), step.want)
+		}
+	}
+	if snapshot := w.state.Snapshots["jdoe"]; len(snapshot) != 1 {
+		t.Errorf("snapshot = %+v", snapshot)
+	}
+}
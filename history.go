@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"helper/v3/models"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// addHistoryRoutes registers the endpoint reporting the attendance history
+// and absence statistics of the session user.
+func (a *app) addHistoryRoutes(api huma.API) {
+	// Get Attendance History
+	register(api, huma.Operation{
+		OperationID: "getAttendanceHistory",
+		Method:      http.MethodGet,
+		Path:        "/attendance/history",
+		Summary:     "Get Attendance History",
+		Description: "Get the outcome of the past courses of the session user and their absence rates per semester and subject. Only the courses whose closed roll call was seen through this API or the presence scheduler are known.",
+	}, func(ctx context.Context, input *struct {
+		Token    string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		Semester string `query:"semester" example:"2024-2025 S1" doc:"Only report this semester, overall statistics included"`
+	}) (*models.AttendanceHistoryOutput, error) {
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := &models.AttendanceHistoryOutput{}
+		thresholds := a.history.Thresholds()
+		resp.Body.Threshold = thresholds.Limit
+		resp.Body.Warning = thresholds.Warning
+		resp.Body.Overall, resp.Body.Semesters = a.history.Stats(session.Username)
+		resp.Body.Records = []models.AttendanceRecord{}
+		for _, record := range a.history.Records(session.Username) {
+			if input.Semester == "" || record.Semester == input.Semester {
+				resp.Body.Records = append(resp.Body.Records, record)
+			}
+		}
+		if input.Semester != "" {
+			var semesters []models.SemesterStats
+			resp.Body.Overall = models.AbsenceStats{Level: thresholds.Level(0)}
+			for _, semester := range resp.Body.Semesters {
+				if semester.Semester == input.Semester {
+					semesters = append(semesters, semester)
+					resp.Body.Overall = semester.AbsenceStats
+				}
+			}
+			resp.Body.Semesters = semesters
+		}
+		if resp.Body.Semesters == nil {
+			resp.Body.Semesters = []models.SemesterStats{}
+		}
+		return resp, nil
+	})
+}
@@ -0,0 +1,326 @@
+// Package history keeps the attendance outcomes of past courses, built from
+// the roll call states read on Pepal, and computes the absence statistics of
+// each user per subject and per semester against the school threshold.
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"helper/v3/atomicfile"
+	"helper/v3/models"
+	"helper/v3/notify"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxRecordsPerUser bounds the records kept for each user, a few school
+// years of courses.
+const maxRecordsPerUser = 5000
+
+// Thresholds are the absence rates, in percent, from which a user is warned
+// and past which the school sanctions them.
+type Thresholds struct {
+	Warning float64
+	Limit   float64
+}
+
+// DefaultThresholds warns from 8% of courses missed, the limit being 10%.
+var DefaultThresholds = Thresholds{Warning: 8, Limit: 10}
+
+// Level returns the position of an absence rate against the thresholds.
+func (t Thresholds) Level(rate float64) models.AbsenceLevel {
+	switch {
+	case t.Limit > 0 && rate >= t.Limit:
+		return models.AbsenceExceeded
+	case t.Warning > 0 && rate >= t.Warning:
+		return models.AbsenceWarning
+	default:
+		return models.AbsenceOK
+	}
+}
+
+// Semester returns the semester of a day, in the 2006-01-02 format: the
+// first one runs from September to January, the second from February to
+// August.
+func Semester(day string) string {
+	date, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return ""
+	}
+	year := date.Year()
+	switch {
+	case date.Month() >= time.September:
+		return fmt.Sprintf("%d-%d S1", year, year+1)
+	case date.Month() == time.January:
+		return fmt.Sprintf("%d-%d S1", year-1, year)
+	default:
+		return fmt.Sprintf("%d-%d S2", year-1, year)
+	}
+}
+
+// Store holds the attendance records of the users. It is safe for concurrent
+// use.
+type Store struct {
+	path       string
+	thresholds Thresholds
+
+	// Notifier, when set, is told when an absence brings the rate of a
+	// user's semester to the warning or the limit.
+	Notifier notify.Notifier
+
+	mu      sync.Mutex
+	records map[string][]models.AttendanceRecord
+}
+
+// Open returns a store persisting the records at path, loading the ones left
+// by a previous run if any.
+func Open(path string, thresholds Thresholds) (*Store, error) {
+	s := &Store{
+		path:       path,
+		thresholds: thresholds,
+		records:    make(map[string][]models.AttendanceRecord),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading attendance history: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.records); err != nil {
+			return nil, fmt.Errorf("error decoding attendance history: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// Thresholds returns the absence thresholds of the store.
+func (s *Store) Thresholds() Thresholds {
+	return s.thresholds
+}
+
+// RecordAttendance stores the outcome of a course of the day, replacing the
+// one already known for it. A late presence is kept when the course is seen
+// again as closed with the user present, since Pepal does not tell them apart.
+// An absence bringing the semester to a higher absence level is notified.
+func (s *Store) RecordAttendance(username, day string, course models.Course, outcome models.AttendanceOutcome, at time.Time) {
+	if username == "" {
+		return
+	}
+
+	s.add(username, models.AttendanceRecord{
+		Day:        day,
+		Semester:   Semester(day),
+		CourseID:   course.ID,
+		Subject:    course.Name,
+		Outcome:    outcome,
+		RecordedAt: at,
+	})
+}
+
+// RecordMissed stores an absence for a course of a past day whose roll call
+// was not seen closed, unless its outcome is already known. It is marked as
+// inferred, and replaced if the roll call is read later on.
+func (s *Store) RecordMissed(username, day string, course models.Course, at time.Time) {
+	if username == "" {
+		return
+	}
+
+	s.add(username, models.AttendanceRecord{
+		Day:        day,
+		Semester:   Semester(day),
+		CourseID:   course.ID,
+		Subject:    course.Name,
+		Outcome:    models.OutcomeAbsent,
+		Inferred:   true,
+		RecordedAt: at,
+	})
+}
+
+// add stores a record, warning about and notifying an absence bringing the
+// semester to a higher absence level.
+func (s *Store) add(username string, record models.AttendanceRecord) {
+	previous, current, ok := s.record(username, record)
+	if !ok || record.Outcome != models.OutcomeAbsent || current.Level == models.AbsenceOK {
+		return
+	}
+	log.Warn().Str("username", username).Str("semester", record.Semester).
+		Float64("absence_rate", current.AbsenceRate).Str("level", string(current.Level)).
+		Msg("Absence rate near or past the school threshold")
+	if s.Notifier != nil && levelRank(current.Level) > levelRank(previous.Level) {
+		s.Notifier.Notify(s.notification(username, record.Semester, current, record.RecordedAt))
+	}
+}
+
+// record stores a record and returns the statistics of its semester before
+// and after it, ok being false when the record was already known.
+func (s *Store) record(username string, record models.AttendanceRecord) (previous, current models.AbsenceStats, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inSemester := func(r models.AttendanceRecord) bool { return r.Semester == record.Semester }
+	records := s.records[username]
+	previous = s.thresholds.stats(records, inSemester)
+	found := false
+	for i := range records {
+		if records[i].Day != record.Day || records[i].CourseID != record.CourseID {
+			continue
+		}
+		found = true
+		// An inferred absence never replaces an outcome read on Pepal
+		if record.Inferred ||
+			(records[i].Outcome == record.Outcome && !records[i].Inferred) ||
+			(records[i].Outcome == models.OutcomeLate && record.Outcome == models.OutcomePresent) {
+			return previous, previous, false
+		}
+		records[i] = record
+		break
+	}
+	if !found {
+		records = append(records, record)
+		if len(records) > maxRecordsPerUser {
+			records = records[len(records)-maxRecordsPerUser:]
+		}
+	}
+	s.records[username] = records
+
+	if err := s.save(); err != nil {
+		log.Error().Err(err).Msg("Error saving attendance history")
+	}
+	return previous, s.thresholds.stats(records, inSemester), true
+}
+
+// levelRank orders the absence levels, so a notification is only sent when
+// the rate reaches a higher one.
+func levelRank(level models.AbsenceLevel) int {
+	switch level {
+	case models.AbsenceExceeded:
+		return 2
+	case models.AbsenceWarning:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// notification returns the alert of a semester whose absence rate reached
+// the warning or the limit.
+func (s *Store) notification(username, semester string, stats models.AbsenceStats, at time.Time) notify.Notification {
+	title := "Seuil d'absence bientôt atteint"
+	threshold := s.thresholds.Warning
+	if stats.Level == models.AbsenceExceeded {
+		title = "Seuil d'absence dépassé"
+		threshold = s.thresholds.Limit
+	}
+	return notify.Notification{
+		Kind:     notify.KindAbsenceWarning,
+		Username: username,
+		Title:    title + " (" + semester + ")",
+		Message: fmt.Sprintf("%d absences sur %d cours au semestre %s, soit %g %% (seuil de %g %%, sanction à partir de %g %%).",
+			stats.Absent, stats.Courses, semester, stats.AbsenceRate, threshold, s.thresholds.Limit),
+		Data: stats,
+		At:   at,
+	}
+}
+
+// Records returns the attendance records of a user, oldest first.
+func (s *Store) Records(username string) []models.AttendanceRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := append([]models.AttendanceRecord(nil), s.records[username]...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Day < records[j].Day
+	})
+	return records
+}
+
+// Stats returns the absence statistics of a user over all their records and
+// for each semester, most recent first, broken down by subject.
+func (s *Store) Stats(username string) (models.AbsenceStats, []models.SemesterStats) {
+	records := s.Records(username)
+	overall := s.thresholds.stats(records, func(models.AttendanceRecord) bool { return true })
+
+	var semesters []models.SemesterStats
+	seen := make(map[string]bool)
+	for i := len(records) - 1; i >= 0; i-- {
+		semester := records[i].Semester
+		if seen[semester] {
+			continue
+		}
+		seen[semester] = true
+
+		inSemester := func(r models.AttendanceRecord) bool { return r.Semester == semester }
+		stats := models.SemesterStats{
+			Semester:     semester,
+			AbsenceStats: s.thresholds.stats(records, inSemester),
+		}
+
+		subjects := make(map[string]bool)
+		for _, record := range records {
+			if record.Semester != semester || subjects[record.Subject] {
+				continue
+			}
+			subjects[record.Subject] = true
+			subject := record.Subject
+			stats.Subjects = append(stats.Subjects, models.SubjectStats{
+				Subject: subject,
+				AbsenceStats: s.thresholds.stats(records, func(r models.AttendanceRecord) bool {
+					return inSemester(r) && r.Subject == subject
+				}),
+			})
+		}
+		sort.Slice(stats.Subjects, func(i, j int) bool {
+			return stats.Subjects[i].Subject < stats.Subjects[j].Subject
+		})
+		semesters = append(semesters, stats)
+	}
+	return overall, semesters
+}
+
+// stats counts the outcomes of the records selected by keep.
+func (t Thresholds) stats(records []models.AttendanceRecord, keep func(models.AttendanceRecord) bool) models.AbsenceStats {
+	var stats models.AbsenceStats
+	for _, record := range records {
+		if !keep(record) {
+			continue
+		}
+		stats.Courses++
+		if !record.Inferred {
+			stats.Observed++
+		}
+		switch record.Outcome {
+		case models.OutcomePresent:
+			stats.Present++
+		case models.OutcomeLate:
+			stats.Late++
+		case models.OutcomeAbsent:
+			stats.Absent++
+		}
+	}
+	if stats.Courses > 0 {
+		rate := 100 * float64(stats.Absent) / float64(stats.Courses)
+		stats.AbsenceRate = math.Round(rate*10) / 10
+		coverage := 100 * float64(stats.Observed) / float64(stats.Courses)
+		stats.Coverage = math.Round(coverage*10) / 10
+	}
+	stats.Level = t.Level(stats.AbsenceRate)
+	return stats
+}
+
+// save writes the records to disk. The caller must hold s.mu.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(s.path, data, 0o700); err != nil {
+		return fmt.Errorf("error writing attendance history: %v", err)
+	}
+	return nil
+}
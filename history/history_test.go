@@ -0,0 +1,93 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"helper/v3/models"
+	"helper/v3/notify"
+)
+
+// notifications records the notifications sent.
+type notifications []notify.Notification
+
+func (n *notifications) Notify(notification notify.Notification) {
+	*n = append(*n, notification)
+}
+
+// TestAbsenceNotification checks that an absence is notified when it brings
+// the semester to the warning, then to the limit, and only then.
+func TestAbsenceNotification(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.json"), Thresholds{Warning: 20, Limit: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent notifications
+	s.Notifier = &sent
+
+	day := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	course := 0
+	attend := func(outcome models.AttendanceOutcome) {
+		course++
+		s.RecordAttendance("jdoe", day.AddDate(0, 0, course).Format("2006-01-02"), models.Course{ID: string(rune('a' + course)), Name: "GOLANG"}, outcome, time.Now())
+	}
+
+	for range 8 {
+		attend(models.OutcomePresent)
+	}
+	attend(models.OutcomeAbsent) // 1 of 9
+	if len(sent) != 0 {
+		t.Fatalf("notified under the warning: %+v", sent)
+	}
+	attend(models.OutcomeAbsent)  // 2 of 10, the warning
+	attend(models.OutcomeAbsent)  // 3 of 11, still the warning
+	attend(models.OutcomePresent) // 3 of 12
+	attend(models.OutcomeAbsent)  // 4 of 13, the limit
+	if len(sent) != 2 {
+		t.Fatalf("notifications = %+v, want the warning and the limit", sent)
+	}
+	for i, level := range []models.AbsenceLevel{models.AbsenceWarning, models.AbsenceExceeded} {
+		if sent[i].Kind != notify.KindAbsenceWarning || sent[i].Username != "jdoe" || sent[i].Data.(models.AbsenceStats).Level != level {
+			t.Errorf("notification %d = %+v, want the %s level", i, sent[i], level)
+		}
+	}
+
+	// The same absence seen again is not notified twice
+	s.RecordAttendance("jdoe", day.AddDate(0, 0, course).Format("2006-01-02"), models.Course{ID: string(rune('a' + course)), Name: "GOLANG"}, models.OutcomeAbsent, time.Now())
+	if len(sent) != 2 {
+		t.Errorf("a known absence was notified again: %+v", sent[2:])
+	}
+}
+
+// TestMissedCourses checks that an inferred absence counts in the rates and
+// lowers the coverage, never replaces an outcome read on Pepal, and is
+// replaced by one.
+func TestMissedCourses(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.json"), DefaultThresholds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golang := models.Course{ID: "a", Name: "GOLANG"}
+	sql := models.Course{ID: "b", Name: "SQL"}
+
+	s.RecordAttendance("jdoe", "2024-10-01", golang, models.OutcomePresent, time.Now())
+	s.RecordMissed("jdoe", "2024-10-01", golang, time.Now())
+	s.RecordMissed("jdoe", "2024-10-01", sql, time.Now())
+	overall, _ := s.Stats("jdoe")
+	if overall.Courses != 2 || overall.Present != 1 || overall.Absent != 1 || overall.Observed != 1 || overall.Coverage != 50 {
+		t.Errorf("stats = %+v, want one present and one inferred absence", overall)
+	}
+
+	// The roll call read later on replaces the inferred absence
+	s.RecordAttendance("jdoe", "2024-10-01", sql, models.OutcomeAbsent, time.Now())
+	overall, _ = s.Stats("jdoe")
+	if overall.Absent != 1 || overall.Observed != 2 || overall.Coverage != 100 {
+		t.Errorf("stats after reading the roll call = %+v", overall)
+	}
+	for _, record := range s.Records("jdoe") {
+		if record.Inferred {
+			t.Errorf("record %+v still inferred", record)
+		}
+	}
+}
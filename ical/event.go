@@ -0,0 +1,180 @@
+package ical
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DateTime is a DATE or DATE-TIME value.
+type DateTime struct {
+	Time time.Time
+	// DateOnly is set for DATE values, which have no time of day.
+	DateOnly bool
+	// TZID is the time zone the value was given in, if any.
+	TZID string
+	// UnknownTZID is set when TZID names neither a zone of the time zone
+	// database nor a VTIMEZONE of the feed, the value being read as a
+	// floating time instead.
+	UnknownTZID bool
+}
+
+// Event is a VEVENT.
+type Event struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	Categories  []string
+	Start       DateTime
+	End         DateTime
+	// Extra holds the properties not mapped to a field above, such as the
+	// PROF property of the Pepal feeds.
+	Extra []Property
+}
+
+// Property returns the first extra property with the given name.
+func (e Event) Property(name string) (Property, bool) {
+	name = strings.ToUpper(name)
+	for _, prop := range e.Extra {
+		if prop.Name == name {
+			return prop, true
+		}
+	}
+	return Property{}, false
+}
+
+// Calendar is a VCALENDAR and its events.
+type Calendar struct {
+	Properties []Property
+	Events     []Event
+	// Warnings lists what was read with a fallback, such as the unknown
+	// TZIDs, once each.
+	Warnings []string
+}
+
+// ParseCalendar reads a stream holding a single VCALENDAR. Floating times,
+// given without "Z" or TZID, are read in loc, or in UTC when loc is nil. A
+// TZID missing from the time zone database is read with the VTIMEZONE of the
+// feed, and as a floating time when the feed has none usable, with a warning.
+func ParseCalendar(r io.Reader, loc *time.Location) (*Calendar, error) {
+	components, err := Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(components) != 1 || components[0].Name != "VCALENDAR" {
+		return nil, fmt.Errorf("ical: expected a single VCALENDAR")
+	}
+	root := components[0]
+
+	calendar := &Calendar{Properties: root.Properties}
+	timezones := timezonesFromComponents(root.Components)
+	unknown := make(map[string]bool)
+	for _, component := range root.Components {
+		if component.Name != "VEVENT" {
+			continue
+		}
+		event, err := eventFromComponent(component, loc, timezones)
+		if err != nil {
+			return nil, err
+		}
+		for _, dt := range []DateTime{event.Start, event.End} {
+			if dt.UnknownTZID && !unknown[dt.TZID] {
+				unknown[dt.TZID] = true
+				calendar.Warnings = append(calendar.Warnings, fmt.Sprintf("unknown TZID %q, read as a floating time", dt.TZID))
+			}
+		}
+		calendar.Events = append(calendar.Events, event)
+	}
+	return calendar, nil
+}
+
+// eventFromComponent maps a VEVENT to an Event.
+func eventFromComponent(component *Component, loc *time.Location, timezones map[string]*timezone) (Event, error) {
+	var event Event
+	for _, prop := range component.Properties {
+		var err error
+		switch prop.Name {
+		case "UID":
+			event.UID = prop.Text()
+		case "SUMMARY":
+			event.Summary = prop.Text()
+		case "DESCRIPTION":
+			event.Description = prop.Text()
+		case "LOCATION":
+			event.Location = prop.Text()
+		case "CATEGORIES":
+			event.Categories = append(event.Categories, splitText(prop.Value)...)
+		case "DTSTART":
+			event.Start, err = parseDateTime(prop, loc, timezones)
+		case "DTEND":
+			event.End, err = parseDateTime(prop, loc, timezones)
+		default:
+			event.Extra = append(event.Extra, prop)
+		}
+		if err != nil {
+			return Event{}, err
+		}
+	}
+	return event, nil
+}
+
+// ParseDateTime decodes a DATE or DATE-TIME property. UTC values, ending in
+// "Z", are returned in UTC; values with a TZID parameter in that time zone;
+// floating values and dates, with neither, in loc, or in UTC when loc is nil.
+// A TZID missing from the time zone database is read in loc as well, and
+// flagged with UnknownTZID.
+func ParseDateTime(prop Property, loc *time.Location) (DateTime, error) {
+	return parseDateTime(prop, loc, nil)
+}
+
+// parseDateTime is ParseDateTime, looking the TZIDs missing from the time
+// zone database up in the VTIMEZONE components of the feed.
+func parseDateTime(prop Property, loc *time.Location, timezones map[string]*timezone) (DateTime, error) {
+	value := prop.Value
+	dt := DateTime{TZID: prop.Param("TZID")}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	if strings.EqualFold(prop.Param("VALUE"), "DATE") || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		if err != nil {
+			return DateTime{}, fmt.Errorf("ical: invalid DATE in %s: %q", prop.Name, value)
+		}
+		dt.Time = t
+		dt.DateOnly = true
+		return dt, nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		if err != nil {
+			return DateTime{}, fmt.Errorf("ical: invalid DATE-TIME in %s: %q", prop.Name, value)
+		}
+		dt.Time = t
+		return dt, nil
+	}
+
+	if dt.TZID != "" {
+		if tz, err := time.LoadLocation(strings.TrimPrefix(dt.TZID, "/")); err == nil {
+			loc = tz
+		} else if tz, ok := timezones[dt.TZID]; ok {
+			if t, ok := tz.parseIn(value, dt.TZID); ok {
+				dt.Time = t
+				return dt, nil
+			}
+			dt.UnknownTZID = true
+		} else {
+			dt.UnknownTZID = true
+		}
+	}
+
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	if err != nil {
+		return DateTime{}, fmt.Errorf("ical: invalid DATE-TIME in %s: %q", prop.Name, value)
+	}
+	dt.Time = t
+	return dt, nil
+}
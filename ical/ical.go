@@ -0,0 +1,252 @@
+// Package ical parses iCalendar (RFC 5545) streams such as the Pepal
+// calendar feeds. It unfolds continuation lines, decodes property
+// parameters and escaped text, and maps VEVENT components to a typed model
+// while keeping the properties it does not know about.
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	// TZID parameters name IANA zones, looked up in the embedded database.
+	_ "time/tzdata"
+)
+
+// Property is a content line: a name, its parameters and its raw value.
+type Property struct {
+	Name   string
+	Params map[string][]string
+	Value  string
+}
+
+// Param returns the first value of a parameter, or "" when it is absent.
+func (p Property) Param(name string) string {
+	values := p.Params[strings.ToUpper(name)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Text returns the value decoded as a TEXT value.
+func (p Property) Text() string {
+	return UnescapeText(p.Value)
+}
+
+// Component is a BEGIN/END block, such as VCALENDAR or VEVENT.
+type Component struct {
+	Name       string
+	Properties []Property
+	Components []*Component
+}
+
+// Property returns the first property with the given name.
+func (c *Component) Property(name string) (Property, bool) {
+	name = strings.ToUpper(name)
+	for _, prop := range c.Properties {
+		if prop.Name == name {
+			return prop, true
+		}
+	}
+	return Property{}, false
+}
+
+// ParseError reports a malformed content line.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("ical: line %d: %s", e.Line, e.Msg)
+}
+
+// Parse reads an iCalendar stream and returns its top-level components,
+// usually a single VCALENDAR.
+func Parse(r io.Reader) ([]*Component, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []*Component
+	var stack []*Component
+	for _, line := range lines {
+		prop, err := parseLine(line.text)
+		if err != nil {
+			return nil, &ParseError{Line: line.number, Msg: err.Error()}
+		}
+
+		switch prop.Name {
+		case "BEGIN":
+			component := &Component{Name: strings.ToUpper(prop.Value)}
+			if len(stack) == 0 {
+				roots = append(roots, component)
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, component)
+			}
+			stack = append(stack, component)
+		case "END":
+			name := strings.ToUpper(prop.Value)
+			if len(stack) == 0 || stack[len(stack)-1].Name != name {
+				return nil, &ParseError{Line: line.number, Msg: "unexpected END:" + prop.Value}
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, &ParseError{Line: line.number, Msg: "property " + prop.Name + " outside of a component"}
+			}
+			current := stack[len(stack)-1]
+			current.Properties = append(current.Properties, prop)
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, &ParseError{Line: lines[len(lines)-1].number, Msg: "missing END:" + stack[len(stack)-1].Name}
+	}
+	return roots, nil
+}
+
+// logicalLine is an unfolded content line and the physical line it starts on.
+type logicalLine struct {
+	number int
+	text   string
+}
+
+// unfold joins the continuation lines, which start with a space or a tab, to
+// the line they continue. Both CRLF and bare LF line endings are accepted and
+// blank lines are skipped.
+func unfold(r io.Reader) ([]logicalLine, error) {
+	var lines []logicalLine
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if number == 1 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+
+		if (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1].text += text[1:]
+			continue
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		lines = append(lines, logicalLine{number: number, text: text})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// parseLine splits a content line into its name, parameters and value:
+//
+//	name *(";" param-name "=" param-value *("," param-value)) ":" value
+//
+// Parameter values may be double-quoted to contain ":", ";" or ",".
+func parseLine(line string) (Property, error) {
+	prop := Property{}
+
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return prop, fmt.Errorf("invalid content line %q", line)
+	}
+	prop.Name = strings.ToUpper(line[:i])
+
+	for line[i] == ';' {
+		i++
+		eq := strings.IndexByte(line[i:], '=')
+		if eq <= 0 {
+			return prop, fmt.Errorf("invalid parameter in %s", prop.Name)
+		}
+		name := strings.ToUpper(line[i : i+eq])
+		i += eq + 1
+
+		for {
+			var value string
+			if i < len(line) && line[i] == '"' {
+				end := strings.IndexByte(line[i+1:], '"')
+				if end < 0 {
+					return prop, fmt.Errorf("unterminated quoted parameter %s in %s", name, prop.Name)
+				}
+				value = line[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				end := strings.IndexAny(line[i:], ",;:")
+				if end < 0 {
+					return prop, fmt.Errorf("missing value in %s", prop.Name)
+				}
+				value = line[i : i+end]
+				i += end
+			}
+
+			if prop.Params == nil {
+				prop.Params = make(map[string][]string)
+			}
+			prop.Params[name] = append(prop.Params[name], value)
+
+			if i >= len(line) {
+				return prop, fmt.Errorf("missing value in %s", prop.Name)
+			}
+			if line[i] != ',' {
+				break
+			}
+			i++
+		}
+	}
+
+	if line[i] != ':' {
+		return prop, fmt.Errorf("missing value in %s", prop.Name)
+	}
+	prop.Value = line[i+1:]
+	return prop, nil
+}
+
+// UnescapeText decodes a TEXT value: "\\", "\;", "\," and "\n" or "\N".
+func UnescapeText(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// splitText splits a multi-valued TEXT value on its unescaped commas and
+// decodes each value.
+func splitText(value string) []string {
+	var values []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ',':
+			values = append(values, UnescapeText(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(values, UnescapeText(value[start:]))
+}
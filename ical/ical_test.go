@@ -0,0 +1,298 @@
+package ical
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseFixture(t *testing.T, name string, loc *time.Location) *Calendar {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	calendar, err := ParseCalendar(f, loc)
+	if err != nil {
+		t.Fatalf("ParseCalendar(%s): %v", name, err)
+	}
+	return calendar
+}
+
+// TestParseCaptures parses the anonymised captures of real feeds made with
+// cmd/icscapture. pepal_week.ics and pepal_timezones.ics are not captures:
+// they are written after the Pepal feeds and cover their known features.
+func TestParseCaptures(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	captures, err := filepath.Glob("testdata/capture_*.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) == 0 {
+		t.Skip("no capture in testdata yet")
+	}
+	for _, path := range captures {
+		calendar := parseFixture(t, filepath.Base(path), paris)
+		if len(calendar.Events) == 0 || len(calendar.Warnings) != 0 {
+			t.Errorf("%s: %d events, warnings %q", path, len(calendar.Events), calendar.Warnings)
+		}
+		for _, event := range calendar.Events {
+			if event.Start.Time.IsZero() {
+				t.Errorf("%s: event %s without start", path, event.UID)
+			}
+		}
+	}
+}
+
+func TestParseCalendarPepalWeek(t *testing.T) {
+	calendar := parseFixture(t, "pepal_week.ics", nil)
+	if len(calendar.Events) != 4 {
+		t.Fatalf("got %d events, want 4", len(calendar.Events))
+	}
+
+	golang := calendar.Events[0]
+	if golang.UID != "seance-2275021@pepal.eu" {
+		t.Errorf("UID = %q", golang.UID)
+	}
+	if want := "Cours de Go, partie 2\nApporter son ordinateur"; golang.Description != want {
+		t.Errorf("Description = %q, want %q", golang.Description, want)
+	}
+	if want := []string{"Cours", "Présentiel"}; !reflect.DeepEqual(golang.Categories, want) {
+		t.Errorf("Categories = %q, want %q", golang.Categories, want)
+	}
+	if want := time.Date(2024, 6, 10, 9, 0, 0, 0, time.UTC); !golang.Start.Time.Equal(want) {
+		t.Errorf("Start = %v, want %v", golang.Start.Time, want)
+	}
+	if prof, ok := golang.Property("PROF"); !ok || prof.Text() != "John DOE" {
+		t.Errorf("PROF = %q, %v", prof.Value, ok)
+	}
+	if _, ok := golang.Property("DTSTAMP"); !ok {
+		t.Error("DTSTAMP was not kept as an extra property")
+	}
+
+	folded := calendar.Events[1]
+	if want := "Architecture logicielle et conception orientée objet avancée pour le développement d'applications"; folded.Summary != want {
+		t.Errorf("folded Summary = %q, want %q", folded.Summary, want)
+	}
+	if folded.Location != "" {
+		t.Errorf("empty Location = %q", folded.Location)
+	}
+
+	if want := "E 210; E 211"; calendar.Events[2].Location != want {
+		t.Errorf("escaped Location = %q, want %q", calendar.Events[2].Location, want)
+	}
+
+	company := calendar.Events[3]
+	if !company.Start.DateOnly || company.Start.Time.Format("2006-01-02") != "2024-06-12" {
+		t.Errorf("DATE Start = %+v", company.Start)
+	}
+	if company.Summary != "" {
+		t.Errorf("empty Summary = %q", company.Summary)
+	}
+}
+
+func TestParseCalendarTimezones(t *testing.T) {
+	calendar := parseFixture(t, "pepal_timezones.ics", nil)
+	if len(calendar.Events) != 2 {
+		t.Fatalf("got %d events, want 2", len(calendar.Events))
+	}
+
+	paris := calendar.Events[0]
+	if paris.Start.TZID != "Europe/Paris" {
+		t.Errorf("TZID = %q", paris.Start.TZID)
+	}
+	// 28 October 2024 is after the switch to CET (UTC+1)
+	if want := time.Date(2024, 10, 28, 8, 0, 0, 0, time.UTC); !paris.Start.Time.Equal(want) {
+		t.Errorf("TZID Start = %v, want %v", paris.Start.Time.UTC(), want)
+	}
+	if loc, ok := paris.Property("LOCATION"); ok {
+		t.Errorf("LOCATION kept as extra property: %+v", loc)
+	}
+
+	utc := calendar.Events[1]
+	if want := time.Date(2024, 10, 28, 12, 30, 0, 0, time.UTC); !utc.Start.Time.Equal(want) {
+		t.Errorf("UTC Start = %v, want %v", utc.Start.Time, want)
+	}
+}
+
+func TestParseCalendarFloatingLocation(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calendar := parseFixture(t, "pepal_week.ics", paris)
+
+	// 10 June 2024 is in CEST (UTC+2)
+	if want := time.Date(2024, 6, 10, 7, 0, 0, 0, time.UTC); !calendar.Events[0].Start.Time.Equal(want) {
+		t.Errorf("floating Start = %v, want %v", calendar.Events[0].Start.Time.UTC(), want)
+	}
+	company := calendar.Events[3].Start
+	if company.Time.Location() != paris || company.Time.Hour() != 0 {
+		t.Errorf("DATE Start = %v, want midnight in Europe/Paris", company.Time)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want Property
+	}{
+		{"SUMMARY:GOLANG", Property{Name: "SUMMARY", Value: "GOLANG"}},
+		{"summary:lower case", Property{Name: "SUMMARY", Value: "lower case"}},
+		{"DTSTART;TZID=Europe/Paris:20240610T090000", Property{
+			Name:   "DTSTART",
+			Params: map[string][]string{"TZID": {"Europe/Paris"}},
+			Value:  "20240610T090000",
+		}},
+		{`ATTENDEE;DELEGATED-TO="mailto:a@b.c","mailto:d@e.f";ROLE=CHAIR:mailto:x@y.z`, Property{
+			Name:   "ATTENDEE",
+			Params: map[string][]string{"DELEGATED-TO": {"mailto:a@b.c", "mailto:d@e.f"}, "ROLE": {"CHAIR"}},
+			Value:  "mailto:x@y.z",
+		}},
+		{"DESCRIPTION:a:b;c", Property{Name: "DESCRIPTION", Value: "a:b;c"}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLine(tt.line)
+		if err != nil {
+			t.Errorf("parseLine(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nEND:VCALENDAR\n",
+		"BEGIN:VCALENDAR\nSUMMARY\nEND:VCALENDAR\n",
+		"SUMMARY:outside\n",
+		"BEGIN:VCALENDAR\nDTSTART;TZID=\"Europe/Paris:20240610T090000\nEND:VCALENDAR\n",
+	}
+
+	for _, input := range tests {
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestUnescapeText(t *testing.T) {
+	tests := map[string]string{
+		`plain`:              "plain",
+		`a\, b\; c`:          "a, b; c",
+		`line\nbreak\Nagain`: "line\nbreak\nagain",
+		`back\\slash`:        `back\slash`,
+	}
+
+	for input, want := range tests {
+		if got := UnescapeText(input); got != want {
+			t.Errorf("UnescapeText(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestParseCalendarUnknownTZID checks the TZIDs missing from the time zone
+// database: they are read with the VTIMEZONE of the feed, by its
+// X-LIC-LOCATION or its rules, and as floating times without one, instead of
+// failing the whole calendar.
+func TestParseCalendarUnknownTZID(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VTIMEZONE",
+		"TZID:Romance Standard Time",
+		"BEGIN:STANDARD",
+		"DTSTART:16010101T030000",
+		"TZOFFSETFROM:+0200",
+		"TZOFFSETTO:+0100",
+		"RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=10",
+		"END:STANDARD",
+		"BEGIN:DAYLIGHT",
+		"DTSTART:16010101T020000",
+		"TZOFFSETFROM:+0100",
+		"TZOFFSETTO:+0200",
+		"RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=3",
+		"END:DAYLIGHT",
+		"END:VTIMEZONE",
+		"BEGIN:VTIMEZONE",
+		"TZID:Paris, Madrid",
+		"X-LIC-LOCATION:Europe/Paris",
+		"END:VTIMEZONE",
+		"BEGIN:VTIMEZONE",
+		"TZID:India",
+		"BEGIN:STANDARD",
+		"DTSTART:19700101T000000",
+		"TZOFFSETFROM:+0530",
+		"TZOFFSETTO:+0530",
+		"END:STANDARD",
+		"END:VTIMEZONE",
+		"BEGIN:VEVENT",
+		"UID:summer",
+		"DTSTART;TZID=Romance Standard Time:20240610T090000",
+		"DTEND;TZID=Nowhere:20240610T120000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:winter",
+		"DTSTART;TZID=Romance Standard Time:20241104T090000",
+		"DTEND;TZID=Nowhere:20241104T120000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:switch",
+		"DTSTART;TZID=Romance Standard Time:20240331T033000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:location",
+		"DTSTART;TZID=\"Paris, Madrid\":20241104T090000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:fixed",
+		"DTSTART;TZID=India:20241104T090000",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	calendar, err := ParseCalendar(strings.NewReader(feed), paris)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []time.Time{
+		time.Date(2024, 6, 10, 7, 0, 0, 0, time.UTC),
+		time.Date(2024, 11, 4, 8, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 31, 1, 30, 0, 0, time.UTC),
+		time.Date(2024, 11, 4, 8, 0, 0, 0, time.UTC),
+		time.Date(2024, 11, 4, 3, 30, 0, 0, time.UTC),
+	} {
+		event := calendar.Events[i]
+		if !event.Start.Time.Equal(want) || event.Start.UnknownTZID {
+			t.Errorf("%s: Start = %v, unknown %v, want %v", event.UID, event.Start.Time.UTC(), event.Start.UnknownTZID, want)
+		}
+	}
+
+	// Without a VTIMEZONE, the value is read in the school time zone
+	for i, want := range []time.Time{
+		time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC),
+		time.Date(2024, 11, 4, 11, 0, 0, 0, time.UTC),
+	} {
+		end := calendar.Events[i].End
+		if !end.Time.Equal(want) || !end.UnknownTZID || end.TZID != "Nowhere" {
+			t.Errorf("%s: End = %+v, want %v read as a floating time", calendar.Events[i].UID, end, want)
+		}
+	}
+	if len(calendar.Warnings) != 1 || !strings.Contains(calendar.Warnings[0], `"Nowhere"`) {
+		t.Errorf("Warnings = %q, want the unknown TZID once", calendar.Warnings)
+	}
+}
@@ -0,0 +1,215 @@
+package ical
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timezone is a VTIMEZONE of a feed, used for the TZIDs that are not names
+// of the time zone database, such as the Windows names some exports use.
+type timezone struct {
+	// location is the zone named by X-LIC-LOCATION, if it is known.
+	location *time.Location
+	// observances are the STANDARD and DAYLIGHT rules of the component.
+	observances []observance
+}
+
+// observance is a STANDARD or DAYLIGHT sub-component: the offset in use from
+// its onsets, which repeat every year when a yearly rule is given.
+type observance struct {
+	offset     int
+	offsetFrom int
+	// start is the first onset, as a local time stored in UTC.
+	start time.Time
+	// month, week and weekday give the onsets of a yearly rule, such as the
+	// last Sunday of March for BYMONTH=3;BYDAY=-1SU. month is zero without
+	// a rule.
+	month   time.Month
+	week    int
+	weekday time.Weekday
+	until   time.Time
+}
+
+// timezonesFromComponents reads the VTIMEZONE components of a calendar by
+// TZID. Components that cannot be read are left out.
+func timezonesFromComponents(components []*Component) map[string]*timezone {
+	timezones := make(map[string]*timezone)
+	for _, component := range components {
+		if component.Name != "VTIMEZONE" {
+			continue
+		}
+		tzid, ok := component.Property("TZID")
+		if !ok {
+			continue
+		}
+		tz := &timezone{}
+		if name, ok := component.Property("X-LIC-LOCATION"); ok {
+			if location, err := time.LoadLocation(name.Value); err == nil {
+				tz.location = location
+			}
+		}
+		for _, sub := range component.Components {
+			if sub.Name != "STANDARD" && sub.Name != "DAYLIGHT" {
+				continue
+			}
+			if o, err := observanceFromComponent(sub); err == nil {
+				tz.observances = append(tz.observances, o)
+			}
+		}
+		if tz.location != nil || len(tz.observances) > 0 {
+			timezones[tzid.Value] = tz
+		}
+	}
+	return timezones
+}
+
+// observanceFromComponent reads a STANDARD or DAYLIGHT sub-component.
+func observanceFromComponent(component *Component) (observance, error) {
+	var o observance
+	to, ok := component.Property("TZOFFSETTO")
+	if !ok {
+		return o, fmt.Errorf("ical: %s without TZOFFSETTO", component.Name)
+	}
+	var err error
+	if o.offset, err = parseOffset(to.Value); err != nil {
+		return o, err
+	}
+	o.offsetFrom = o.offset
+	if from, ok := component.Property("TZOFFSETFROM"); ok {
+		if o.offsetFrom, err = parseOffset(from.Value); err != nil {
+			return o, err
+		}
+	}
+	if start, ok := component.Property("DTSTART"); ok {
+		if o.start, err = time.Parse("20060102T150405", start.Value); err != nil {
+			return o, fmt.Errorf("ical: invalid DTSTART in %s: %q", component.Name, start.Value)
+		}
+	}
+	if rule, ok := component.Property("RRULE"); ok {
+		if err := o.parseRule(rule.Value); err != nil {
+			return o, err
+		}
+	}
+	return o, nil
+}
+
+// parseOffset reads a UTC offset such as "+0100" or "-053000", in seconds.
+func parseOffset(value string) (int, error) {
+	if len(value) != 5 && len(value) != 7 || (value[0] != '+' && value[0] != '-') {
+		return 0, fmt.Errorf("ical: invalid UTC offset %q", value)
+	}
+	digits, err := strconv.Atoi(value[1:])
+	if err != nil {
+		return 0, fmt.Errorf("ical: invalid UTC offset %q", value)
+	}
+	if len(value) == 5 {
+		digits *= 100
+	}
+	seconds := digits/10000*3600 + digits/100%100*60 + digits%100
+	if value[0] == '-' {
+		seconds = -seconds
+	}
+	return seconds, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseRule reads the yearly rules of the time zones, such as
+// "FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU". Other rules are refused.
+func (o *observance) parseRule(rule string) error {
+	parts := make(map[string]string)
+	for _, part := range strings.Split(rule, ";") {
+		name, value, _ := strings.Cut(part, "=")
+		parts[strings.ToUpper(name)] = value
+	}
+	month, err := strconv.Atoi(parts["BYMONTH"])
+	byday := parts["BYDAY"]
+	if parts["FREQ"] != "YEARLY" || err != nil || month < 1 || month > 12 || len(byday) < 3 {
+		return fmt.Errorf("ical: unsupported time zone rule %q", rule)
+	}
+	weekday, ok := weekdays[byday[len(byday)-2:]]
+	week, err := strconv.Atoi(byday[:len(byday)-2])
+	if !ok || err != nil || week == 0 || week < -5 || week > 5 {
+		return fmt.Errorf("ical: unsupported time zone rule %q", rule)
+	}
+	if until := parts["UNTIL"]; until != "" {
+		if o.until, err = time.Parse("20060102T150405Z", until); err != nil {
+			return fmt.Errorf("ical: invalid UNTIL in time zone rule %q", rule)
+		}
+	}
+	o.month, o.week, o.weekday = time.Month(month), week, weekday
+	return nil
+}
+
+// onset returns the onset of the yearly rule in a year, as a local time
+// stored in UTC, or false when it has none that year.
+func (o observance) onset(year int) (time.Time, bool) {
+	clock := o.start.Sub(o.start.Truncate(24 * time.Hour))
+	var day time.Time
+	if o.week > 0 {
+		first := time.Date(year, o.month, 1, 0, 0, 0, 0, time.UTC)
+		day = first.AddDate(0, 0, (int(o.weekday)-int(first.Weekday())+7)%7+7*(o.week-1))
+	} else {
+		last := time.Date(year, o.month+1, 0, 0, 0, 0, 0, time.UTC)
+		day = last.AddDate(0, 0, -(int(last.Weekday())-int(o.weekday)+7)%7+7*(o.week+1))
+	}
+	if day.Month() != o.month {
+		return time.Time{}, false
+	}
+	onset := day.Add(clock)
+	if onset.Before(o.start) || (!o.until.IsZero() && onset.Add(-time.Duration(o.offsetFrom)*time.Second).After(o.until)) {
+		return time.Time{}, false
+	}
+	return onset, true
+}
+
+// offset returns the UTC offset, in seconds, in use at a local time stored
+// in UTC: the one of the observance with the latest onset before it.
+func (tz *timezone) offset(local time.Time) (int, bool) {
+	var latest time.Time
+	offset, found := 0, false
+	for _, o := range tz.observances {
+		onsets := []time.Time{o.start}
+		if o.month != 0 {
+			onsets = nil
+			for _, year := range []int{local.Year(), local.Year() - 1} {
+				if onset, ok := o.onset(year); ok {
+					onsets = append(onsets, onset)
+				}
+			}
+		}
+		for _, onset := range onsets {
+			if onset.After(local) {
+				continue
+			}
+			if !found || onset.After(latest) {
+				latest, offset, found = onset, o.offset, true
+			}
+			break
+		}
+	}
+	return offset, found
+}
+
+// parseIn reads a local DATE-TIME value in the time zone of the feed.
+func (tz *timezone) parseIn(value, tzid string) (time.Time, bool) {
+	if tz.location != nil {
+		t, err := time.ParseInLocation("20060102T150405", value, tz.location)
+		return t, err == nil
+	}
+	local, err := time.Parse("20060102T150405", value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	offset, ok := tz.offset(local)
+	if !ok {
+		return time.Time{}, false
+	}
+	zone := time.FixedZone(tzid, offset)
+	return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, zone), true
+}
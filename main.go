@@ -2,163 +2,435 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"helper/v3/calendarcache"
+	"helper/v3/calendarwatch"
 	"helper/v3/controllers"
+	"helper/v3/diagnostics"
+	"helper/v3/gradewatch"
+	"helper/v3/history"
 	"helper/v3/models"
+	"helper/v3/notify"
+	"helper/v3/scheduler"
+	"helper/v3/sessions"
+	"helper/v3/vault"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/adapters/humachi"
 	"github.com/go-chi/chi/v5"
+	"github.com/joho/godotenv"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func addRoutes(api huma.API) {
-	// Get Cookie
-	huma.Register(api, huma.Operation{
+// app holds the dependencies shared by the route handlers.
+type app struct {
+	pepal    *controllers.PepalClient
+	sessions *sessions.Store
+	// vault is nil when no VAULT_KEYS are configured.
+	vault *vault.Vault
+	// scheduler is nil when the vault is disabled, as it logs in with the
+	// stored credentials.
+	scheduler *scheduler.Scheduler
+	// grades is nil when the vault is disabled, for the same reason.
+	grades   *gradewatch.Watcher
+	history  *history.Store
+	notifier *notify.Dispatcher
+	changes  *calendarwatch.Watcher
+	// diagnostics keeps the pages the parsers could not read.
+	diagnostics *diagnostics.Store
+	// adminToken guards the admin endpoints, which are disabled when it is
+	// empty.
+	adminToken string
+}
+
+// session resolves the token sent in the Authorization header.
+func (a *app) session(token string) (sessions.Session, error) {
+	session, err := a.sessions.Resolve(strings.TrimPrefix(token, "Bearer "))
+	if err != nil {
+		return sessions.Session{}, huma.Error401Unauthorized(err.Error())
+	}
+	return session, nil
+}
+
+// auth resolves the token sent in the Authorization header into the Pepal
+// credentials of its session. Sessions of users who opted in to stored
+// credentials log in again when their Pepal cookie has expired.
+func (a *app) auth(token string) (*controllers.Auth, error) {
+	session, err := a.session(token)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := controllers.CookieAuth(session.Cookie)
+	auth.Username = session.Username
+	if a.vault != nil && a.vault.Has(session.Username) {
+		auth.Renew = func(ctx context.Context) (string, error) {
+			log.Info().Str("username", session.Username).Msg("Pepal session expired, logging in again")
+			cookie, err := a.relogin(ctx, session.Username)
+			if err != nil {
+				return "", err
+			}
+			return cookie, a.sessions.UpdateCookie(session.ID, cookie)
+		}
+	}
+	return auth, nil
+}
+
+// relogin logs a user in to Pepal with the credentials stored in the vault.
+func (a *app) relogin(ctx context.Context, username string) (string, error) {
+	password, err := a.vault.Get(username)
+	if err != nil {
+		return "", err
+	}
+	cookie, err := a.pepal.Login(ctx, username, password)
+	if err != nil {
+		return "", err
+	}
+	return cookie.Value, nil
+}
+
+func (a *app) addRoutes(api huma.API) {
+	// Login
+	register(api, huma.Operation{
 		OperationID: "login",
 		Method:      http.MethodPost,
 		Path:        "/login",
 		Summary:     "Login",
-		Description: "Login and get User cookie",
+		Description: "Login to Pepal and get a session token. With remember, the credentials are stored encrypted to log in again when the Pepal session expires.",
+		Middlewares: huma.Middlewares{withTimeout(15 * time.Second)},
 	}, func(ctx context.Context, input *struct {
 		Body struct {
 			Username string `path:"username" maxLength:"30" example:"myusername" doc:"Username"`
 			Password string `path:"password" example:"mypassword" doc:"Password"`
+			Remember bool   `json:"remember,omitempty" doc:"Keep the credentials to log in again when the Pepal session expires"`
 		}
 	}) (*models.LoginOutput, error) {
 		resp := &models.LoginOutput{}
-		cookie, err := controllers.Login(input.Body.Username, input.Body.Password)
-		resp.Body.Cookie = cookie
-		return resp, err
+		cookie, err := a.pepal.Login(ctx, input.Body.Username, input.Body.Password)
+		if err != nil {
+			return nil, err
+		}
+		if input.Body.Remember {
+			if a.vault == nil {
+				return nil, errVaultDisabled
+			}
+			if err := a.vault.Put(input.Body.Username, input.Body.Password); err != nil {
+				return nil, err
+			}
+		}
+		renewable := a.vault != nil && a.vault.Has(input.Body.Username)
+		token, session, err := a.sessions.Create(input.Body.Username, cookie.Value, cookie.Expires, renewable)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Token = token
+		resp.Body.ExpiresAt = session.ExpiresAt
+		return resp, nil
+	})
 
+	// Logout
+	register(api, huma.Operation{
+		OperationID: "logout",
+		Method:      http.MethodPost,
+		Path:        "/logout",
+		Summary:     "Logout",
+		Description: "Revoke a session token, or every session of its user with all",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		All   bool   `query:"all" doc:"Revoke every session of the user, on every device"`
+	}) (*models.GenericOutput, error) {
+		resp := &models.GenericOutput{}
+		if input.All {
+			session, err := a.session(input.Token)
+			if err != nil {
+				return nil, err
+			}
+			resp.Body.Message = fmt.Sprintf("%d sessions revoked", a.sessions.RevokeUser(session.Username))
+			return resp, nil
+		}
+		if err := a.sessions.Revoke(strings.TrimPrefix(input.Token, "Bearer ")); err != nil {
+			return nil, huma.Error401Unauthorized(err.Error())
+		}
+		resp.Body.Message = "Session revoked"
+		return resp, nil
 	})
 
 	// Get Course IDs
-	huma.Register(api, huma.Operation{
+	register(api, huma.Operation{
 		OperationID: "getCourseIDs",
 		Method:      http.MethodPost,
 		Path:        "/getCourseIDs",
 		Summary:     "Get Course IDs",
 		Description: "Get Course IDs for the day",
+		Middlewares: huma.Middlewares{withTimeout(15 * time.Second)},
 	}, func(ctx context.Context, input *struct {
-		Cookie string `header:"sdv" json:"cookie" example:"yoursupercookie" doc:"Cookie"`
+		Token          string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		AcceptLanguage string `header:"Accept-Language" example:"fr" doc:"Language of the period labels, fr or en"`
 	}) (*models.CourseIDsOutput, error) {
 		resp := &models.CourseIDsOutput{}
-		courses, err := controllers.GetCourseIDs(input.Cookie)
+		auth, err := a.auth(input.Token)
 		if err != nil {
 			return nil, err
 		}
+		courses, err := a.pepal.GetCourseIDs(ctx, auth)
+		if err != nil {
+			return nil, err
+		}
+		for i := range courses {
+			courses[i].Label = controllers.PeriodLabel(courses[i].Period, input.AcceptLanguage)
+		}
 		resp.Body.Courses = courses
 		return resp, nil
 	})
 
 	// Get Attendance Status
-	huma.Register(api, huma.Operation{
+	register(api, huma.Operation{
 		OperationID: "getAttendanceStatus",
 		Method:      http.MethodPost,
 		Path:        "/getAttendanceStatus",
 		Summary:     "Get Attendance Status",
 		Description: "Get the attendance status for a course",
+		Middlewares: huma.Middlewares{withTimeout(20 * time.Second)},
 	}, func(ctx context.Context, input *struct {
-		Cookie string `header:"sdv" json:"cookie" example:"yoursupercookie" doc:"Cookie"`
-		Body   struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		Body  struct {
 			CourseID string `json:"courseID" example:"2275021" doc:"Course ID"`
 		}
 	}) (*models.AttendanceStatusOutput, error) {
 		resp := &models.AttendanceStatusOutput{}
-		status, err := controllers.GetAttendanceStatus(input.Cookie, input.Body.CourseID)
+		auth, err := a.auth(input.Token)
 		if err != nil {
 			return nil, err
 		}
-		resp.Body.Status = status
+		status, err := a.pepal.GetAttendanceStatus(ctx, auth, input.Body.CourseID)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = status
 		return resp, nil
 	})
 
 	// Set Presence
-	huma.Register(api, huma.Operation{
+	register(api, huma.Operation{
 		OperationID: "setPresence",
 		Method:      http.MethodPost,
 		Path:        "/setPresence",
 		Summary:     "Set Presence",
-		Description: "Mark presence for a course",
+		Description: "Mark presence for a course. With allowLate, the late presence validation is used once the roll call only offers it. The returned status is read again from Pepal once the presence is set.",
+		Middlewares: huma.Middlewares{withTimeout(30 * time.Second)},
 	}, func(ctx context.Context, input *struct {
-		Cookie string `header:"sdv" json:"cookie" example:"yoursupercookie" doc:"Cookie"`
-		Body   struct {
-			CourseID string `json:"courseID" example:"2275021" doc:"Course ID"`
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		Body  struct {
+			CourseID  string `json:"courseID" example:"2275021" doc:"Course ID"`
+			AllowLate bool   `json:"allowLate,omitempty" doc:"Validate the presence late when the roll call only offers the late validation"`
 		}
-	}) (*models.AttendanceStatusOutput, error) {
-		resp := &models.AttendanceStatusOutput{}
-		err := controllers.SetPresence(input.Cookie, input.Body.CourseID)
+	}) (*models.SetPresenceOutput, error) {
+		resp := &models.SetPresenceOutput{}
+		auth, err := a.auth(input.Token)
 		if err != nil {
 			return nil, err
 		}
-		status, err := controllers.GetAttendanceStatus(input.Cookie, input.Body.CourseID)
+		timing, status, err := a.pepal.Snapshot(auth).SetPresence(ctx, input.Body.CourseID, input.Body.AllowLate)
 		if err != nil {
 			return nil, err
 		}
-		resp.Body.Status = status
+		resp.Body.AttendanceStatus = status
+		resp.Body.Presence = timing
 		return resp, nil
 	})
 
 	// Get Calendar
-	huma.Register(api, huma.Operation{
+	register(api, huma.Operation{
 		OperationID: "fetchCalendar",
 		Method:      http.MethodPost,
 		Path:        "/fetchCalendar",
 		Summary:     "Fetch Calendar",
-		Description: "Fetch the calendar and return the schedule for the week",
+		Description: "Fetch the calendar and return the schedule for the week, or for the period selected with from/to, week or month",
+		Middlewares: huma.Middlewares{withTimeout(30 * time.Second)},
 	}, func(ctx context.Context, input *struct {
 		Body struct {
-			CalUUID string `json:"calUUID" example:"49caac7c643b4be6817db60be4374ee7" doc:"Calendar UUID"`
+			CalUUID string `json:"calUUID" pattern:"^[0-9a-fA-F]{32}$" example:"49caac7c643b4be6817db60be4374ee7" doc:"Calendar UUID"`
+			From    string `json:"from,omitempty" format:"date" example:"2024-06-10" doc:"First day, used with to"`
+			To      string `json:"to,omitempty" format:"date" example:"2024-06-30" doc:"Last day, used with from"`
+			Week    int    `json:"week,omitempty" example:"1" doc:"Week offset from the current week (1 for next week, -1 for the previous one)"`
+			Month   string `json:"month,omitempty" pattern:"^[0-9]{4}-[0-9]{2}$" example:"2024-06" doc:"Month (YYYY-MM)"`
 		}
 	}) (*models.CalendarOutput, error) {
-		resp := &models.CalendarOutput{}
-		events, err := controllers.FetchAndParseCalendar(input.Body.CalUUID)
+		dateRange, err := a.calendarRange(input.Body.From, input.Body.To, input.Body.Week, input.Body.Month)
 		if err != nil {
 			return nil, err
 		}
-		resp.Body.Schedule = events
-		return resp, nil
+		return a.calendar(ctx, input.Body.CalUUID, dateRange)
 	})
 
 	// Get Grades
-	// Get Grades
-	huma.Register(api, huma.Operation{
+	register(api, huma.Operation{
 		OperationID: "getGrades",
 		Method:      http.MethodPost,
 		Path:        "/getGrades",
 		Summary:     "Get Grades",
-		Description: "Get the grades for the user",
+		Description: "Get the grades for the user, with their parsed values and the weighted averages per course, teaching unit and overall",
+		Middlewares: huma.Middlewares{withTimeout(20 * time.Second)},
 	}, func(ctx context.Context, input *struct {
-		Cookie string `header:"sdv" json:"cookie" example:"yoursupercookie" doc:"Cookie"`
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
 	}) (*models.GradesOutput, error) {
 		resp := &models.GradesOutput{}
-		grades, err := controllers.FetchGrades(input.Cookie)
+		auth, err := a.auth(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		grades, err := a.pepal.FetchGrades(ctx, auth)
 		if err != nil {
 			return nil, err
 		}
 		resp.Body.Grades = grades
+		resp.Body.Averages = controllers.ComputeAverages(grades)
 		return resp, nil
 	})
 }
 
-func main() {
+// withTimeout bounds the handler context of an operation, cancelling the
+// Pepal requests still in flight once the deadline is reached.
+func withTimeout(timeout time.Duration) func(huma.Context, func(huma.Context)) {
+	return func(ctx huma.Context, next func(huma.Context)) {
+		timeoutCtx, cancel := context.WithTimeout(ctx.Context(), timeout)
+		defer cancel()
+		next(huma.WithContext(ctx, timeoutCtx))
+	}
+}
+
+// handler returns the router serving the API.
+func (a *app) handler() http.Handler {
 	router := chi.NewMux()
 	config := huma.DefaultConfig("Pepal Helper", "3.0.0")
 	api := humachi.New(router, config)
-	addRoutes(api)
 
-	// Start API
-	err := http.ListenAndServe("0.0.0.0:8888", router)
+	a.addRoutes(api)
+	a.addCredentialRoutes(api)
+	a.addSchedulerRoutes(api)
+	a.addCalendarRoutes(api)
+	a.addHistoryRoutes(api)
+	a.addGradeWatchRoutes(api)
+	a.addNotificationRoutes(api)
+	a.addAdminRoutes(api)
+	router.Handle("/admin/metrics", a.metricsHandler())
+	return router
+}
+
+func main() {
+	pepal := controllers.NewPepalClient(os.Getenv("PEPAL_BASE_URL"), nil)
+	pepal.Location = schoolLocation()
+	var selectorFile *controllers.SelectorFile
+	if path := selectorsPath(); path != "" {
+		var err error
+		selectorFile, err = controllers.LoadSelectorFile(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Error loading selectors")
+		}
+		pepal.SetSelectors(selectorFile.Selectors)
+	}
+	pepal.Calendars = calendarcache.New(pepal.DownloadCalendar, calendarCacheTTL(), calendarStorage())
+	attendance, err := history.Open(historyPath(), absenceThresholds())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error loading attendance history")
+	}
+	pepal.History = attendance
+	notifyPath, deadLetterPath := notifyPaths()
+	notifyConf := notifyConfig()
+	notifier, err := notify.New(notifyDrivers(notifyConf), notifyPath, deadLetterPath, notifyConf)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error loading notification channels")
+	}
+	attendance.Notifier = notifier
+	changes, err := calendarwatch.New(pepal, calendarWatchPath())
 	if err != nil {
-		log.Error().Err(err)
+		log.Fatal().Err(err).Msg("Error loading calendar watcher")
+	}
+	changes.Notifier = notifier
+	pepal.Calendars.OnChange = changes.Update
+	captures, err := diagnostics.Open(diagnosticsPath(), diagnostics.DefaultLimit)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error loading diagnostics")
+	}
+	captures.Notifier = notifier
+	captures.AlertUser = os.Getenv("DIAGNOSTICS_ALERT_USER")
+	pepal.Diagnostics = captures
+	a := &app{
+		pepal:       pepal,
+		sessions:    sessions.NewStore(sessionSecret(), sessionTTL()),
+		vault:       openVault(),
+		history:     attendance,
+		notifier:    notifier,
+		changes:     changes,
+		diagnostics: captures,
+		adminToken:  adminToken(),
+	}
+
+	// Cancel every request context when the server is asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go pepal.Calendars.RunJanitor(ctx, time.Hour, calendarMaxAge())
+	go a.notifier.Run(ctx)
+	go a.changes.Run(ctx, calendarWatchInterval())
+	if selectorFile != nil {
+		go pepal.WatchSelectors(ctx, selectorFile, selectorsReloadInterval())
+	}
+
+	if a.vault != nil {
+		s, err := scheduler.New(a.pepal, a.relogin, schedulerPath(), schedulerConfig())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error loading presence scheduler")
+		}
+		s.Notifier = a.notifier
+		a.scheduler = s
+		go a.scheduler.Run(ctx)
+
+		w, err := gradewatch.New(a.pepal, a.relogin, gradeWatchPath(), gradeWatchInterval())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error loading grade watcher")
+		}
+		w.Notifier = a.notifier
+		a.grades = w
+		go a.grades.Run(ctx)
+	}
+
+	server := &http.Server{
+		Addr:        "0.0.0.0:8888",
+		Handler:     a.handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("Error shutting down server")
+		}
+	}()
+
+	// Start API
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msg("Server stopped")
+	}
+	if err := a.diagnostics.Flush(); err != nil {
+		log.Error().Err(err).Msg("Error saving diagnostics")
 	}
 }
 
 func init() {
+	godotenv.Load()
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "02/01/2006 15:04:05"})
 	fmt.Println("Server started on port 8888")
 }
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"helper/v3/calendarcache"
+	"helper/v3/calendarwatch"
+	"helper/v3/controllers"
+	"helper/v3/diagnostics"
+	"helper/v3/gradewatch"
+	"helper/v3/history"
+	"helper/v3/models"
+	"helper/v3/notify"
+	"helper/v3/pepaltest"
+	"helper/v3/scheduler"
+	"helper/v3/sessions"
+	"helper/v3/vault"
+)
+
+const (
+	testUser     = "jdoe"
+	testPassword = "s3cret"
+	testCalendar = "49caac7c643b4be6817db60be4374ee7"
+	testAdmin    = "admin-token"
+)
+
+// testEnv is the API wired to a fake Pepal, as main does with the live one.
+type testEnv struct {
+	t     *testing.T
+	pepal *pepaltest.Server
+	app   *app
+	api   *httptest.Server
+}
+
+// newTestEnv starts the API against a fake Pepal holding the test user. The
+// vault, and with it the scheduler and the grade watcher, is enabled when
+// withVault is set.
+func newTestEnv(t *testing.T, withVault bool) *testEnv {
+	t.Helper()
+	dir := t.TempDir()
+
+	fake := pepaltest.NewServer()
+	t.Cleanup(fake.Close)
+	fake.AddUser(testUser, testPassword)
+
+	pepal := controllers.NewPepalClient(fake.URL, fake.Client())
+	// Every calendar request downloads the feed again, so its changes are
+	// seen at once
+	pepal.Calendars = calendarcache.New(pepal.DownloadCalendar, time.Nanosecond, calendarcache.NewMemoryStorage())
+
+	attendance, err := history.Open(filepath.Join(dir, "history.json"), history.DefaultThresholds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pepal.History = attendance
+
+	config := notify.DefaultConfig
+	config.AllowHTTP = true
+	config.AllowPrivate = true
+	config.Attempts = 1
+	drivers := map[string]notify.Driver{notify.ChannelWebhook: &notify.WebhookDriver{Client: http.DefaultClient}}
+	notifier, err := notify.New(drivers, filepath.Join(dir, "notifications.json"), filepath.Join(dir, "dead-letters.jsonl"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attendance.Notifier = notifier
+
+	changes, err := calendarwatch.New(pepal, filepath.Join(dir, "calendar-watch.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes.Notifier = notifier
+	pepal.Calendars.OnChange = changes.Update
+
+	captures, err := diagnostics.Open(filepath.Join(dir, "diagnostics.json"), diagnostics.DefaultLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pepal.Diagnostics = captures
+
+	secret, err := sessions.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &app{
+		pepal:       pepal,
+		sessions:    sessions.NewStore(secret, time.Hour),
+		history:     attendance,
+		notifier:    notifier,
+		changes:     changes,
+		diagnostics: captures,
+	}
+	// The admin endpoints stay disabled until a test sets a.adminToken
+
+	if withVault {
+		key := make([]byte, 32)
+		rand.Read(key)
+		keyring, err := vault.ParseKeyring("test:" + base64.StdEncoding.EncodeToString(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.vault, err = vault.Open(filepath.Join(dir, "vault.json"), keyring); err != nil {
+			t.Fatal(err)
+		}
+		if a.scheduler, err = scheduler.New(pepal, a.relogin, filepath.Join(dir, "scheduler.json"), scheduler.DefaultConfig); err != nil {
+			t.Fatal(err)
+		}
+		if a.grades, err = gradewatch.New(pepal, a.relogin, filepath.Join(dir, "grades.json"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api := httptest.NewServer(a.handler())
+	t.Cleanup(api.Close)
+	return &testEnv{t: t, pepal: fake, app: a, api: api}
+}
+
+// call sends a request to the API and decodes the JSON response into out,
+// when not nil. It returns the response status.
+func (e *testEnv) call(method, path, token string, body, out any, header ...string) int {
+	e.t.Helper()
+	resp, data := e.send(method, path, token, body, header...)
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, out); err != nil {
+			e.t.Fatalf("%s %s: decoding %s: %v", method, path, data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// fail sends a request expected to fail and returns the response status and
+// the code of its problem body.
+func (e *testEnv) fail(method, path, token string, body any) (int, string) {
+	e.t.Helper()
+	resp, data := e.send(method, path, token, body)
+	if resp.StatusCode < 400 {
+		return resp.StatusCode, ""
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		e.t.Errorf("%s %s: content type %q", method, path, ct)
+	}
+	var problem struct {
+		Status int    `json:"status"`
+		Code   string `json:"code"`
+	}
+	if err := json.Unmarshal(data, &problem); err != nil || problem.Status != resp.StatusCode {
+		e.t.Fatalf("%s %s: problem %s: %v", method, path, data, err)
+	}
+	return resp.StatusCode, problem.Code
+}
+
+// send sends a request to the API and returns the response and its body.
+func (e *testEnv) send(method, path, token string, body any, header ...string) (*http.Response, []byte) {
+	e.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, e.api.URL+path, reader)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return resp, data
+}
+
+// login opens a session for the test user and returns its token.
+func (e *testEnv) login(remember bool) string {
+	e.t.Helper()
+	var out struct {
+		Token string `json:"token"`
+	}
+	body := map[string]any{"Username": testUser, "Password": testPassword, "remember": remember}
+	if status := e.call("POST", "/login", "", body, &out); status != http.StatusOK {
+		e.t.Fatalf("login: status %d", status)
+	}
+	return out.Token
+}
+
+func TestLoginAndLogout(t *testing.T) {
+	env := newTestEnv(t, false)
+
+	body := map[string]any{"Username": testUser, "Password": "wrong"}
+	if status, code := env.fail("POST", "/login", "", body); status != http.StatusUnauthorized || code != "invalid_credentials" {
+		t.Errorf("login with a wrong password: status %d, code %q", status, code)
+	}
+
+	token := env.login(false)
+	if status := env.call("POST", "/logout", token, nil, nil); status != http.StatusOK {
+		t.Errorf("logout: status %d", status)
+	}
+	if status, code := env.fail("POST", "/getCourseIDs", token, nil); status != http.StatusUnauthorized || code != "unauthorized" {
+		t.Errorf("request after logout: status %d, code %q", status, code)
+	}
+
+	// Logging out everywhere revokes the sessions of the other devices
+	tokens := []string{env.login(false), env.login(false)}
+	if status := env.call("POST", "/logout?all=true", tokens[0], nil, nil); status != http.StatusOK {
+		t.Errorf("logout everywhere: status %d", status)
+	}
+	for _, token := range tokens {
+		if status, _ := env.fail("POST", "/getCourseIDs", token, nil); status != http.StatusUnauthorized {
+			t.Errorf("request after logging out everywhere: status %d", status)
+		}
+	}
+	if status := env.call("POST", "/login", "", map[string]any{"Username": testUser, "Password": testPassword, "remember": true}, nil); status != http.StatusNotImplemented {
+		t.Errorf("login with remember and no vault: status %d", status)
+	}
+}
+
+func TestAttendanceRoutes(t *testing.T) {
+	env := newTestEnv(t, false)
+	env.pepal.SetCourses(testUser,
+		pepaltest.Course{ID: "101", Name: "Développement Go", Time: "09:00-12:00", State: models.AttendanceOpen},
+		// Pepal still offers the late validation once it is recorded
+		pepaltest.Course{ID: "102", Name: "Bases de données", Time: "13:30-17:30", State: models.AttendanceLateOpen, Validated: models.AttendanceLateOpen},
+		pepaltest.Course{ID: "103", Name: "Projet", Time: "09:00-16:00", State: models.AttendanceClosedAbsent},
+	)
+	token := env.login(false)
+
+	var courses struct {
+		Courses []models.Course `json:"courses"`
+	}
+	if status := env.call("POST", "/getCourseIDs", token, nil, &courses, "Accept-Language", "en-GB,en;q=0.9"); status != http.StatusOK {
+		t.Fatalf("getCourseIDs: status %d", status)
+	}
+	var periods, labels []string
+	for _, course := range courses.Courses {
+		periods = append(periods, string(course.Period))
+		labels = append(labels, course.Label)
+	}
+	if want := []string{"morning", "afternoon", "full_day"}; !reflect.DeepEqual(periods, want) {
+		t.Errorf("periods = %v, want %v", periods, want)
+	}
+	if want := []string{"Morning", "Afternoon", "All day"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+	if start := courses.Courses[0].Start; start.Hour() != 9 || start.Minute() != 0 {
+		t.Errorf("start = %v", start)
+	}
+
+	var status models.AttendanceStatus
+	if code := env.call("POST", "/getAttendanceStatus", token, map[string]string{"courseID": "103"}, &status); code != http.StatusOK {
+		t.Fatalf("getAttendanceStatus: status %d", code)
+	}
+	if status.State != models.AttendanceClosedAbsent {
+		t.Errorf("state = %s", status.State)
+	}
+	if status, code := env.fail("POST", "/getAttendanceStatus", token, map[string]string{"courseID": "999"}); status != http.StatusNotFound || code != "course_not_today" {
+		t.Errorf("getAttendanceStatus of an unknown course: status %d, code %q", status, code)
+	}
+
+	// The courses are remembered: the validation reads the attendance page,
+	// posts the presence and reads the page again, nothing else
+	env.pepal.ResetRequests()
+	var presence struct {
+		models.AttendanceStatus
+		Presence models.PresenceTiming `json:"presence"`
+	}
+	if code := env.call("POST", "/setPresence", token, map[string]any{"courseID": "101"}, &presence); code != http.StatusOK {
+		t.Fatalf("setPresence: status %d", code)
+	}
+	if presence.Presence != models.PresenceOnTime || presence.State != models.AttendanceClosedPresent || presence.RawText == "" {
+		t.Errorf("setPresence = %+v", presence)
+	}
+	if want := []string{"GET /presences/s/101", "POST /student/upload.php", "GET /presences/s/101"}; !reflect.DeepEqual(env.pepal.Requests(), want) {
+		t.Errorf("Pepal requests = %v, want %v", env.pepal.Requests(), want)
+	}
+	if state := env.pepal.CourseState(testUser, "101"); state != models.AttendanceClosedPresent {
+		t.Errorf("Pepal state = %s", state)
+	}
+
+	if status, code := env.fail("POST", "/setPresence", token, map[string]any{"courseID": "102"}); status != http.StatusConflict || code != "attendance_not_open" {
+		t.Errorf("setPresence on a late roll call: status %d, code %q", status, code)
+	}
+	if code := env.call("POST", "/setPresence", token, map[string]any{"courseID": "102", "allowLate": true}, &presence); code != http.StatusOK {
+		t.Fatalf("setPresence with allowLate: status %d", code)
+	}
+	// The status is the one read on Pepal, not the one the validation implies
+	if presence.Presence != models.PresenceLate || presence.State != models.AttendanceLateOpen {
+		t.Errorf("setPresence with allowLate = %+v", presence)
+	}
+
+	var attendance struct {
+		Overall models.AbsenceStats       `json:"overall"`
+		Records []models.AttendanceRecord `json:"records"`
+	}
+	if code := env.call("GET", "/attendance/history", token, nil, &attendance); code != http.StatusOK {
+		t.Fatalf("attendance history: status %d", code)
+	}
+	if attendance.Overall.Present != 1 || attendance.Overall.Late != 1 || attendance.Overall.Absent != 1 {
+		t.Errorf("overall = %+v", attendance.Overall)
+	}
+
+	// The semester filter also applies to the overall statistics
+	if code := env.call("GET", "/attendance/history?semester=2000-2001+S1", token, nil, &attendance); code != http.StatusOK {
+		t.Fatalf("attendance history of another semester: status %d", code)
+	}
+	if attendance.Overall.Courses != 0 || attendance.Overall.Level != models.AbsenceOK || len(attendance.Records) != 0 {
+		t.Errorf("another semester: overall = %+v, %d records", attendance.Overall, len(attendance.Records))
+	}
+}
+
+func TestExpiredPepalSession(t *testing.T) {
+	env := newTestEnv(t, true)
+	env.pepal.SetCourses(testUser, pepaltest.Course{ID: "101", Name: "Développement Go", Time: "09:00-12:00", State: models.AttendanceNotYetOpen})
+
+	token := env.login(false)
+	env.pepal.ExpireSessions()
+	if status, code := env.fail("POST", "/getCourseIDs", token, nil); status != http.StatusUnauthorized || code != "auth_expired" {
+		t.Errorf("expired session without stored credentials: status %d, code %q", status, code)
+	}
+
+	token = env.login(true)
+	env.pepal.ExpireSessions()
+	if status := env.call("POST", "/getCourseIDs", token, nil, nil); status != http.StatusOK {
+		t.Errorf("expired session with stored credentials: status %d", status)
+	}
+	// The renewed cookie is kept for the next requests
+	env.pepal.ResetRequests()
+	env.call("POST", "/getCourseIDs", token, nil, nil)
+	if want := []string{"GET /presences"}; !reflect.DeepEqual(env.pepal.Requests(), want) {
+		t.Errorf("Pepal requests = %v, want %v", env.pepal.Requests(), want)
+	}
+}
+
+func TestGradesRoute(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// manual disables the transparent decompression of the transport,
+		// leaving the gzip body to the client
+		gzip, manual bool
+	}{
+		{"plain", false, false},
+		{"gzip", true, false},
+		{"gzip without transport decompression", true, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			env := newTestEnv(t, false)
+			env.pepal.Gzip = test.gzip
+			if test.manual {
+				env.app.pepal.HTTPClient.Transport.(*http.Transport).DisableCompression = true
+			}
+			env.pepal.SetGrades(testUser,
+				pepaltest.Grade{Unit: "UE1", Course: "Go", Subject: "TP1", Date: "12/09/2024", Mark: "15,5", Coef: "1", Published: true, Comment: "Bon travail"},
+				pepaltest.Grade{Unit: "UE1", Course: "Go", Subject: "Examen", Date: "03/10/2024", Mark: "12", Coef: "2", Published: true},
+				pepaltest.Grade{Unit: "UE1", Course: "SQL", Subject: "QCM", Date: "20/09/2024", Mark: "8/10", Coef: "1"},
+			)
+			token := env.login(false)
+
+			var out struct {
+				Grades   []models.Grade  `json:"grades"`
+				Averages models.Averages `json:"averages"`
+			}
+			if status := env.call("POST", "/getGrades", token, nil, &out); status != http.StatusOK {
+				t.Fatalf("getGrades: status %d", status)
+			}
+			if len(out.Grades) != 3 {
+				t.Fatalf("grades = %+v", out.Grades)
+			}
+			if out.Grades[0].Comment != "Bon travail" || out.Grades[0].Course != "Go" || !out.Grades[0].Published {
+				t.Errorf("first grade = %+v", out.Grades[0])
+			}
+			if out.Grades[2].Scale != 10 || out.Grades[2].Published {
+				t.Errorf("last grade = %+v", out.Grades[2])
+			}
+			if avg := out.Averages.Overall.Average; avg == nil || len(out.Averages.Courses) != 2 {
+				t.Errorf("averages = %+v", out.Averages)
+			}
+		})
+	}
+}
+
+func TestCalendarRoutes(t *testing.T) {
+	env := newTestEnv(t, false)
+	token := env.login(false)
+
+	day := time.Now().In(env.app.pepal.Location).AddDate(0, 0, 2)
+	at := func(hour int) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), hour, 0, 0, 0, day.Location())
+	}
+	course := pepaltest.Event{UID: "c1", Summary: "Développement Go", Location: "Salle 101", Professor: "M. Martin", Start: at(9), End: at(12)}
+	env.pepal.SetCalendar(testCalendar, pepaltest.Calendar(course))
+
+	query := "?from=" + day.Format("2006-01-02") + "&to=" + day.Format("2006-01-02")
+	var calendar struct {
+		Schedule []models.Event `json:"schedule"`
+	}
+	if status := env.call("GET", "/calendar/"+testCalendar+query, "", nil, &calendar); status != http.StatusOK {
+		t.Fatalf("getCalendar: status %d", status)
+	}
+	if len(calendar.Schedule) != 1 || calendar.Schedule[0].Location != "Salle 101" || !calendar.Schedule[0].Morning {
+		t.Errorf("schedule = %+v", calendar.Schedule)
+	}
+	if status := env.call("GET", "/calendar/not-a-uuid", "", nil, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("getCalendar with an invalid UUID: status %d", status)
+	}
+
+	var watch struct {
+		Watched bool `json:"watched"`
+	}
+	if status := env.call("PUT", "/calendar/"+testCalendar+"/watch", token, nil, &watch); status != http.StatusOK || !watch.Watched {
+		t.Errorf("watchCalendar: status %d, %+v", status, watch)
+	}
+
+	// The room changes on Pepal
+	course.Location = "Salle 204"
+	env.pepal.SetCalendar(testCalendar, pepaltest.Calendar(course))
+	body := map[string]string{"calUUID": testCalendar, "from": day.Format("2006-01-02"), "to": day.Format("2006-01-02")}
+	if status := env.call("POST", "/fetchCalendar", "", body, &calendar); status != http.StatusOK {
+		t.Fatalf("fetchCalendar: status %d", status)
+	}
+	if len(calendar.Schedule) != 1 || calendar.Schedule[0].Location != "Salle 204" {
+		t.Errorf("schedule = %+v", calendar.Schedule)
+	}
+
+	var changes struct {
+		Changes []models.CalendarChange `json:"changes"`
+	}
+	if status := env.call("GET", "/calendar/"+testCalendar+"/changes", "", nil, &changes); status != http.StatusOK {
+		t.Fatalf("getCalendarChanges: status %d", status)
+	}
+	if len(changes.Changes) != 1 || changes.Changes[0].Type != models.CalendarEventChanged {
+		t.Errorf("changes = %+v", changes.Changes)
+	}
+
+	if status := env.call("DELETE", "/calendar/"+testCalendar+"/watch", token, nil, &watch); status != http.StatusOK || watch.Watched {
+		t.Errorf("unwatchCalendar: status %d, %+v", status, watch)
+	}
+}
+
+func TestPepalUnavailable(t *testing.T) {
+	env := newTestEnv(t, false)
+	token := env.login(false)
+
+	env.pepal.Close()
+	if status, code := env.fail("POST", "/getCourseIDs", token, nil); status != http.StatusServiceUnavailable || code != "upstream_unavailable" {
+		t.Errorf("course IDs with Pepal down: status %d, code %q", status, code)
+	}
+
+	// Every error documents its code
+	var spec struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if status := env.call("GET", "/openapi.json", "", nil, &spec); status != http.StatusOK {
+		t.Fatalf("openapi: status %d", status)
+	}
+	found := false
+	for _, schema := range spec.Components.Schemas {
+		if schema.Properties["code"] != nil && schema.Properties["detail"] != nil {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("no error schema with a code")
+	}
+}
+
+func TestCredentialRoutes(t *testing.T) {
+	env := newTestEnv(t, true)
+	token := env.login(false)
+
+	for _, step := range []struct {
+		method, password string
+		status           int
+	}{
+		{"PUT", testPassword, http.StatusNotFound},
+		{"POST", "wrong", http.StatusUnauthorized},
+		{"POST", testPassword, http.StatusOK},
+		{"POST", testPassword, http.StatusConflict},
+		{"PUT", testPassword, http.StatusOK},
+		{"DELETE", "", http.StatusOK},
+	} {
+		var body any
+		if step.method != "DELETE" {
+			body = map[string]string{"password": step.password}
+		}
+		if status := env.call(step.method, "/credentials", token, body, nil); status != step.status {
+			t.Errorf("%s /credentials (%s): status %d, want %d", step.method, step.password, status, step.status)
+		}
+	}
+
+	// Deleting the credentials revoked the sessions
+	if status, _ := env.fail("DELETE", "/credentials", token, nil); status != http.StatusUnauthorized {
+		t.Errorf("request after deleting the credentials: status %d", status)
+	}
+	if status := env.call("DELETE", "/credentials", env.login(false), nil, nil); status != http.StatusNotFound {
+		t.Errorf("DELETE /credentials without credentials: status %d", status)
+	}
+}
+
+func TestSchedulerRoutes(t *testing.T) {
+	env := newTestEnv(t, true)
+	token := env.login(false)
+	enrol := map[string]string{"calUUID": testCalendar}
+
+	if status := env.call("POST", "/scheduler", token, enrol, nil); status != http.StatusPreconditionFailed {
+		t.Errorf("enrol without credentials: status %d", status)
+	}
+	env.call("POST", "/credentials", token, map[string]string{"password": testPassword}, nil)
+
+	var enrolment struct {
+		CalUUID string `json:"calUUID"`
+	}
+	if status := env.call("POST", "/scheduler", token, enrol, &enrolment); status != http.StatusOK || enrolment.CalUUID != testCalendar {
+		t.Errorf("enrol: status %d, %+v", status, enrolment)
+	}
+	if status := env.call("GET", "/scheduler", token, nil, &enrolment); status != http.StatusOK || enrolment.CalUUID != testCalendar {
+		t.Errorf("get enrolment: status %d, %+v", status, enrolment)
+	}
+	var records struct {
+		Records []models.PresenceRecord `json:"records"`
+	}
+	if status := env.call("GET", "/scheduler/records", token, nil, &records); status != http.StatusOK || len(records.Records) != 0 {
+		t.Errorf("records: status %d, %+v", status, records)
+	}
+	if status := env.call("DELETE", "/scheduler", token, nil, nil); status != http.StatusOK {
+		t.Errorf("leave: status %d", status)
+	}
+	if status := env.call("GET", "/scheduler", token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("get enrolment after leaving: status %d", status)
+	}
+}
+
+func TestGradeWatchRoutes(t *testing.T) {
+	env := newTestEnv(t, true)
+	token := env.login(false)
+
+	if status := env.call("POST", "/grades/watch", token, nil, nil); status != http.StatusPreconditionFailed {
+		t.Errorf("watch without credentials: status %d", status)
+	}
+	env.call("POST", "/credentials", token, map[string]string{"password": testPassword}, nil)
+
+	if status := env.call("POST", "/grades/watch", token, nil, nil); status != http.StatusOK {
+		t.Errorf("watch: status %d", status)
+	}
+	if status := env.call("GET", "/grades/watch", token, nil, nil); status != http.StatusOK {
+		t.Errorf("get watch: status %d", status)
+	}
+	var events struct {
+		Events []models.GradeEvent `json:"events"`
+	}
+	if status := env.call("GET", "/grades/events", token, nil, &events); status != http.StatusOK || len(events.Events) != 0 {
+		t.Errorf("events: status %d, %+v", status, events)
+	}
+	if status := env.call("DELETE", "/grades/watch", token, nil, nil); status != http.StatusOK {
+		t.Errorf("unwatch: status %d", status)
+	}
+	if status := env.call("GET", "/grades/watch", token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("get watch after unwatching: status %d", status)
+	}
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	env := newTestEnv(t, false)
+	token := env.login(false)
+
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/credentials"},
+		{"DELETE", "/credentials"},
+		{"GET", "/scheduler"},
+		{"GET", "/scheduler/records"},
+		{"GET", "/grades/watch"},
+		{"GET", "/grades/events"},
+	} {
+		var body any
+		if route.method == "POST" {
+			body = map[string]string{"password": testPassword}
+		}
+		if status := env.call(route.method, route.path, token, body, nil); status != http.StatusNotImplemented {
+			t.Errorf("%s %s: status %d", route.method, route.path, status)
+		}
+	}
+}
+
+func TestNotificationRoutes(t *testing.T) {
+	env := newTestEnv(t, false)
+	token := env.login(false)
+
+	received := make(chan notify.Notification, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notify.Notification
+		json.NewDecoder(r.Body).Decode(&n)
+		received <- n
+	}))
+	defer webhook.Close()
+
+	if status := env.call("POST", "/notifications/test", token, nil, nil); status != http.StatusPreconditionFailed {
+		t.Errorf("test without channels: status %d", status)
+	}
+	invalid := map[string]any{"channels": []notify.Channel{{Type: notify.ChannelWebhook, URL: webhook.URL}}}
+	if status := env.call("PUT", "/notifications/channels", token, invalid, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("webhook without secret: status %d", status)
+	}
+
+	var channels struct {
+		Channels []notify.Channel `json:"channels"`
+	}
+	valid := map[string]any{"channels": []notify.Channel{{Type: notify.ChannelWebhook, URL: webhook.URL, Secret: "hook"}}}
+	if status := env.call("PUT", "/notifications/channels", token, valid, &channels); status != http.StatusOK {
+		t.Fatalf("set channels: status %d", status)
+	}
+	if status := env.call("GET", "/notifications/channels", token, nil, &channels); status != http.StatusOK || len(channels.Channels) != 1 || channels.Channels[0].Secret != "" {
+		t.Errorf("get channels: status %d, %+v", status, channels)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go env.app.notifier.Run(ctx)
+	if status := env.call("POST", "/notifications/test", token, nil, nil); status != http.StatusOK {
+		t.Fatalf("test: status %d", status)
+	}
+	select {
+	case n := <-received:
+		if n.Kind != notify.KindTest || n.Username != testUser || !strings.Contains(n.Title, "test") {
+			t.Errorf("notification = %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the test notification was not delivered")
+	}
+
+	var letters struct {
+		DeadLetters []notify.DeadLetter `json:"dead_letters"`
+	}
+	if status := env.call("GET", "/notifications/dead-letters", token, nil, &letters); status != http.StatusOK || len(letters.DeadLetters) != 0 {
+		t.Errorf("dead letters: status %d, %+v", status, letters)
+	}
+}
+
+func TestAdminDiagnostics(t *testing.T) {
+	env := newTestEnv(t, false)
+	token := env.login(false)
+
+	if status := env.call("GET", "/admin/diagnostics", testAdmin, nil, nil); status != http.StatusNotImplemented {
+		t.Errorf("diagnostics without admin token: status %d", status)
+	}
+	env.app.adminToken = testAdmin
+	for _, admin := range []string{"", token} {
+		if status := env.call("GET", "/admin/diagnostics", admin, nil, nil); status != http.StatusUnauthorized {
+			t.Errorf("diagnostics with token %q: status %d", admin, status)
+		}
+	}
+
+	// A day without course is an empty list, not a failure
+	var courses struct {
+		Courses []models.Course `json:"courses"`
+	}
+	if status := env.call("POST", "/getCourseIDs", token, nil, &courses); status != http.StatusOK || courses.Courses == nil || len(courses.Courses) != 0 {
+		t.Fatalf("course IDs of a day without course: status %d, %+v", status, courses)
+	}
+
+	// A page without the course table fails to parse and is captured
+	env.pepal.SetPresencesPage(testUser, `<html><body><div class="alert alert-warning">Pepal est en maintenance.</div></body></html>`)
+	if status, code := env.fail("POST", "/getCourseIDs", token, nil); status != http.StatusBadGateway || code != "parse_failure" {
+		t.Fatalf("course IDs of an unknown page: status %d, code %q", status, code)
+	}
+	var list models.ParseCapturesOutput
+	if status := env.call("GET", "/admin/diagnostics", testAdmin, nil, &list.Body); status != http.StatusOK {
+		t.Fatalf("list captures: status %d", status)
+	}
+	if len(list.Body.Captures) != 1 || len(list.Body.Parsers) != 1 {
+		t.Fatalf("captures = %+v", list.Body)
+	}
+	captured := list.Body.Captures[0]
+	if captured.Parser != controllers.ParserCourses || !captured.Drift || captured.Page != "" {
+		t.Errorf("capture = %+v", captured)
+	}
+
+	var capture models.ParseCapture
+	if status := env.call("GET", "/admin/diagnostics/"+captured.ID, testAdmin, nil, &capture); status != http.StatusOK || capture.Page == "" || strings.Contains(capture.Page, testUser) {
+		t.Errorf("get capture: status %d, %+v", status, capture)
+	}
+	if status := env.call("GET", "/admin/diagnostics/unknown", testAdmin, nil, nil); status != http.StatusNotFound {
+		t.Errorf("unknown capture: status %d", status)
+	}
+
+	note := map[string]string{"note": "Page de maintenance"}
+	if status := env.call("PUT", "/admin/diagnostics/fingerprints/"+captured.Fingerprint, testAdmin, note, nil); status != http.StatusOK {
+		t.Errorf("acknowledge: status %d", status)
+	}
+	if status := env.call("GET", "/admin/diagnostics/"+captured.ID, testAdmin, nil, &capture); status != http.StatusOK || capture.Drift || capture.Note != "Page de maintenance" {
+		t.Errorf("acknowledged capture: status %d, %+v", status, capture)
+	}
+
+	if status, code := env.fail("GET", "/admin/metrics", token, nil); status != http.StatusUnauthorized || code != "unauthorized" {
+		t.Errorf("metrics with a user token: status %d, code %q", status, code)
+	}
+	var metrics map[string]json.RawMessage
+	if status := env.call("GET", "/admin/metrics", testAdmin, nil, &metrics); status != http.StatusOK || metrics["pepal_parser_failures"] == nil {
+		t.Errorf("metrics: status %d", status)
+	}
+}
@@ -1,9 +1,27 @@
 package models
 
+import "time"
+
+// CoursePeriod is the half-day a course takes place in.
+type CoursePeriod string
+
+const (
+	PeriodMorning   CoursePeriod = "morning"
+	PeriodAfternoon CoursePeriod = "afternoon"
+	// PeriodFullDay: the course runs through the lunch break, in both
+	// half-days.
+	PeriodFullDay CoursePeriod = "full_day"
+)
+
 type Course struct {
-	ID     string `json:"id"`
-	Name   string `json:"name"`
-	Period string `json:"period"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Start and End are the times of the course today, in the school time
+	// zone. They are zero when Pepal does not show them.
+	Start  time.Time    `json:"start"`
+	End    time.Time    `json:"end"`
+	Period CoursePeriod `json:"period" enum:"morning,afternoon,full_day"`
+	Label  string       `json:"label" example:"Matin" doc:"Period name in the requested language"`
 }
 
 type CourseIDsOutput struct {
@@ -12,9 +30,48 @@ type CourseIDsOutput struct {
 	}
 }
 
+// AttendanceState is the state of the roll call of a course, as shown on its
+// Pepal attendance page.
+type AttendanceState string
+
+const (
+	// AttendanceNotYetOpen: the roll call has not opened yet.
+	AttendanceNotYetOpen AttendanceState = "NotYetOpen"
+	// AttendanceOpen: the roll call is open and presence can be validated.
+	AttendanceOpen AttendanceState = "Open"
+	// AttendanceLateOpen: only a late presence can still be validated.
+	AttendanceLateOpen AttendanceState = "LateOpen"
+	// AttendanceClosedPresent: the roll call is closed and the user was marked present.
+	AttendanceClosedPresent AttendanceState = "ClosedPresent"
+	// AttendanceClosedAbsent: the roll call is closed without the user being marked present.
+	AttendanceClosedAbsent AttendanceState = "ClosedAbsent"
+	// AttendanceUnknown: the attendance panel text was not recognised.
+	AttendanceUnknown AttendanceState = "Unknown"
+)
+
+// AttendanceStatus is the attendance status of a course at a given time.
+type AttendanceStatus struct {
+	State      AttendanceState `json:"status" enum:"NotYetOpen,Open,LateOpen,ClosedPresent,ClosedAbsent,Unknown" doc:"Roll call state"`
+	RawText    string          `json:"raw_text" doc:"Text of the Pepal attendance panel"`
+	ObservedAt time.Time       `json:"observed_at" doc:"Time the status was read from Pepal"`
+}
+
 type AttendanceStatusOutput struct {
+	Body AttendanceStatus `json:"body"`
+}
+
+// PresenceTiming tells whether a presence was validated on time or late.
+type PresenceTiming string
+
+const (
+	PresenceOnTime PresenceTiming = "OnTime"
+	PresenceLate   PresenceTiming = "Late"
+)
+
+type SetPresenceOutput struct {
 	Body struct {
-		Status string `json:"status"`
+		AttendanceStatus
+		Presence PresenceTiming `json:"presence" enum:"OnTime,Late" doc:"Whether the presence was recorded on time or late"`
 	} `json:"body"`
 }
 
@@ -1,18 +1,80 @@
 package models
 
+import "time"
+
 type CalendarOutput struct {
 	Body struct {
+		From     string  `json:"from"`
+		To       string  `json:"to"`
 		Schedule []Event `json:"schedule"`
 	}
 }
 
+// EventType tells what an event of the calendar is.
+type EventType string
+
+const (
+	// EventCourse: a course at the school or remote.
+	EventCourse EventType = "course"
+	// EventCompany: a day at the company, given without a summary in the
+	// feed.
+	EventCompany EventType = "company"
+)
+
 type Event struct {
-	Day       string `json:"day"`
-	FullDay   bool   `json:"full_day"`
-	Morning   bool   `json:"morning"`
-	Afternoon bool   `json:"afternoon"`
-	Remote    bool   `json:"remote"`
-	Location  string `json:"location,omitempty"`
-	Professor string `json:"professor"`
-	Subject   string `json:"subject"`
+	UID  string    `json:"uid,omitempty"`
+	Type EventType `json:"type" enum:"course,company"`
+	Day  string    `json:"day"`
+	// Start and End are in the school time zone. End is exclusive, so a
+	// full day ends at midnight the next day.
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Duration  int       `json:"duration" doc:"Duration in minutes"`
+	FullDay   bool      `json:"full_day"`
+	Morning   bool      `json:"morning"`
+	Afternoon bool      `json:"afternoon"`
+	Remote    bool      `json:"remote"`
+	Location  string    `json:"location,omitempty"`
+	Room      string    `json:"room,omitempty" doc:"Location with its spaces normalised"`
+	Professor string    `json:"professor"`
+	// Subject is "entreprise" for the company days, kept for the clients
+	// written before Type.
+	Subject     string   `json:"subject"`
+	Description string   `json:"description,omitempty"`
+	Categories  []string `json:"categories,omitempty"`
+}
+
+// CalendarChangeType is the kind of change found on a calendar event.
+type CalendarChangeType string
+
+const (
+	CalendarEventAdded   CalendarChangeType = "added"
+	CalendarEventRemoved CalendarChangeType = "removed"
+	CalendarEventChanged CalendarChangeType = "changed"
+)
+
+// CalendarChange is a difference between two downloads of a calendar.
+type CalendarChange struct {
+	Type CalendarChangeType `json:"type" enum:"added,removed,changed"`
+	Day  string             `json:"day"`
+	// Event is the event as it is now, absent for a removed event.
+	Event *Event `json:"event,omitempty"`
+	// Previous is the event as it was, absent for an added event.
+	Previous *Event `json:"previous,omitempty"`
+	// Fields lists what changed on a changed event.
+	Fields     []string  `json:"fields,omitempty" enum:"subject,location,professor,time" doc:"What changed: the subject, the room, the professor or the time"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+type CalendarChangesOutput struct {
+	Body struct {
+		Changes []CalendarChange `json:"changes"`
+	} `json:"body"`
+}
+
+type CalendarWatchOutput struct {
+	Body struct {
+		CalUUID string `json:"calUUID"`
+		Watched bool   `json:"watched"`
+	} `json:"body"`
 }
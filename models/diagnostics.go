@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// ParseCapture is a Pepal page one of the parsers could not read, with its
+// sensitive data removed. The failures on pages of the same structure, the
+// same fingerprint, are grouped in a single capture keeping the last page.
+type ParseCapture struct {
+	ID          string `json:"id"`
+	Parser      string `json:"parser" enum:"courses,attendance" doc:"Parser that failed"`
+	Fingerprint string `json:"fingerprint" doc:"Hash of the structure of the page, ignoring its text and repeated rows"`
+	// Drift is set unless the fingerprint was acknowledged as an expected
+	// page, such as a maintenance page.
+	Drift     bool      `json:"drift" doc:"Whether the page structure is unknown, hinting at a change of the Pepal templates"`
+	Path      string    `json:"path" doc:"Pepal page the capture comes from"`
+	Error     string    `json:"error"`
+	Count     int       `json:"count" doc:"Number of failures on pages with this fingerprint"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Page      string    `json:"page,omitempty" doc:"First page, redacted"`
+	Note      string    `json:"note,omitempty" doc:"Note left when the fingerprint was acknowledged"`
+}
+
+// ParserStats counts the failures of a parser since the server started.
+type ParserStats struct {
+	Parser   string `json:"parser"`
+	Failures int    `json:"failures"`
+	Drift    int    `json:"drift" doc:"Failures on pages whose fingerprint was not acknowledged"`
+}
+
+type ParseCapturesOutput struct {
+	Body struct {
+		Parsers  []ParserStats  `json:"parsers"`
+		Captures []ParseCapture `json:"captures"`
+	} `json:"body"`
+}
+
+type ParseCaptureOutput struct {
+	Body ParseCapture `json:"body"`
+}
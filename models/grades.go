@@ -1,15 +1,84 @@
 package models
 
+import "time"
+
+// GradeStatus tells whether a grade holds a mark.
+type GradeStatus string
+
+const (
+	// GradeGraded: the grade holds a numeric mark.
+	GradeGraded GradeStatus = "Graded"
+	// GradeAbsent: the student missed the evaluation ("ABS").
+	GradeAbsent GradeStatus = "Absent"
+	// GradeNotGraded: the evaluation is not graded, or its mark was not understood.
+	GradeNotGraded GradeStatus = "NotGraded"
+)
+
 type Grade struct {
-	Subject string `json:"subject"`
-	Date    string `json:"date"`
-	Grade   string `json:"grade"`
-	Comment string `json:"comment,omitempty"`
-	Course  string `json:"course"`
+	Subject     string      `json:"subject"`
+	Date        string      `json:"date"`
+	Grade       string      `json:"grade" doc:"Grade as shown on Pepal"`
+	Comment     string      `json:"comment,omitempty"`
+	Course      string      `json:"course"`
+	Published   bool        `json:"published" doc:"Whether Pepal shows the grade as published"`
+	Unit        string      `json:"unit,omitempty" doc:"Teaching unit of the course"`
+	Status      GradeStatus `json:"status" enum:"Graded,Absent,NotGraded"`
+	Value       *float64    `json:"value,omitempty" doc:"Mark, on the scale of the grade"`
+	Scale       float64     `json:"scale,omitempty" doc:"Maximum mark, 20 unless Pepal shows another one"`
+	Coefficient float64     `json:"coefficient" doc:"Weight of the grade, 1 unless Pepal shows one"`
+}
+
+// Average is the average of a course, a teaching unit or all the grades, on
+// 20.
+type Average struct {
+	Name        string   `json:"name"`
+	Unit        string   `json:"unit,omitempty" doc:"Teaching unit of a course"`
+	Average     *float64 `json:"average,omitempty" doc:"Average on 20, absent when no grade is graded"`
+	Grades      int      `json:"grades" doc:"Number of graded grades"`
+	Coefficient float64  `json:"coefficient" doc:"Sum of the coefficients of the graded grades"`
+}
+
+// Averages are the averages of the grades per course, per teaching unit and
+// overall, computed by controllers.ComputeAverages.
+type Averages struct {
+	Overall Average   `json:"overall"`
+	Units   []Average `json:"units"`
+	Courses []Average `json:"courses"`
+}
+
+// GradeEventType is the kind of change found on a grade.
+type GradeEventType string
+
+const (
+	GradeEventNew          GradeEventType = "new_grade"
+	GradeEventChanged      GradeEventType = "grade_changed"
+	GradeEventCommentAdded GradeEventType = "comment_added"
+)
+
+// GradeEvent is a change found on the grades of a user between two polls.
+type GradeEvent struct {
+	Type     GradeEventType `json:"type" enum:"new_grade,grade_changed,comment_added"`
+	Grade    Grade          `json:"grade"`
+	Previous *Grade         `json:"previous,omitempty" doc:"Grade as it was before the change"`
+	At       time.Time      `json:"at"`
+}
+
+type GradeWatchOutput struct {
+	Body struct {
+		WatchingSince time.Time `json:"watching_since"`
+		LastPoll      time.Time `json:"last_poll,omitempty"`
+	} `json:"body"`
+}
+
+type GradeEventsOutput struct {
+	Body struct {
+		Events []GradeEvent `json:"events"`
+	} `json:"body"`
 }
 
 type GradesOutput struct {
 	Body struct {
-		Grades []Grade `json:"grades"`
+		Grades   []Grade  `json:"grades"`
+		Averages Averages `json:"averages"`
 	} `json:"body"`
 }
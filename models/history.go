@@ -0,0 +1,67 @@
+package models
+
+import "time"
+
+// AttendanceOutcome is the final attendance of the user for a course.
+type AttendanceOutcome string
+
+const (
+	OutcomePresent AttendanceOutcome = "Present"
+	OutcomeLate    AttendanceOutcome = "Late"
+	OutcomeAbsent  AttendanceOutcome = "Absent"
+)
+
+// AttendanceRecord is the outcome of a past course, as observed on Pepal or,
+// for the courses whose roll call was never seen closed, inferred.
+type AttendanceRecord struct {
+	Day        string            `json:"day" format:"date"`
+	Semester   string            `json:"semester" example:"2024-2025 S1"`
+	CourseID   string            `json:"course_id"`
+	Subject    string            `json:"subject"`
+	Outcome    AttendanceOutcome `json:"outcome" enum:"Present,Late,Absent"`
+	Inferred   bool              `json:"inferred,omitempty" doc:"Set for an absence recorded because the roll call was not seen closed by the end of the day"`
+	RecordedAt time.Time         `json:"recorded_at"`
+}
+
+// AbsenceLevel tells how close an absence rate is to the school threshold.
+type AbsenceLevel string
+
+const (
+	AbsenceOK       AbsenceLevel = "ok"
+	AbsenceWarning  AbsenceLevel = "warning"
+	AbsenceExceeded AbsenceLevel = "exceeded"
+)
+
+// AbsenceStats counts the outcomes of a set of courses. Late presences count
+// as presences in the absence rate.
+type AbsenceStats struct {
+	Courses     int          `json:"courses"`
+	Present     int          `json:"present"`
+	Late        int          `json:"late"`
+	Absent      int          `json:"absent"`
+	AbsenceRate float64      `json:"absence_rate" doc:"Percentage of courses missed"`
+	Level       AbsenceLevel `json:"level" enum:"ok,warning,exceeded" doc:"Position of the absence rate against the school threshold"`
+	Observed    int          `json:"observed" doc:"Courses whose outcome was read on Pepal, the others being inferred absences"`
+	Coverage    float64      `json:"coverage" doc:"Percentage of the courses whose outcome was read on Pepal"`
+}
+
+type SubjectStats struct {
+	Subject string `json:"subject"`
+	AbsenceStats
+}
+
+type SemesterStats struct {
+	Semester string `json:"semester"`
+	AbsenceStats
+	Subjects []SubjectStats `json:"subjects"`
+}
+
+type AttendanceHistoryOutput struct {
+	Body struct {
+		Threshold float64            `json:"threshold" doc:"Absence rate, in percent, past which the school sanctions the student"`
+		Warning   float64            `json:"warning" doc:"Absence rate, in percent, from which the level is warning"`
+		Overall   AbsenceStats       `json:"overall"`
+		Semesters []SemesterStats    `json:"semesters"`
+		Records   []AttendanceRecord `json:"records"`
+	} `json:"body"`
+}
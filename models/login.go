@@ -1,7 +1,10 @@
 package models
 
+import "time"
+
 type LoginOutput struct {
 	Body struct {
-		Cookie string `json:"cookie"`
+		Token     string    `json:"token" doc:"Session token to send in the Authorization header"`
+		ExpiresAt time.Time `json:"expires_at" doc:"Expiry of the session"`
 	}
 }
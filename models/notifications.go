@@ -0,0 +1,15 @@
+package models
+
+import "helper/v3/notify"
+
+type NotificationChannelsOutput struct {
+	Body struct {
+		Channels []notify.Channel `json:"channels"`
+	} `json:"body"`
+}
+
+type DeadLettersOutput struct {
+	Body struct {
+		DeadLetters []notify.DeadLetter `json:"dead_letters"`
+	} `json:"body"`
+}
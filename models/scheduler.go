@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// PresenceRecord is the outcome of an automatic presence attempt for a course.
+type PresenceRecord struct {
+	Username   string    `json:"username"`
+	Day        string    `json:"day"`
+	CourseID   string    `json:"course_id"`
+	CourseName string    `json:"course_name"`
+	Result     string    `json:"result" enum:"marked,already_present,closed_absent,failed,missed"`
+	Error      string    `json:"error,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+type SchedulerOutput struct {
+	Body struct {
+		CalUUID    string    `json:"calUUID"`
+		EnrolledAt time.Time `json:"enrolled_at"`
+	} `json:"body"`
+}
+
+type SchedulerRecordsOutput struct {
+	Body struct {
+		Records []PresenceRecord `json:"records"`
+	} `json:"body"`
+}
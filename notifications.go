@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"helper/v3/models"
+	"helper/v3/notify"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// addNotificationRoutes registers the endpoints managing the notification
+// channels of the session user.
+func (a *app) addNotificationRoutes(api huma.API) {
+	// Get Notification Channels
+	register(api, huma.Operation{
+		OperationID: "getNotificationChannels",
+		Method:      http.MethodGet,
+		Path:        "/notifications/channels",
+		Summary:     "Get Notification Channels",
+		Description: "Get the channels the notifications of the session user are sent to. Webhook secrets are not returned.",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.NotificationChannelsOutput, error) {
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		return channelsOutput(a.notifier.Channels(session.Username)), nil
+	})
+
+	// Set Notification Channels
+	register(api, huma.Operation{
+		OperationID: "setNotificationChannels",
+		Method:      http.MethodPut,
+		Path:        "/notifications/channels",
+		Summary:     "Set Notification Channels",
+		Description: "Replace the channels the notifications of the session user are sent to. An empty list turns the notifications off.",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		Body  struct {
+			Channels []notify.Channel `json:"channels" maxItems:"5"`
+		}
+	}) (*models.NotificationChannelsOutput, error) {
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.notifier.SetChannels(session.Username, input.Body.Channels); err != nil {
+			var invalid *notify.ValidationError
+			if errors.As(err, &invalid) {
+				return nil, huma.Error422UnprocessableEntity(err.Error())
+			}
+			return nil, err
+		}
+		return channelsOutput(a.notifier.Channels(session.Username)), nil
+	})
+
+	// Test Notification Channels
+	register(api, huma.Operation{
+		OperationID: "testNotificationChannels",
+		Method:      http.MethodPost,
+		Path:        "/notifications/test",
+		Summary:     "Test Notification Channels",
+		Description: "Send a test notification to every channel of the session user. Failed deliveries show up in /notifications/dead-letters.",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.GenericOutput, error) {
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		if len(a.notifier.Channels(session.Username)) == 0 {
+			return nil, huma.Error412PreconditionFailed("set your notification channels with /notifications/channels first")
+		}
+		a.notifier.Notify(notify.Notification{
+			Kind:     notify.KindTest,
+			Username: session.Username,
+			Title:    "Notification de test",
+			Message:  "Les notifications de Pepal Helper arrivent bien sur ce canal.",
+		})
+		resp := &models.GenericOutput{}
+		resp.Body.Message = "Test notification queued"
+		return resp, nil
+	})
+
+	// Get Dead Letters
+	register(api, huma.Operation{
+		OperationID: "getDeadLetters",
+		Method:      http.MethodGet,
+		Path:        "/notifications/dead-letters",
+		Summary:     "Get Dead Letters",
+		Description: "Get the notifications of the session user that could not be delivered after every retry",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.DeadLettersOutput, error) {
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		letters, err := a.notifier.DeadLetters(session.Username)
+		if err != nil {
+			return nil, err
+		}
+		resp := &models.DeadLettersOutput{}
+		resp.Body.DeadLetters = letters
+		if resp.Body.DeadLetters == nil {
+			resp.Body.DeadLetters = []notify.DeadLetter{}
+		}
+		return resp, nil
+	})
+}
+
+// channelsOutput returns the channels of a user without their secrets.
+func channelsOutput(channels []notify.Channel) *models.NotificationChannelsOutput {
+	resp := &models.NotificationChannelsOutput{}
+	resp.Body.Channels = []notify.Channel{}
+	for _, channel := range channels {
+		channel.Secret = ""
+		resp.Body.Channels = append(resp.Body.Channels, channel)
+	}
+	return resp
+}
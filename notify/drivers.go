@@ -0,0 +1,201 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of the webhook deliveries. The signature is the hex HMAC-SHA256,
+// keyed with the channel secret, of the timestamp, a dot and the body, so a
+// receiver can also reject replayed payloads.
+const (
+	HeaderSignature = "X-Pepal-Signature"
+	HeaderTimestamp = "X-Pepal-Timestamp"
+	HeaderEvent     = "X-Pepal-Event"
+)
+
+// Sign returns the signature of a webhook payload sent at timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDriver posts the notifications as JSON to the channel URL, signed
+// with the channel secret.
+type WebhookDriver struct {
+	Client *http.Client
+}
+
+func (d *WebhookDriver) Send(ctx context.Context, channel Channel, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header := http.Header{}
+	header.Set(HeaderTimestamp, timestamp)
+	header.Set(HeaderSignature, Sign(channel.Secret, timestamp, body))
+	header.Set(HeaderEvent, string(n.Kind))
+	return post(ctx, d.Client, channel.URL, header, body)
+}
+
+// ChatDriver posts the notifications to Discord or Slack incoming webhooks,
+// whose payloads only differ by the name of the text field.
+type ChatDriver struct {
+	Client *http.Client
+}
+
+func (d *ChatDriver) Send(ctx context.Context, channel Channel, n Notification) error {
+	text := fmt.Sprintf("**%s**\n%s", n.Title, n.Message)
+	field := "content"
+	if channel.Type == ChannelSlack {
+		text = fmt.Sprintf("*%s*\n%s", n.Title, n.Message)
+		field = "text"
+	}
+
+	body, err := json.Marshal(map[string]string{field: text})
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+	return post(ctx, d.Client, channel.URL, http.Header{}, body)
+}
+
+// post sends a JSON body, treating the client errors other than 408 and 429
+// as permanent.
+func post(ctx context.Context, client *http.Client, url string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook answered %s", resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// SMTPDriver emails the notifications through an SMTP server, with
+// STARTTLS when the server offers it.
+type SMTPDriver struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	From string
+	// Auth authenticates to the server; nil sends without authentication.
+	Auth smtp.Auth
+}
+
+func (d *SMTPDriver) Send(ctx context.Context, channel Channel, n Notification) error {
+	to, err := mail.ParseAddress(channel.Email)
+	if err != nil {
+		return &PermanentError{Err: fmt.Errorf("invalid email address: %v", err)}
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + d.From + "\r\n")
+	msg.WriteString("To: " + to.Address + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", n.Title) + "\r\n")
+	msg.WriteString("Date: " + n.At.Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Message, "\n", "\r\n") + "\r\n")
+	return d.sendMail(ctx, to.Address, []byte(msg.String()))
+}
+
+// sendMail sends msg to a recipient like smtp.SendMail, on a connection
+// bounded by the deadline of ctx and closed when ctx is canceled.
+func (d *SMTPDriver) sendMail(ctx context.Context, to string, msg []byte) error {
+	host, _, err := net.SplitHostPort(d.Addr)
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if d.Auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return &PermanentError{Err: errors.New("the SMTP server does not support authentication")}
+		}
+		if err := client.Auth(d.Auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(d.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// The message is accepted once its data is: a failed QUIT must not send
+	// it again
+	client.Quit()
+	return nil
+}
@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// chatHosts are the hosts of the Discord and Slack incoming webhooks. The
+// chat channels are refused on any other host.
+var chatHosts = map[string][]string{
+	ChannelDiscord: {"discord.com", "discordapp.com", "ptb.discord.com", "canary.discord.com"},
+	ChannelSlack:   {"hooks.slack.com"},
+}
+
+// reservedPrefixes are the ranges outside the public internet that netip
+// does not classify: "this network" and the carrier-grade NAT.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// publicAddr reports whether addr is a public unicast address, so a webhook
+// cannot make the server reach its own host or internal network.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupHost resolves the addresses of a webhook host.
+func lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// checkHost resolves host and refuses it if any of its addresses is not
+// public.
+func (d *Dispatcher) checkHost(host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := d.lookup(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("the host %s cannot be resolved", host)
+	}
+	for _, addr := range addrs {
+		if !publicAddr(addr) {
+			return fmt.Errorf("the host %s is not a public address", host)
+		}
+	}
+	return nil
+}
+
+// PublicClient returns an HTTP client for the webhook drivers that only
+// connects to public addresses. The check is done on the address dialed, so
+// it also covers the redirects and a host resolving to another address after
+// its channel was validated.
+func PublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddr(addrPort.Addr()) {
+				return &PermanentError{Err: fmt.Errorf("refusing to connect to %s, not a public address", address)}
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
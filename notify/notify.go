@@ -0,0 +1,439 @@
+// Package notify delivers the notifications of the service (grade changes,
+// roll call openings, failed presences, calendar changes) to the channels
+// each user chose: signed HTTP webhooks, Discord or Slack webhooks and
+// email. Deliveries are retried with an exponential backoff and the ones
+// that keep failing are appended to a dead-letter log.
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"helper/v3/atomicfile"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Kind is the event a notification reports.
+type Kind string
+
+const (
+	KindGradeNew        Kind = "grade_new"
+	KindGradeChanged    Kind = "grade_changed"
+	KindGradeComment    Kind = "grade_comment"
+	KindAttendanceOpen  Kind = "attendance_open"
+	KindPresenceFailed  Kind = "presence_failed"
+	KindCalendarChanged Kind = "calendar_changed"
+	KindAbsenceWarning  Kind = "absence_warning"
+	// KindParserDrift alerts the administrator that Pepal served a page the
+	// parsers do not recognise.
+	KindParserDrift Kind = "parser_drift"
+	KindTest        Kind = "test"
+)
+
+// Notification is a message for a user.
+type Notification struct {
+	Kind     Kind      `json:"kind"`
+	Username string    `json:"username"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Data     any       `json:"data,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Channel types.
+const (
+	ChannelWebhook = "webhook"
+	ChannelDiscord = "discord"
+	ChannelSlack   = "slack"
+	ChannelEmail   = "email"
+)
+
+// maxChannelsPerUser bounds the channels a user can register.
+const maxChannelsPerUser = 5
+
+// Channel is a destination chosen by a user.
+type Channel struct {
+	Type string `json:"type" enum:"webhook,discord,slack,email"`
+	// URL is the endpoint of the webhook channels.
+	URL string `json:"url,omitempty" doc:"Endpoint of the webhook, Discord and Slack channels"`
+	// Secret signs the payloads of the webhook channel.
+	Secret string `json:"secret,omitempty" doc:"Secret signing the webhook payloads, never returned"`
+	// Email is the address of the email channel.
+	Email string `json:"email,omitempty" doc:"Address of the email channel"`
+	// Kinds restricts the channel to some notifications; empty means all.
+	Kinds []Kind `json:"kinds,omitempty" enum:"grade_new,grade_changed,grade_comment,attendance_open,presence_failed,calendar_changed,absence_warning,parser_drift"`
+}
+
+// accepts reports whether the channel wants notifications of kind.
+func (c Channel) accepts(kind Kind) bool {
+	if len(c.Kinds) == 0 || kind == KindTest {
+		return true
+	}
+	for _, k := range c.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Driver sends a notification to a channel.
+type Driver interface {
+	Send(ctx context.Context, channel Channel, n Notification) error
+}
+
+// Notifier accepts notifications to deliver. A nil Notifier is not allowed;
+// the packages producing notifications check for nil before calling it.
+type Notifier interface {
+	Notify(n Notification)
+}
+
+// PermanentError marks a delivery failure that retrying cannot fix, such as
+// a webhook answering 404.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// DeadLetter is a delivery that failed after every attempt.
+type DeadLetter struct {
+	Notification Notification `json:"notification"`
+	Channel      Channel      `json:"channel"`
+	Attempts     int          `json:"attempts"`
+	Error        string       `json:"error"`
+	At           time.Time    `json:"at"`
+}
+
+// Config tunes the deliveries.
+type Config struct {
+	// Attempts is the number of tries of a delivery.
+	Attempts int
+	// Backoff is the delay before the first retry, doubled for each
+	// following one up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Workers is the number of concurrent deliveries.
+	Workers int
+	// QueueSize bounds the pending notifications; new ones are dropped once
+	// it is reached.
+	QueueSize int
+	// AllowHTTP accepts webhook URLs without TLS, for local tests.
+	AllowHTTP bool
+	// AllowPrivate accepts webhook hosts on loopback, private or link-local
+	// addresses, for local tests. The chat channels keep their hosts.
+	AllowPrivate bool
+}
+
+// DefaultConfig tries each delivery 4 times over about 15 seconds.
+var DefaultConfig = Config{
+	Attempts:   4,
+	Backoff:    2 * time.Second,
+	MaxBackoff: time.Minute,
+	Workers:    4,
+	QueueSize:  1000,
+}
+
+// delivery is a notification to send to one channel.
+type delivery struct {
+	channel Channel
+	n       Notification
+}
+
+// Dispatcher keeps the channels of the users and delivers their
+// notifications. It is safe for concurrent use.
+type Dispatcher struct {
+	drivers        map[string]Driver
+	path           string
+	deadLetterPath string
+	config         Config
+	queue          chan delivery
+	// lookup resolves the webhook hosts.
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+
+	mu       sync.Mutex
+	channels map[string][]Channel
+	// deadMu serialises the appends to the dead-letter log.
+	deadMu sync.Mutex
+}
+
+// New returns a dispatcher persisting the channels at path and appending
+// the failed deliveries to deadLetterPath. Channel types without a driver
+// are refused.
+func New(drivers map[string]Driver, path, deadLetterPath string, config Config) (*Dispatcher, error) {
+	d := &Dispatcher{
+		drivers:        drivers,
+		path:           path,
+		deadLetterPath: deadLetterPath,
+		config:         config,
+		queue:          make(chan delivery, config.QueueSize),
+		lookup:         lookupHost,
+		channels:       make(map[string][]Channel),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading notification channels: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &d.channels); err != nil {
+			return nil, fmt.Errorf("error decoding notification channels: %v", err)
+		}
+	}
+	return d, nil
+}
+
+// Channels returns the channels of a user.
+func (d *Dispatcher) Channels(username string) []Channel {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Channel(nil), d.channels[username]...)
+}
+
+// SetChannels replaces the channels of a user after validating them. An
+// empty list turns the notifications of the user off.
+func (d *Dispatcher) SetChannels(username string, channels []Channel) error {
+	if len(channels) > maxChannelsPerUser {
+		return fmt.Errorf("at most %d channels are allowed", maxChannelsPerUser)
+	}
+	channels = slices.Clone(channels)
+	for i := range channels {
+		if err := d.validate(&channels[i]); err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(channels) == 0 {
+		delete(d.channels, username)
+	} else {
+		d.channels[username] = channels
+	}
+
+	data, err := json.MarshalIndent(d.channels, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(d.path, data, 0o700); err != nil {
+		return fmt.Errorf("error writing notification channels: %v", err)
+	}
+	return nil
+}
+
+// ValidationError reports a channel that cannot be registered.
+type ValidationError struct {
+	Msg string
+}
+
+func (e *ValidationError) Error() string { return e.Msg }
+
+// validate checks that a channel has a driver and the fields it needs. The
+// Discord and Slack channels must point to their provider, and the hosts of
+// the webhooks must resolve to public addresses. The email address is
+// replaced by its parsed form, without display name.
+func (d *Dispatcher) validate(channel *Channel) error {
+	if _, ok := d.drivers[channel.Type]; !ok {
+		return &ValidationError{Msg: fmt.Sprintf("%s channels are not available on this server", channel.Type)}
+	}
+	switch channel.Type {
+	case ChannelWebhook, ChannelDiscord, ChannelSlack:
+		u, err := url.Parse(channel.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && !(d.config.AllowHTTP && u.Scheme == "http")) {
+			return &ValidationError{Msg: "the channel URL must be an https URL"}
+		}
+		if hosts, ok := chatHosts[channel.Type]; ok && !slices.Contains(hosts, strings.ToLower(u.Hostname())) {
+			return &ValidationError{Msg: fmt.Sprintf("%s channels must be %s webhooks", channel.Type, hosts[0])}
+		}
+		if !d.config.AllowPrivate {
+			if err := d.checkHost(u.Hostname()); err != nil {
+				return &ValidationError{Msg: err.Error()}
+			}
+		}
+		if channel.Type == ChannelWebhook && channel.Secret == "" {
+			return &ValidationError{Msg: "webhook channels need a secret to sign their payloads"}
+		}
+	case ChannelEmail:
+		addr, err := mail.ParseAddress(channel.Email)
+		if err != nil {
+			return &ValidationError{Msg: "invalid email address"}
+		}
+		channel.Email = addr.Address
+	}
+	return nil
+}
+
+// Notify queues a notification for every channel of its user accepting its
+// kind. It never blocks: the notification is dropped when the queue is full.
+func (d *Dispatcher) Notify(n Notification) {
+	if n.At.IsZero() {
+		n.At = time.Now()
+	}
+	for _, channel := range d.Channels(n.Username) {
+		if !channel.accepts(n.Kind) {
+			continue
+		}
+		select {
+		case d.queue <- delivery{channel: channel, n: n}:
+		default:
+			log.Warn().Str("username", n.Username).Str("kind", string(n.Kind)).Msg("Notification queue full, dropping notification")
+		}
+	}
+}
+
+// Run delivers the queued notifications until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	workers := d.config.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case delivery := <-d.queue:
+					d.deliver(ctx, delivery)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// deliver sends a notification to a channel, retrying with backoff, and
+// records it in the dead-letter log when every attempt failed.
+func (d *Dispatcher) deliver(ctx context.Context, delivery delivery) {
+	driver := d.drivers[delivery.channel.Type]
+	attempts := max(d.config.Attempts, 1)
+	backoff := d.config.Backoff
+
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err = driver.Send(sendCtx, delivery.channel, delivery.n)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		var permanent *PermanentError
+		if errors.As(err, &permanent) || attempt >= attempts {
+			break
+		}
+		log.Warn().Err(err).Str("username", delivery.n.Username).Str("channel", delivery.channel.Type).
+			Int("attempt", attempt).Msg("Notification delivery failed, retrying")
+
+		if !sleep(ctx, backoff) {
+			err = ctx.Err()
+			break
+		}
+		backoff *= 2
+		if d.config.MaxBackoff > 0 {
+			backoff = min(backoff, d.config.MaxBackoff)
+		}
+	}
+
+	log.Error().Err(err).Str("username", delivery.n.Username).Str("channel", delivery.channel.Type).
+		Msg("Notification delivery failed")
+	d.deadLetter(DeadLetter{
+		Notification: delivery.n,
+		Channel:      redact(delivery.channel),
+		Attempts:     attempt,
+		Error:        err.Error(),
+		At:           time.Now(),
+	})
+}
+
+// sleep waits for delay, returning false if ctx is cancelled first.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// redact removes the secret of a channel before it is logged.
+func redact(channel Channel) Channel {
+	if channel.Secret != "" {
+		channel.Secret = "redacted"
+	}
+	return channel
+}
+
+// deadLetter appends a failed delivery to the dead-letter log, one JSON
+// object per line.
+func (d *Dispatcher) deadLetter(letter DeadLetter) {
+	d.deadMu.Lock()
+	defer d.deadMu.Unlock()
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		log.Error().Err(err).Msg("Error encoding dead letter")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(d.deadLetterPath), 0o700); err != nil {
+		log.Error().Err(err).Msg("Error writing dead letter")
+		return
+	}
+	file, err := os.OpenFile(d.deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Error().Err(err).Msg("Error writing dead letter")
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Error().Err(err).Msg("Error writing dead letter")
+	}
+}
+
+// DeadLetters returns the failed deliveries of a user, oldest first.
+func (d *Dispatcher) DeadLetters(username string) ([]DeadLetter, error) {
+	d.deadMu.Lock()
+	defer d.deadMu.Unlock()
+
+	file, err := os.Open(d.deadLetterPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			continue
+		}
+		if letter.Notification.Username == username {
+			letters = append(letters, letter)
+		}
+	}
+	return letters, scanner.Err()
+}
@@ -0,0 +1,302 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testNotification = Notification{
+	Kind:     KindGradeNew,
+	Username: "jdoe",
+	Title:    "Nouvelle note en GOLANG",
+	Message:  "TP1 : 15,5",
+	At:       time.Date(2024, 6, 13, 9, 0, 0, 0, time.UTC),
+}
+
+func TestWebhookDriverSignsPayload(t *testing.T) {
+	var got Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(HeaderTimestamp)
+		if want := Sign("s3cret", timestamp, body); r.Header.Get(HeaderSignature) != want {
+			t.Errorf("signature = %q, want %q", r.Header.Get(HeaderSignature), want)
+		}
+		if r.Header.Get(HeaderEvent) != string(KindGradeNew) {
+			t.Errorf("event = %q", r.Header.Get(HeaderEvent))
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer server.Close()
+
+	driver := &WebhookDriver{Client: server.Client()}
+	channel := Channel{Type: ChannelWebhook, URL: server.URL, Secret: "s3cret"}
+	if err := driver.Send(context.Background(), channel, testNotification); err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != testNotification.Title || got.Username != "jdoe" {
+		t.Errorf("payload = %+v", got)
+	}
+}
+
+func TestChatDriverPayloads(t *testing.T) {
+	for _, test := range []struct {
+		channelType string
+		field       string
+	}{
+		{ChannelDiscord, "content"},
+		{ChannelSlack, "text"},
+	} {
+		var payload map[string]string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&payload)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		driver := &ChatDriver{Client: server.Client()}
+		err := driver.Send(context.Background(), Channel{Type: test.channelType, URL: server.URL}, testNotification)
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.channelType, err)
+		}
+		if !strings.Contains(payload[test.field], "TP1 : 15,5") {
+			t.Errorf("%s payload = %q", test.channelType, payload)
+		}
+	}
+}
+
+func TestWebhookClientErrorIsPermanent(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	driver := &WebhookDriver{Client: server.Client()}
+	err := driver.Send(context.Background(), Channel{Type: ChannelWebhook, URL: server.URL, Secret: "x"}, testNotification)
+	if _, ok := err.(*PermanentError); !ok {
+		t.Errorf("err = %v, want a PermanentError", err)
+	}
+}
+
+// smtpServer is a minimal SMTP stand-in accepting one message, sent with the
+// envelope commands before it.
+func smtpServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+		reply("220 localhost ESMTP")
+		var data, commands strings.Builder
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					messages <- commands.String() + data.String()
+					reply("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch command := strings.ToUpper(strings.Fields(line)[0]); command {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "DATA":
+				inData = true
+				reply("354 End data with <CR><LF>.<CR><LF>")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				commands.WriteString(line)
+				reply("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestSMTPDriverSendsMail(t *testing.T) {
+	addr, messages := smtpServer(t)
+
+	driver := &SMTPDriver{Addr: addr, From: "helper@example.com"}
+	channel := Channel{Type: ChannelEmail, Email: "Jean Doe <jdoe@example.com>"}
+	if err := driver.Send(context.Background(), channel, testNotification); err != nil {
+		t.Fatal(err)
+	}
+
+	message := <-messages
+	for _, want := range []string{"RCPT TO:<jdoe@example.com>", "To: jdoe@example.com\r\n", "Subject: Nouvelle note en GOLANG", "TP1 : 15,5"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message does not contain %q:\n%s", want, message)
+		}
+	}
+}
+
+// failingDriver fails every delivery and counts the attempts.
+type failingDriver struct {
+	mu       sync.Mutex
+	attempts int
+}
+
+func (d *failingDriver) Send(ctx context.Context, channel Channel, n Notification) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.attempts++
+	return io.ErrUnexpectedEOF
+}
+
+func TestSMTPDriverStopsAtDeadline(t *testing.T) {
+	// A server accepting the connection but never greeting
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	driver := &SMTPDriver{Addr: listener.Addr().String(), From: "helper@example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := driver.Send(ctx, Channel{Type: ChannelEmail, Email: "jdoe@example.com"}, testNotification); err == nil {
+		t.Error("the mail was sent to a silent server")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the delivery ignored the deadline, it took %s", elapsed)
+	}
+}
+
+func TestDispatcherRetriesThenDeadLetters(t *testing.T) {
+	dir := t.TempDir()
+	driver := &failingDriver{}
+	config := Config{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Workers: 1, QueueSize: 10}
+	d, err := New(map[string]Driver{ChannelWebhook: driver}, filepath.Join(dir, "channels.json"), filepath.Join(dir, "dead.jsonl"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.lookup = fakeLookup
+	channel := Channel{Type: ChannelWebhook, URL: "https://example.com/hook", Secret: "s3cret"}
+	if err := d.SetChannels("jdoe", []Channel{channel}); err != nil {
+		t.Fatal(err)
+	}
+	d.deliver(context.Background(), delivery{channel: channel, n: testNotification})
+
+	if driver.attempts != 3 {
+		t.Errorf("attempts = %d, want 3", driver.attempts)
+	}
+	letters, err := d.DeadLetters("jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Attempts != 3 || letters[0].Channel.Secret == "s3cret" {
+		t.Errorf("dead letters = %+v", letters)
+	}
+}
+
+// fakeLookup resolves the hosts of the tests without DNS: internal.example.com
+// is on the private network, and the other hosts are public.
+func fakeLookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	if host == "internal.example.com" {
+		return []netip.Addr{netip.MustParseAddr("93.184.215.14"), netip.MustParseAddr("10.0.0.7")}, nil
+	}
+	return []netip.Addr{netip.MustParseAddr("93.184.215.14")}, nil
+}
+
+func TestDispatcherValidatesChannels(t *testing.T) {
+	dir := t.TempDir()
+	drivers := map[string]Driver{ChannelWebhook: &WebhookDriver{}, ChannelDiscord: &ChatDriver{}, ChannelSlack: &ChatDriver{}, ChannelEmail: &SMTPDriver{}}
+	d, err := New(drivers, filepath.Join(dir, "channels.json"), filepath.Join(dir, "dead.jsonl"), DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.lookup = fakeLookup
+
+	for _, channel := range []Channel{
+		{Type: ChannelWebhook, URL: "http://example.com/hook", Secret: "x"},
+		{Type: ChannelWebhook, URL: "https://example.com/hook"},
+		{Type: ChannelEmail, Email: "jdoe"},
+		{Type: ChannelWebhook, URL: "https://127.0.0.1/hook", Secret: "x"},
+		{Type: ChannelWebhook, URL: "https://[::1]/hook", Secret: "x"},
+		{Type: ChannelWebhook, URL: "https://10.1.2.3/hook", Secret: "x"},
+		{Type: ChannelWebhook, URL: "https://169.254.169.254/latest/meta-data", Secret: "x"},
+		{Type: ChannelWebhook, URL: "https://[::ffff:192.168.1.1]/hook", Secret: "x"},
+		{Type: ChannelWebhook, URL: "https://internal.example.com/hook", Secret: "x"},
+		{Type: ChannelDiscord, URL: "https://example.com/api/webhooks/1/x"},
+		{Type: ChannelDiscord, URL: "https://discord.com.example.com/api/webhooks/1/x"},
+		{Type: ChannelSlack, URL: "https://discord.com/api/webhooks/1/x"},
+	} {
+		if err := d.SetChannels("jdoe", []Channel{channel}); err == nil {
+			t.Errorf("channel %+v was accepted", channel)
+		}
+	}
+
+	for _, channel := range []Channel{
+		{Type: ChannelWebhook, URL: "https://example.com/hook", Secret: "x"},
+		{Type: ChannelDiscord, URL: "https://discord.com/api/webhooks/1/x"},
+		{Type: ChannelSlack, URL: "https://hooks.slack.com/services/T0/B0/x"},
+	} {
+		if err := d.SetChannels("jdoe", []Channel{channel}); err != nil {
+			t.Errorf("channel %+v was refused: %v", channel, err)
+		}
+	}
+
+	// Only the address of an email channel is kept
+	if err := d.SetChannels("jdoe", []Channel{{Type: ChannelEmail, Email: "Jean Doe <jdoe@example.com>"}}); err != nil {
+		t.Fatal(err)
+	}
+	if channels := d.Channels("jdoe"); channels[0].Email != "jdoe@example.com" {
+		t.Errorf("email = %q", channels[0].Email)
+	}
+}
+
+func TestPublicClientRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request reached a loopback server")
+	}))
+	defer server.Close()
+
+	driver := &WebhookDriver{Client: PublicClient(time.Second)}
+	err := driver.Send(context.Background(), Channel{Type: ChannelWebhook, URL: server.URL, Secret: "x"}, testNotification)
+	var permanent *PermanentError
+	if !errors.As(err, &permanent) {
+		t.Errorf("error = %v, want a permanent error", err)
+	}
+}
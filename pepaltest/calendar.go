@@ -0,0 +1,50 @@
+package pepaltest
+
+import (
+	"strings"
+	"time"
+)
+
+// Event is an event of a calendar feed. An event without summary is a
+// company day.
+type Event struct {
+	UID       string
+	Summary   string
+	Location  string
+	Professor string
+	Start     time.Time
+	End       time.Time
+}
+
+// Calendar returns an iCalendar feed of the events, written as Pepal does:
+// CRLF line endings and times in UTC.
+func Calendar(events ...Event) string {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Pepal//Calendrier//FR",
+	}
+	for _, event := range events {
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+event.UID,
+			"DTSTAMP:"+event.Start.UTC().Format("20060102T150405Z"),
+			"DTSTART:"+event.Start.UTC().Format("20060102T150405Z"),
+			"DTEND:"+event.End.UTC().Format("20060102T150405Z"),
+			"SUMMARY:"+escapeText(event.Summary),
+			"LOCATION:"+escapeText(event.Location),
+		)
+		if event.Professor != "" {
+			lines = append(lines, "PROF:"+escapeText(event.Professor))
+		}
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func escapeText(text string) string {
+	return textEscaper.Replace(text)
+}
@@ -0,0 +1,129 @@
+package pepaltest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"strings"
+
+	"helper/v3/models"
+)
+
+// The act values the attendance buttons post to student/upload.php.
+const (
+	actPresent = "set_present"
+	actLate    = "set_present_late"
+)
+
+const loginPage = `<!DOCTYPE html>
+<html lang="fr"><head><title>Pepal</title></head>
+<body>
+<form class="login-form" action="/include/php/ident.php" method="post">
+<input type="text" name="login" placeholder="Identifiant">
+<input type="password" name="pass" placeholder="Mot de passe">
+<button type="submit">Connexion</button>
+</form>
+</body></html>`
+
+const accessDenied = `<!DOCTYPE html>
+<html lang="fr"><body><div class="alert alert-danger">Accès refusé !</div></body></html>`
+
+const loginSucceeded = `<!DOCTYPE html>
+<html lang="fr"><body><p>Connexion réussie</p><script>window.location = "/";</script></body></html>`
+
+const unknownCourse = `<!DOCTYPE html>
+<html lang="fr"><body><div class="alert alert-danger">Séance introuvable</div></body></html>`
+
+const presenceSaved = `<script>location.reload();</script>`
+
+const presenceRefused = `<div class="alert alert-danger">Impossible de valider la présence</div>`
+
+// page wraps the content in the layout of the Pepal pages.
+func page(title, content string) string {
+	return `<!DOCTYPE html>
+<html lang="fr"><head><meta charset="utf-8"><title>` + html.EscapeString(title) + ` - Pepal</title></head>
+<body><div class="container">
+<h1>` + html.EscapeString(title) + `</h1>
+` + content + `
+</div></body></html>`
+}
+
+// presencesPage lists the courses of the day, each linking to its
+// attendance page.
+func presencesPage(courses []Course) string {
+	var b strings.Builder
+	b.WriteString(`<table class="table table-striped"><thead><tr><th>Horaire</th><th>Séance</th><th></th></tr></thead><tbody>`)
+	for _, course := range courses {
+		b.WriteString(`<tr><td>` + html.EscapeString(course.Time) + `</td><td>` + html.EscapeString(course.Name) + `</td>`)
+		b.WriteString(`<td><a href="/presences/s/` + html.EscapeString(course.ID) + `" class="btn btn-default">Appel</a></td></tr>`)
+	}
+	b.WriteString(`</tbody></table>`)
+	return page("Présences", b.String())
+}
+
+// attendancePage shows the course and its roll call panel, with the markup
+// of the attendance pages in controllers/testdata/attendance.
+func attendancePage(course Course) string {
+	var panel string
+	switch course.State {
+	case models.AttendanceNotYetOpen:
+		panel = `<p class="text-muted">L'appel n'est pas encore ouvert.</p>`
+	case models.AttendanceOpen:
+		panel = `<p>L'appel est ouvert.</p>
+<a href="#" id="body_presence" class="btn btn-success btn-lg" data-act="` + actPresent + `">Valider la présence</a>`
+	case models.AttendanceLateOpen:
+		panel = `<p class="text-warning">Les présences à l'heure ne sont plus acceptées.</p>
+<a href="#" class="btn btn-warning btn-lg" data-act="` + actLate + `">Valider la présence en retard</a>`
+	case models.AttendanceClosedPresent:
+		panel = `<p>L'appel est clôturé.</p>
+<p class="text-success"><i class="fa fa-check"></i> Vous avez été noté présent.</p>`
+	case models.AttendanceClosedAbsent:
+		panel = `<p>L'appel est clôturé.</p>
+<p class="text-danger"><i class="fa fa-times"></i> Vous n'avez pas été noté présent.</p>`
+	default:
+		panel = `<p>` + html.EscapeString(string(course.State)) + `</p>`
+	}
+	return page(course.Name, `<div class="row">
+<div class="col-md-6"><div class="panel panel-default"><div class="panel-heading">Séance</div><div class="panel-body">
+<p>Horaire : `+html.EscapeString(course.Time)+`</p>
+</div></div></div>
+<div class="col-md-6"><div class="panel panel-primary"><div class="panel-heading">Appel</div><div class="panel-body">
+`+panel+`
+</div></div></div>
+</div>`)
+}
+
+// gradesPage shows the grades table, with a header row for each teaching
+// unit and course and a row below the grades that have a comment.
+func gradesPage(grades []Grade) string {
+	var b strings.Builder
+	b.WriteString(`<table class="table table-bordered"><thead><tr><th>Évaluation</th><th>Type</th><th>Date</th><th>Note</th><th>Coef.</th></tr></thead><tbody>`)
+	var unit, course string
+	for _, grade := range grades {
+		if grade.Unit != unit {
+			unit = grade.Unit
+			b.WriteString(`<tr class="warning"><td colspan="5">` + html.EscapeString(unit) + `</td></tr>`)
+		}
+		if grade.Course != course {
+			course = grade.Course
+			b.WriteString(`<tr class="info"><td colspan="5">` + html.EscapeString(course) + `</td></tr>`)
+		}
+
+		subject := html.EscapeString(grade.Subject)
+		if grade.Published {
+			subject += ` <span class="label label-success">PUBLIE</span>`
+		}
+		b.WriteString(`<tr><td>` + subject + `</td><td>Contrôle</td><td>` + html.EscapeString(grade.Date) +
+			`</td><td>` + html.EscapeString(grade.Mark) + `</td><td>` + html.EscapeString(grade.Coef) + `</td></tr>`)
+		if grade.Comment != "" {
+			b.WriteString(`<tr><td></td><td colspan="4">` + html.EscapeString(grade.Comment) + `</td></tr>`)
+		}
+	}
+	b.WriteString(`</tbody></table>`)
+	return page("Mes notes", b.String())
+}
+
+func hashContent(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:8])
+}
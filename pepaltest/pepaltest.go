@@ -0,0 +1,379 @@
+// Package pepaltest provides a fake Pepal, for testing the controllers and
+// the API without reaching the live site. It serves the login, presences,
+// attendance, presence validation, grades and calendar pages the controllers
+// scrape, from data set by the tests, and can answer gzip-encoded or with the
+// login page of an expired session.
+package pepaltest
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"helper/v3/models"
+)
+
+// Course is a course of the day shown on the presences page.
+type Course struct {
+	ID   string
+	Name string
+	// Time is the slot shown by Pepal, such as "09:00-12:00".
+	Time string
+	// State is the roll call state shown on the attendance page. Validating
+	// the presence of an Open or LateOpen course makes it Validated.
+	State models.AttendanceState
+	// Validated is the state shown once the presence is validated,
+	// ClosedPresent when empty.
+	Validated models.AttendanceState
+}
+
+// Grade is a row of the grades table.
+type Grade struct {
+	// Unit and Course are the header rows the grade is listed under.
+	Unit      string
+	Course    string
+	Subject   string
+	Date      string
+	Mark      string
+	Coef      string
+	Published bool
+	// Comment, when set, is shown in a row of its own below the grade.
+	Comment string
+}
+
+// user is an account of the fake Pepal.
+type user struct {
+	password string
+	courses  []Course
+	grades   []Grade
+	// presences replaces the presences page when set.
+	presences string
+}
+
+// Pepal is a fake Pepal instance. It is an http.Handler safe for concurrent
+// use, configured through its methods.
+type Pepal struct {
+	// Gzip, when set, encodes every response with gzip whether or not the
+	// client asked for it, as Pepal does.
+	Gzip bool
+	// SessionTTL is the lifetime of the sdv cookies, 1 hour when zero.
+	SessionTTL time.Duration
+
+	mu        sync.Mutex
+	users     map[string]*user
+	sessions  map[string]string
+	calendars map[string]string
+	requests  []string
+}
+
+// New returns a fake Pepal without any user or calendar.
+func New() *Pepal {
+	return &Pepal{
+		users:     make(map[string]*user),
+		sessions:  make(map[string]string),
+		calendars: make(map[string]string),
+	}
+}
+
+// Server is a fake Pepal listening on a local address.
+type Server struct {
+	*httptest.Server
+	*Pepal
+}
+
+// NewServer starts a fake Pepal. Its URL, with a trailing slash, is the base
+// URL of a PepalClient. The caller should Close it when done.
+func NewServer() *Server {
+	pepal := New()
+	return &Server{Server: httptest.NewServer(pepal), Pepal: pepal}
+}
+
+// AddUser creates an account, or changes its password.
+func (p *Pepal) AddUser(username, password string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if u, ok := p.users[username]; ok {
+		u.password = password
+		return
+	}
+	p.users[username] = &user{password: password}
+}
+
+// SetCourses replaces the courses of the day of a user.
+func (p *Pepal) SetCourses(username string, courses ...Course) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if u, ok := p.users[username]; ok {
+		u.courses = append([]Course(nil), courses...)
+	}
+}
+
+// SetPresencesPage serves page as the presences page of a user, such as a
+// page of an unknown template. An empty page restores the list of courses.
+func (p *Pepal) SetPresencesPage(username, page string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if u, ok := p.users[username]; ok {
+		u.presences = page
+	}
+}
+
+// SetCourseState changes the roll call state of a course of a user.
+func (p *Pepal) SetCourseState(username, courseID string, state models.AttendanceState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if course := p.course(username, courseID); course != nil {
+		course.State = state
+	}
+}
+
+// CourseState returns the roll call state of a course of a user.
+func (p *Pepal) CourseState(username, courseID string) models.AttendanceState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if course := p.course(username, courseID); course != nil {
+		return course.State
+	}
+	return ""
+}
+
+// SetGrades replaces the grades of a user.
+func (p *Pepal) SetGrades(username string, grades ...Grade) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if u, ok := p.users[username]; ok {
+		u.grades = append([]Grade(nil), grades...)
+	}
+}
+
+// SetCalendar serves an iCalendar feed at the calendar UUID. An empty
+// content removes the calendar.
+func (p *Pepal) SetCalendar(calUUID, content string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if content == "" {
+		delete(p.calendars, calUUID)
+		return
+	}
+	p.calendars[calUUID] = content
+}
+
+// ExpireSessions invalidates every sdv cookie: the next authenticated
+// requests get the login page.
+func (p *Pepal) ExpireSessions() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions = make(map[string]string)
+}
+
+// Requests returns the requests received so far, as "METHOD /path?query".
+func (p *Pepal) Requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+// ResetRequests forgets the requests received so far.
+func (p *Pepal) ResetRequests() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = nil
+}
+
+func (p *Pepal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = append(p.requests, r.Method+" "+r.URL.RequestURI())
+
+	if p.Gzip {
+		gz := &gzipWriter{ResponseWriter: w}
+		defer gz.Close()
+		w = gz
+	}
+
+	path := r.URL.Path
+	switch {
+	case r.Method == http.MethodPost && path == "/include/php/ident.php":
+		p.login(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/ical_student/"):
+		p.calendar(w, r, strings.TrimPrefix(path, "/ical_student/"))
+	case r.Method == http.MethodGet && path == "/presences":
+		p.authenticated(w, r, p.presences)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/presences/s/"):
+		p.authenticated(w, r, func(w http.ResponseWriter, r *http.Request, u *user) {
+			p.attendance(w, u, strings.TrimPrefix(path, "/presences/s/"))
+		})
+	case r.Method == http.MethodPost && path == "/student/upload.php":
+		p.authenticated(w, r, p.upload)
+	case r.Method == http.MethodGet && path == "/" && r.URL.Query().Get("my") == "notes":
+		p.authenticated(w, r, p.notes)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// gzipWriter compresses the body written by a handler. The responses that
+// cannot have a body, such as 304, are sent as they are.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Close writes the end of the compressed body, if any.
+func (w *gzipWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// login checks the credentials and sets the sdv cookie.
+func (p *Pepal) login(w http.ResponseWriter, r *http.Request) {
+	u, ok := p.users[r.PostFormValue("login")]
+	if !ok || u.password != r.PostFormValue("pass") {
+		writePage(w, accessDenied)
+		return
+	}
+
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	cookie := hex.EncodeToString(raw)
+	p.sessions[cookie] = r.PostFormValue("login")
+
+	ttl := p.SessionTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "sdv",
+		Value:    cookie,
+		Path:     "/",
+		Expires:  time.Now().Add(ttl),
+		HttpOnly: true,
+	})
+	writePage(w, loginSucceeded)
+}
+
+// authenticated serves the page of the user of the sdv cookie, or the login
+// page when the cookie is missing or expired.
+func (p *Pepal) authenticated(w http.ResponseWriter, r *http.Request, page func(http.ResponseWriter, *http.Request, *user)) {
+	cookie, err := r.Cookie("sdv")
+	if err != nil {
+		writePage(w, loginPage)
+		return
+	}
+	username, ok := p.sessions[cookie.Value]
+	if !ok {
+		writePage(w, loginPage)
+		return
+	}
+	page(w, r, p.users[username])
+}
+
+// course returns a course of a user. The caller must hold p.mu.
+func (p *Pepal) course(username, courseID string) *Course {
+	u, ok := p.users[username]
+	if !ok {
+		return nil
+	}
+	for i := range u.courses {
+		if u.courses[i].ID == courseID {
+			return &u.courses[i]
+		}
+	}
+	return nil
+}
+
+func (p *Pepal) presences(w http.ResponseWriter, r *http.Request, u *user) {
+	if u.presences != "" {
+		writePage(w, u.presences)
+		return
+	}
+	writePage(w, presencesPage(u.courses))
+}
+
+func (p *Pepal) attendance(w http.ResponseWriter, u *user, courseID string) {
+	for _, course := range u.courses {
+		if course.ID == courseID {
+			writePage(w, attendancePage(course))
+			return
+		}
+	}
+	writePage(w, unknownCourse)
+}
+
+// upload validates the presence of an open course, as the button of its
+// attendance page does.
+func (p *Pepal) upload(w http.ResponseWriter, r *http.Request, u *user) {
+	for i := range u.courses {
+		course := &u.courses[i]
+		if course.ID != r.PostFormValue("seance_pk") {
+			continue
+		}
+		act := r.PostFormValue("act")
+		if (course.State == models.AttendanceOpen && act == actPresent) ||
+			(course.State == models.AttendanceLateOpen && act == actLate) {
+			course.State = models.AttendanceClosedPresent
+			if course.Validated != "" {
+				course.State = course.Validated
+			}
+			writePage(w, presenceSaved)
+			return
+		}
+	}
+	writePage(w, presenceRefused)
+}
+
+func (p *Pepal) notes(w http.ResponseWriter, r *http.Request, u *user) {
+	writePage(w, gradesPage(u.grades))
+}
+
+// calendar serves a calendar feed, answering conditional requests with 304
+// when it has not changed.
+func (p *Pepal) calendar(w http.ResponseWriter, r *http.Request, calUUID string) {
+	content, ok := p.calendars[calUUID]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	etag := `"` + hashContent(content) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("ETag", etag)
+	w.Write([]byte(content))
+}
+
+func writePage(w http.ResponseWriter, page string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(page))
+}
@@ -0,0 +1,58 @@
+package pepaltest
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestGzip checks that the responses with a body are gzip-encoded and that
+// the ones without, such as 304, are sent as they are.
+func TestGzip(t *testing.T) {
+	fake := New()
+	fake.Gzip = true
+	calendar := Calendar(Event{UID: "c1", Summary: "GOLANG"})
+	fake.SetCalendar("cal", calendar)
+
+	get := func(path, etag string) (*http.Response, string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		fake.ServeHTTP(w, r)
+		resp := w.Result()
+		body := io.Reader(resp.Body)
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+			body = gz
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return resp, string(data)
+	}
+
+	resp, body := get("/ical_student/cal", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" || body != calendar {
+		t.Errorf("calendar: status %d, encoding %q, body %q", resp.StatusCode, resp.Header.Get("Content-Encoding"), body)
+	}
+
+	resp, body = get("/ical_student/cal", resp.Header.Get("ETag"))
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("Content-Encoding") != "" || body != "" {
+		t.Errorf("unchanged calendar: status %d, encoding %q, body %q", resp.StatusCode, resp.Header.Get("Content-Encoding"), body)
+	}
+
+	resp, body = get("/unknown", "")
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(body, "not found") {
+		t.Errorf("unknown page: status %d, body %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"helper/v3/models"
+	"helper/v3/scheduler"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+var errSchedulerDisabled = huma.Error501NotImplemented("the presence scheduler is disabled on this server")
+
+// addSchedulerRoutes registers the endpoints enrolling the session user in
+// the presence scheduler and listing its records.
+func (a *app) addSchedulerRoutes(api huma.API) {
+	// Enrol in Scheduler
+	register(api, huma.Operation{
+		OperationID: "enrolScheduler",
+		Method:      http.MethodPost,
+		Path:        "/scheduler",
+		Summary:     "Enrol in Scheduler",
+		Description: "Mark the presence of the session user automatically as soon as the roll call of their courses opens. Requires stored credentials.",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+		Body  struct {
+			CalUUID string `json:"calUUID" pattern:"^[0-9a-fA-F]{32}$" example:"49caac7c643b4be6817db60be4374ee7" doc:"Calendar UUID"`
+		}
+	}) (*models.SchedulerOutput, error) {
+		if a.scheduler == nil {
+			return nil, errSchedulerDisabled
+		}
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		if !a.vault.Has(session.Username) {
+			return nil, huma.Error412PreconditionFailed("store your credentials with /credentials first")
+		}
+		enrolment, err := a.scheduler.Enrol(session.Username, input.Body.CalUUID)
+		if err != nil {
+			return nil, err
+		}
+		resp := &models.SchedulerOutput{}
+		resp.Body.CalUUID = enrolment.CalUUID
+		resp.Body.EnrolledAt = enrolment.CreatedAt
+		return resp, nil
+	})
+
+	// Get Scheduler Enrolment
+	register(api, huma.Operation{
+		OperationID: "getScheduler",
+		Method:      http.MethodGet,
+		Path:        "/scheduler",
+		Summary:     "Get Scheduler Enrolment",
+		Description: "Get the presence scheduler enrolment of the session user",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.SchedulerOutput, error) {
+		if a.scheduler == nil {
+			return nil, errSchedulerDisabled
+		}
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		enrolment, err := a.scheduler.Enrolment(session.Username)
+		if err != nil {
+			return nil, schedulerError(err)
+		}
+		resp := &models.SchedulerOutput{}
+		resp.Body.CalUUID = enrolment.CalUUID
+		resp.Body.EnrolledAt = enrolment.CreatedAt
+		return resp, nil
+	})
+
+	// Leave Scheduler
+	register(api, huma.Operation{
+		OperationID: "leaveScheduler",
+		Method:      http.MethodDelete,
+		Path:        "/scheduler",
+		Summary:     "Leave Scheduler",
+		Description: "Stop marking the presence of the session user automatically",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.GenericOutput, error) {
+		if a.scheduler == nil {
+			return nil, errSchedulerDisabled
+		}
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.scheduler.Unenrol(session.Username); err != nil {
+			return nil, schedulerError(err)
+		}
+		resp := &models.GenericOutput{}
+		resp.Body.Message = "Scheduler disabled"
+		return resp, nil
+	})
+
+	// Get Scheduler Records
+	register(api, huma.Operation{
+		OperationID: "getSchedulerRecords",
+		Method:      http.MethodGet,
+		Path:        "/scheduler/records",
+		Summary:     "Get Scheduler Records",
+		Description: "Get the presence attempts made by the scheduler for the session user",
+	}, func(ctx context.Context, input *struct {
+		Token string `header:"Authorization" example:"Bearer yoursessiontoken" doc:"Session token"`
+	}) (*models.SchedulerRecordsOutput, error) {
+		if a.scheduler == nil {
+			return nil, errSchedulerDisabled
+		}
+		session, err := a.session(input.Token)
+		if err != nil {
+			return nil, err
+		}
+		resp := &models.SchedulerRecordsOutput{}
+		resp.Body.Records = a.scheduler.Records(session.Username)
+		return resp, nil
+	})
+}
+
+func schedulerError(err error) error {
+	if errors.Is(err, scheduler.ErrNotEnrolled) {
+		return huma.Error404NotFound(err.Error())
+	}
+	return err
+}
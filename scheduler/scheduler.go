@@ -0,0 +1,532 @@
+// Package scheduler marks the presence of enrolled users automatically. It
+// polls Pepal only while one of the user's courses is running, according to
+// their calendar, and sets the presence as soon as the roll call opens.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"helper/v3/atomicfile"
+	"helper/v3/controllers"
+	"helper/v3/models"
+	"helper/v3/notify"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNotEnrolled is returned when a user is not enrolled in the scheduler.
+var ErrNotEnrolled = errors.New("user is not enrolled in the presence scheduler")
+
+// maxRecordsPerUser bounds the presence records kept for each user.
+const maxRecordsPerUser = 500
+
+// Result of a presence attempt.
+const (
+	ResultMarked         = "marked"
+	ResultAlreadyPresent = "already_present"
+	// ResultClosedAbsent: the roll call closed before the presence could be
+	// marked.
+	ResultClosedAbsent = "closed_absent"
+	ResultFailed       = "failed"
+	// ResultMissed: the roll call was not seen closed by the end of the day,
+	// and the course is counted as missed.
+	ResultMissed = "missed"
+)
+
+// Enrolment is a user whose presence is marked automatically.
+type Enrolment struct {
+	Username  string    `json:"username"`
+	CalUUID   string    `json:"cal_uuid"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Config tunes the polling.
+type Config struct {
+	// Interval is the delay between two polls.
+	Interval time.Duration
+	// Jitter is the maximum random delay added to or removed from Interval,
+	// so the users are not all polled at the same instant.
+	Jitter time.Duration
+	// Margin widens each course, before its start and after its end, into
+	// the span during which its roll call is polled.
+	Margin time.Duration
+}
+
+// DefaultConfig polls every minute, give or take 15 seconds, from half an
+// hour before each course to half an hour after it.
+var DefaultConfig = Config{
+	Interval: time.Minute,
+	Jitter:   15 * time.Second,
+	Margin:   30 * time.Minute,
+}
+
+// state is what the scheduler persists between restarts.
+type state struct {
+	Enrolments map[string]Enrolment               `json:"enrolments"`
+	Records    map[string][]models.PresenceRecord `json:"records"`
+	// Polled holds, for each user, the courses polled on their last day of
+	// courses, settled once the day is over.
+	Polled map[string]polledDay `json:"polled"`
+}
+
+// polledDay is the courses of a day polled for a user.
+type polledDay struct {
+	Day     string          `json:"day"`
+	Courses []models.Course `json:"courses"`
+}
+
+// schedule caches the calendar of a user for a day.
+type schedule struct {
+	day    string
+	events []models.Event
+}
+
+// Scheduler polls Pepal for the enrolled users. It is safe for concurrent use.
+type Scheduler struct {
+	// Notifier, when set, is told when a roll call opens and when a
+	// presence cannot be validated.
+	Notifier notify.Notifier
+
+	pepal  *controllers.PepalClient
+	logins *controllers.Logins
+	path   string
+	config Config
+
+	mu        sync.Mutex
+	state     state
+	schedules map[string]schedule
+	// opened holds the courses of the day whose opening was notified.
+	opened map[string]bool
+}
+
+// New returns a scheduler persisting its state at path, loading the state
+// left by a previous run if any.
+func New(pepal *controllers.PepalClient, login controllers.LoginFunc, path string, config Config) (*Scheduler, error) {
+	s := &Scheduler{
+		pepal:  pepal,
+		logins: controllers.NewLogins(login),
+		path:   path,
+		config: config,
+		state: state{
+			Enrolments: make(map[string]Enrolment),
+			Records:    make(map[string][]models.PresenceRecord),
+			Polled:     make(map[string]polledDay),
+		},
+		schedules: make(map[string]schedule),
+		opened:    make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading scheduler state: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("error decoding scheduler state: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// Enrol starts marking the presence of a user, whose courses are read from
+// the calendar calUUID.
+func (s *Scheduler) Enrol(username, calUUID string) (Enrolment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrolment := Enrolment{Username: username, CalUUID: calUUID, CreatedAt: time.Now()}
+	if previous, ok := s.state.Enrolments[username]; ok {
+		enrolment.CreatedAt = previous.CreatedAt
+	}
+	s.state.Enrolments[username] = enrolment
+	delete(s.schedules, username)
+	return enrolment, s.save()
+}
+
+// Unenrol stops marking the presence of a user. Their records are kept.
+func (s *Scheduler) Unenrol(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.state.Enrolments[username]; !ok {
+		return ErrNotEnrolled
+	}
+	delete(s.state.Enrolments, username)
+	delete(s.state.Polled, username)
+	s.logins.Forget(username)
+	delete(s.schedules, username)
+	return s.save()
+}
+
+// Enrolment returns the enrolment of a user.
+func (s *Scheduler) Enrolment(username string) (Enrolment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrolment, ok := s.state.Enrolments[username]
+	if !ok {
+		return Enrolment{}, ErrNotEnrolled
+	}
+	return enrolment, nil
+}
+
+// Records returns the presence records of a user, oldest first.
+func (s *Scheduler) Records(username string) []models.PresenceRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]models.PresenceRecord(nil), s.state.Records[username]...)
+}
+
+// Run polls until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	log.Info().Dur("interval", s.config.Interval).Msg("Presence scheduler started")
+	for {
+		timer := time.NewTimer(s.nextDelay())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Info().Msg("Presence scheduler stopped")
+			return
+		case <-timer.C:
+		}
+		s.pollAll(ctx)
+	}
+}
+
+// nextDelay returns the polling interval with its random jitter applied.
+func (s *Scheduler) nextDelay() time.Duration {
+	delay := s.config.Interval
+	if s.config.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*s.config.Jitter))) - s.config.Jitter
+	}
+	if delay <= 0 {
+		delay = time.Second
+	}
+	return delay
+}
+
+// pollAll polls every enrolled user concurrently.
+func (s *Scheduler) pollAll(ctx context.Context) {
+	s.mu.Lock()
+	enrolments := make([]Enrolment, 0, len(s.state.Enrolments))
+	for _, enrolment := range s.state.Enrolments {
+		enrolments = append(enrolments, enrolment)
+	}
+	s.mu.Unlock()
+
+	now := time.Now().In(s.pepal.Location)
+	s.settle(now)
+
+	var wg sync.WaitGroup
+	for _, enrolment := range enrolments {
+		wg.Add(1)
+		go func(enrolment Enrolment) {
+			defer wg.Done()
+			if err := s.poll(ctx, enrolment, now); err != nil {
+				log.Error().Err(err).Str("username", enrolment.Username).Msg("Presence scheduler poll failed")
+			}
+		}(enrolment)
+	}
+	wg.Wait()
+}
+
+// poll marks the presence of a user for the running courses whose roll call
+// is open.
+func (s *Scheduler) poll(ctx context.Context, enrolment Enrolment, now time.Time) error {
+	events, err := s.todayEvents(ctx, enrolment, now)
+	if err != nil {
+		return err
+	}
+
+	if !s.polling(events, now) {
+		return nil
+	}
+
+	auth := s.logins.Auth(enrolment.Username)
+	// A single snapshot loads each Pepal page at most once during the poll
+	snapshot := s.pepal.Snapshot(auth)
+	defer func() { s.rememberCookie(auth) }()
+	courses, err := snapshot.Courses(ctx)
+	if err != nil {
+		return err
+	}
+
+	day := now.Format("2006-01-02")
+	for _, course := range courses {
+		if !s.running(course.Start, course.End, now) {
+			continue
+		}
+		s.track(enrolment.Username, day, course)
+		if s.done(enrolment.Username, day, course.ID) {
+			continue
+		}
+
+		_, status, err := snapshot.Attendance(ctx, course.ID)
+		if err != nil {
+			return err
+		}
+
+		switch status.State {
+		case models.AttendanceClosedPresent:
+			s.record(enrolment.Username, day, course, ResultAlreadyPresent, nil)
+		case models.AttendanceClosedAbsent:
+			log.Warn().Str("username", enrolment.Username).Str("course", course.Name).Msg("Roll call closed without presence")
+			s.record(enrolment.Username, day, course, ResultClosedAbsent, nil)
+		case models.AttendanceOpen, models.AttendanceLateOpen:
+			s.notifyOpen(enrolment.Username, day, course, status.State)
+		}
+
+		if status.State == models.AttendanceOpen {
+			_, _, err := snapshot.SetPresence(ctx, course.ID, false)
+			if err != nil {
+				if s.record(enrolment.Username, day, course, ResultFailed, err) {
+					s.notify(notify.Notification{
+						Kind:     notify.KindPresenceFailed,
+						Username: enrolment.Username,
+						Title:    "Échec de la validation de présence en " + course.Name,
+						Message:  "La présence n'a pas pu être validée automatiquement (" + err.Error() + "). Validez-la sur Pepal.",
+						Data:     course,
+					})
+				}
+			} else {
+				log.Info().Str("username", enrolment.Username).Str("course", course.Name).Msg("Presence marked")
+				s.record(enrolment.Username, day, course, ResultMarked, nil)
+			}
+		}
+	}
+	return nil
+}
+
+// todayEvents returns the calendar events of the day, fetching the calendar
+// once per day and user.
+func (s *Scheduler) todayEvents(ctx context.Context, enrolment Enrolment, now time.Time) ([]models.Event, error) {
+	day := now.Format("2006-01-02")
+
+	s.mu.Lock()
+	cached, ok := s.schedules[enrolment.Username]
+	s.mu.Unlock()
+	if ok && cached.day == day {
+		return cached.events, nil
+	}
+
+	weekly, err := s.pepal.FetchAndParseCalendar(ctx, enrolment.CalUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []models.Event
+	for _, event := range weekly {
+		if event.Day == day {
+			events = append(events, event)
+		}
+	}
+
+	s.mu.Lock()
+	s.schedules[enrolment.Username] = schedule{day: day, events: events}
+	s.mu.Unlock()
+	return events, nil
+}
+
+// polling reports whether one of the courses of the calendar is running at
+// now, margin included, so Pepal is only polled around the courses.
+func (s *Scheduler) polling(events []models.Event, now time.Time) bool {
+	for _, event := range events {
+		if event.Type != models.EventCompany && s.running(event.Start, event.End, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// running reports whether now is between start and end, widened by the
+// margin. A course without times, as Pepal shows some, is always running.
+func (s *Scheduler) running(start, end, now time.Time) bool {
+	if start.IsZero() || end.IsZero() {
+		return true
+	}
+	return !now.Before(start.Add(-s.config.Margin)) && now.Before(end.Add(s.config.Margin))
+}
+
+// rememberCookie keeps the cookie of a user for the next poll, unless they
+// were unenrolled meanwhile.
+func (s *Scheduler) rememberCookie(auth *controllers.Auth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Enrolments[auth.Username]; ok {
+		s.logins.Remember(auth)
+	}
+}
+
+// done reports whether the presence of a user for a course has already been
+// settled, so the course is not polled again.
+func (s *Scheduler) done(username, day, courseID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settled(username, day, courseID)
+}
+
+// settled is done for a caller holding s.mu.
+func (s *Scheduler) settled(username, day, courseID string) bool {
+	for _, record := range s.state.Records[username] {
+		if record.Day == day && record.CourseID == courseID && record.Result != ResultFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// track adds a course to the courses of the day polled for a user.
+func (s *Scheduler) track(username, day string, course models.Course) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	polled := s.state.Polled[username]
+	if polled.Day != day {
+		polled = polledDay{Day: day}
+	}
+	for _, known := range polled.Courses {
+		if known.ID == course.ID {
+			return
+		}
+	}
+	polled.Courses = append(polled.Courses, course)
+	s.state.Polled[username] = polled
+	s.saveOrLog()
+}
+
+// settle counts as missed the courses polled on a past day whose roll call
+// was not seen closed, so the absence statistics do not only count the
+// absences observed on Pepal.
+func (s *Scheduler) settle(now time.Time) {
+	today := now.Format("2006-01-02")
+	type course struct {
+		username, day string
+		course        models.Course
+	}
+	var missed []course
+
+	s.mu.Lock()
+	changed := false
+	for username, polled := range s.state.Polled {
+		if polled.Day >= today {
+			continue
+		}
+		delete(s.state.Polled, username)
+		changed = true
+		for _, c := range polled.Courses {
+			if !s.settled(username, polled.Day, c.ID) {
+				missed = append(missed, course{username, polled.Day, c})
+			}
+		}
+	}
+	if changed {
+		s.saveOrLog()
+	}
+	s.mu.Unlock()
+
+	for _, m := range missed {
+		log.Warn().Str("username", m.username).Str("day", m.day).Str("course", m.course.Name).Msg("Roll call not seen closed, course counted as missed")
+		s.record(m.username, m.day, m.course, ResultMissed, nil)
+		if s.pepal.History != nil {
+			s.pepal.History.RecordMissed(m.username, m.day, m.course, now)
+		}
+	}
+}
+
+// notifyOpen tells a user that the roll call of a course opened, once per
+// course and day.
+func (s *Scheduler) notifyOpen(username, day string, course models.Course, state models.AttendanceState) {
+	key := username + "\x00" + day + "\x00" + course.ID
+	s.mu.Lock()
+	if s.opened[key] {
+		s.mu.Unlock()
+		return
+	}
+	for k := range s.opened {
+		if !strings.Contains(k, "\x00"+day+"\x00") {
+			delete(s.opened, k)
+		}
+	}
+	s.opened[key] = true
+	s.mu.Unlock()
+
+	n := notify.Notification{
+		Kind:     notify.KindAttendanceOpen,
+		Username: username,
+		Title:    "L'appel est ouvert en " + course.Name,
+		Message:  "L'appel est ouvert, la présence va être validée automatiquement.",
+		Data:     course,
+	}
+	if state == models.AttendanceLateOpen {
+		n.Message = "Seule la présence en retard peut encore être validée, sur Pepal ou avec allowLate."
+	}
+	s.notify(n)
+}
+
+func (s *Scheduler) notify(n notify.Notification) {
+	if s.Notifier != nil {
+		s.Notifier.Notify(n)
+	}
+}
+
+// record stores the outcome of a presence attempt. It reports whether a new
+// record was added, a repeated failure only updating the previous one.
+func (s *Scheduler) record(username, day string, course models.Course, result string, err error) bool {
+	record := models.PresenceRecord{
+		Username:   username,
+		Day:        day,
+		CourseID:   course.ID,
+		CourseName: course.Name,
+		Result:     result,
+		At:         time.Now(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := s.state.Records[username]
+	if n := len(records); n > 0 && result == ResultFailed {
+		// Keep a single failure per course and day while retrying
+		last := &records[n-1]
+		if last.Day == day && last.CourseID == course.ID && last.Result == ResultFailed {
+			last.Error = record.Error
+			last.At = record.At
+			s.saveOrLog()
+			return false
+		}
+	}
+	records = append(records, record)
+	if len(records) > maxRecordsPerUser {
+		records = records[len(records)-maxRecordsPerUser:]
+	}
+	s.state.Records[username] = records
+	s.saveOrLog()
+	return true
+}
+
+// saveOrLog saves the state, logging failures. The caller must hold s.mu.
+func (s *Scheduler) saveOrLog() {
+	if err := s.save(); err != nil {
+		log.Error().Err(err).Msg("Error saving scheduler state")
+	}
+}
+
+// save writes the state to disk. The caller must hold s.mu.
+func (s *Scheduler) save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(s.path, data, 0o700); err != nil {
+		return fmt.Errorf("error writing scheduler state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package scheduler
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"helper/v3/controllers"
+	"helper/v3/models"
+	"helper/v3/pepaltest"
+)
+
+const (
+	testUser     = "jdoe"
+	testPassword = "s3cret"
+	testCalendar = "49caac7c643b4be6817db60be4374ee7"
+)
+
+// newTestScheduler returns a scheduler against a fake Pepal holding the test
+// user, enrolled with testCalendar.
+func newTestScheduler(t *testing.T) (*Scheduler, *pepaltest.Server) {
+	t.Helper()
+	fake := pepaltest.NewServer()
+	t.Cleanup(fake.Close)
+	fake.AddUser(testUser, testPassword)
+
+	pepal := controllers.NewPepalClient(fake.URL, fake.Client())
+	login := func(ctx context.Context, username string) (string, error) {
+		cookie, err := pepal.Login(ctx, username, testPassword)
+		if err != nil {
+			return "", err
+		}
+		return cookie.Value, nil
+	}
+	s, err := New(pepal, login, filepath.Join(t.TempDir(), "scheduler.json"), DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Enrol(testUser, testCalendar); err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func TestPolling(t *testing.T) {
+	s, _ := newTestScheduler(t)
+	day := time.Date(2024, 6, 13, 0, 0, 0, 0, s.pepal.Location)
+	at := func(hour, minute int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+	course := func(start, end time.Time) models.Event {
+		return models.Event{Type: models.EventCourse, Start: start, End: end}
+	}
+	morning := course(at(9, 0), at(12, 0))
+	afternoon := course(at(13, 30), at(17, 30))
+	company := models.Event{Type: models.EventCompany, FullDay: true, Start: day, End: day.AddDate(0, 0, 1)}
+
+	for name, test := range map[string]struct {
+		events []models.Event
+		margin time.Duration
+		now    time.Time
+		want   bool
+	}{
+		"before the margin":             {[]models.Event{morning}, 30 * time.Minute, at(8, 29), false},
+		"margin before the course":      {[]models.Event{morning}, 30 * time.Minute, at(8, 30), true},
+		"during the course":             {[]models.Event{morning}, 30 * time.Minute, at(11, 0), true},
+		"margin after the course":       {[]models.Event{morning}, 30 * time.Minute, at(12, 29), true},
+		"after the margin":              {[]models.Event{morning}, 30 * time.Minute, at(12, 30), false},
+		"between two courses":           {[]models.Event{morning, afternoon}, 30 * time.Minute, at(12, 45), false},
+		"afternoon course":              {[]models.Event{morning, afternoon}, 30 * time.Minute, at(13, 0), true},
+		"narrower margin":               {[]models.Event{morning}, 10 * time.Minute, at(8, 45), false},
+		"narrower margin opens":         {[]models.Event{morning}, 10 * time.Minute, at(8, 50), true},
+		"without margin":                {[]models.Event{morning}, 0, at(12, 0), false},
+		"company day":                   {[]models.Event{company}, 30 * time.Minute, at(9, 0), false},
+		"company day and morning class": {[]models.Event{company, morning}, 30 * time.Minute, at(9, 0), true},
+		"no event":                      {nil, 30 * time.Minute, at(9, 0), false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s.config.Margin = test.margin
+			if got := s.polling(test.events, test.now); got != test.want {
+				t.Errorf("polling = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Pepal does not always show the times of a course: it is then polled
+	// whenever the calendar is
+	if !s.running(time.Time{}, time.Time{}, at(15, 0)) {
+		t.Error("a course without times is not polled")
+	}
+}
+
+// setMorningCourses gives the test user a morning class on the calendar, and
+// courses of the day in every roll call state on Pepal. It returns a time
+// during the morning class.
+func setMorningCourses(s *Scheduler, fake *pepaltest.Server) time.Time {
+	now := time.Now().In(s.pepal.Location)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.pepal.Location)
+	pollAt := day.Add(10 * time.Hour)
+	fake.SetCalendar(testCalendar, pepaltest.Calendar(pepaltest.Event{
+		UID: "c1", Summary: "GOLANG", Location: "E 210", Professor: "John DOE",
+		Start: day.Add(9 * time.Hour), End: day.Add(12 * time.Hour),
+	}))
+	fake.SetCourses(testUser,
+		pepaltest.Course{ID: "open", Name: "GOLANG", Time: "09:00-12:00", State: models.AttendanceOpen},
+		pepaltest.Course{ID: "present", Name: "SQL", Time: "09:00-12:00", State: models.AttendanceClosedPresent},
+		pepaltest.Course{ID: "absent", Name: "Anglais", Time: "09:00-12:00", State: models.AttendanceClosedAbsent},
+		pepaltest.Course{ID: "later", Name: "Réseaux", Time: "09:00-12:00", State: models.AttendanceNotYetOpen},
+		pepaltest.Course{ID: "late", Name: "Projet", Time: "09:00-12:00", State: models.AttendanceLateOpen},
+		pepaltest.Course{ID: "afternoon", Name: "Java", Time: "14:00-17:00", State: models.AttendanceOpen},
+	)
+	return pollAt
+}
+
+// TestPollRecordsEachCourseOnce polls the morning courses of the day in
+// every roll call state, and checks that the settled ones are not polled
+// again.
+func TestPollRecordsEachCourseOnce(t *testing.T) {
+	s, fake := newTestScheduler(t)
+	pollAt := setMorningCourses(s, fake)
+
+	enrolment, err := s.Enrolment(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.poll(context.Background(), enrolment, pollAt); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(map[string]string)
+	for _, record := range s.Records(testUser) {
+		results[record.CourseID] = record.Result
+	}
+	want := map[string]string{"open": ResultMarked, "present": ResultAlreadyPresent, "absent": ResultClosedAbsent}
+	if len(results) != len(want) {
+		t.Errorf("records = %+v, want %+v", results, want)
+	}
+	for courseID, result := range want {
+		if results[courseID] != result {
+			t.Errorf("%s: result = %q, want %q", courseID, results[courseID], result)
+		}
+	}
+	if state := fake.CourseState(testUser, "open"); state != models.AttendanceClosedPresent {
+		t.Errorf("open course state = %s after the poll", state)
+	}
+	if state := fake.CourseState(testUser, "late"); state != models.AttendanceLateOpen {
+		t.Errorf("late course state = %s, the scheduler validated a late presence", state)
+	}
+
+	// The next poll only reads the roll calls still pending
+	fake.ResetRequests()
+	if err := s.poll(context.Background(), enrolment, pollAt.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	var read []string
+	for _, request := range fake.Requests() {
+		if courseID, ok := strings.CutPrefix(request, "GET /presences/s/"); ok {
+			read = append(read, courseID)
+		}
+	}
+	if strings.Join(read, ",") != "later,late" {
+		t.Errorf("attendance pages read = %v, want later and late", read)
+	}
+	if records := s.Records(testUser); len(records) != 3 {
+		t.Errorf("records after the second poll = %+v", records)
+	}
+}
+
+func TestRecordKeepsOneFailurePerCourse(t *testing.T) {
+	s, _ := newTestScheduler(t)
+	course := models.Course{ID: "c1", Name: "GOLANG"}
+	errFailed := &controllers.Error{Code: controllers.CodeParseFailure, Message: "presence not marked successfully"}
+
+	if !s.record(testUser, "2024-06-13", course, ResultFailed, errFailed) {
+		t.Error("the first failure was not added")
+	}
+	if s.record(testUser, "2024-06-13", course, ResultFailed, errFailed) {
+		t.Error("a repeated failure was added")
+	}
+	if s.done(testUser, "2024-06-13", course.ID) {
+		t.Error("a failed course is done")
+	}
+	if !s.record(testUser, "2024-06-13", course, ResultMarked, nil) || !s.done(testUser, "2024-06-13", course.ID) {
+		t.Error("a marked course is not done")
+	}
+	if s.done(testUser, "2024-06-14", course.ID) {
+		t.Error("a course marked on another day is done")
+	}
+	if records := s.Records(testUser); len(records) != 2 {
+		t.Errorf("records = %+v", records)
+	}
+}
+
+// missedRecorder keeps the courses counted as missed.
+type missedRecorder struct {
+	missed []string
+}
+
+func (r *missedRecorder) RecordAttendance(username, day string, course models.Course, outcome models.AttendanceOutcome, at time.Time) {
+}
+
+func (r *missedRecorder) RecordMissed(username, day string, course models.Course, at time.Time) {
+	r.missed = append(r.missed, course.ID)
+}
+
+// TestSettleCountsUnresolvedCoursesAsMissed checks that the polled courses
+// whose roll call was not seen closed are counted as missed once the day is
+// over, and only then.
+func TestSettleCountsUnresolvedCoursesAsMissed(t *testing.T) {
+	s, fake := newTestScheduler(t)
+	recorder := &missedRecorder{}
+	s.pepal.History = recorder
+	pollAt := setMorningCourses(s, fake)
+
+	enrolment, err := s.Enrolment(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.poll(context.Background(), enrolment, pollAt); err != nil {
+		t.Fatal(err)
+	}
+	s.settle(pollAt.Add(8 * time.Hour))
+	if len(recorder.missed) != 0 {
+		t.Errorf("courses missed before the end of the day: %v", recorder.missed)
+	}
+
+	// The afternoon course was never polled: it is not the scheduler's
+	s.settle(pollAt.Add(24 * time.Hour))
+	if strings.Join(recorder.missed, ",") != "later,late" {
+		t.Errorf("courses missed = %v, want later and late", recorder.missed)
+	}
+	results := make(map[string]string)
+	for _, record := range s.Records(testUser) {
+		results[record.CourseID] = record.Result
+	}
+	if results["later"] != ResultMissed || results["late"] != ResultMissed || results["open"] != ResultMarked {
+		t.Errorf("results = %+v", results)
+	}
+
+	s.settle(pollAt.Add(48 * time.Hour))
+	if len(recorder.missed) != 2 {
+		t.Errorf("courses counted as missed twice: %v", recorder.missed)
+	}
+}
@@ -0,0 +1,172 @@
+// Package sessions keeps the Pepal cookies of logged in users on the server
+// and hands out opaque signed tokens in their place.
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is returned when a token is malformed, badly signed, revoked
+// or expired.
+var ErrInvalidToken = errors.New("invalid or expired session token")
+
+// Session is the server-side state behind a token.
+type Session struct {
+	ID        string
+	Username  string
+	Cookie    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Store holds the sessions in memory. It is safe for concurrent use.
+type Store struct {
+	mu       sync.Mutex
+	secret   []byte
+	ttl      time.Duration
+	sessions map[string]*Session
+}
+
+// NewStore returns a store signing its tokens with secret. Sessions last ttl,
+// or less when Pepal gives the cookie an earlier expiry.
+func NewStore(secret []byte, ttl time.Duration) *Store {
+	return &Store{
+		secret:   secret,
+		ttl:      ttl,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// NewSecret returns a random signing secret, for when none is configured.
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Create stores a session for the Pepal cookie and returns its token.
+// cookieExpires is the expiry announced by Pepal, zero if none. A renewable
+// session, whose user has stored credentials, outlives its cookie.
+func (s *Store) Create(username, cookie string, cookieExpires time.Time, renewable bool) (string, Session, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", Session{}, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	expiresAt := now.Add(s.ttl)
+	if !renewable && !cookieExpires.IsZero() && cookieExpires.Before(expiresAt) {
+		expiresAt = cookieExpires
+	}
+
+	session := &Session{
+		ID:        id,
+		Username:  username,
+		Cookie:    cookie,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	s.sessions[id] = session
+
+	return id + "." + s.sign(id), *session, nil
+}
+
+// Resolve returns the session behind a token.
+func (s *Store) Resolve(token string) (Session, error) {
+	id, err := s.verify(token)
+	if err != nil {
+		return Session{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, ErrInvalidToken
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(s.sessions, id)
+		return Session{}, ErrInvalidToken
+	}
+	return *session, nil
+}
+
+// UpdateCookie replaces the Pepal cookie of a session after a re-login.
+func (s *Store) UpdateCookie(id, cookie string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return ErrInvalidToken
+	}
+	session.Cookie = cookie
+	return nil
+}
+
+// Revoke deletes the session behind a token.
+func (s *Store) Revoke(token string) error {
+	id, err := s.verify(token)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		return ErrInvalidToken
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+// RevokeUser deletes every session of a Pepal user and returns how many there were.
+func (s *Store) RevokeUser(username string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for id, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, id)
+			count++
+		}
+	}
+	return count
+}
+
+// verify checks the token signature and returns the session ID it carries.
+func (s *Store) verify(token string) (string, error) {
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(id))) {
+		return "", ErrInvalidToken
+	}
+	return id, nil
+}
+
+func (s *Store) sign(id string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// prune drops the expired sessions. The caller must hold s.mu.
+func (s *Store) prune(now time.Time) {
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+}
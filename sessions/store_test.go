@@ -0,0 +1,142 @@
+package sessions
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore() *Store {
+	return NewStore([]byte("0123456789abcdef0123456789abcdef"), time.Hour)
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := newTestStore()
+	token, created, err := s.Create("jdoe", "cookie-1", time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(token, "cookie-1") {
+		t.Error("the token carries the Pepal cookie")
+	}
+
+	session, err := s.Resolve(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ID != created.ID || session.Username != "jdoe" || session.Cookie != "cookie-1" {
+		t.Errorf("session = %+v", session)
+	}
+
+	if err := s.UpdateCookie(session.ID, "cookie-2"); err != nil {
+		t.Fatal(err)
+	}
+	if session, err = s.Resolve(token); err != nil || session.Cookie != "cookie-2" {
+		t.Errorf("cookie after the update = %q, %v", session.Cookie, err)
+	}
+
+	if err := s.Revoke(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Resolve(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Resolve after Revoke: err = %v", err)
+	}
+	if err := s.Revoke(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("second Revoke: err = %v", err)
+	}
+}
+
+func TestTamperedToken(t *testing.T) {
+	s := newTestStore()
+	token, _, err := s.Create("jdoe", "cookie", time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, signature, _ := strings.Cut(token, ".")
+	other, _, err := s.Create("jroe", "cookie", time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, _, _ := strings.Cut(other, ".")
+
+	forged := NewStore([]byte("another secret"), time.Hour)
+	for name, token := range map[string]string{
+		"empty":             "",
+		"no signature":      id,
+		"empty signature":   id + ".",
+		"changed signature": id + "." + strings.ToUpper(signature),
+		"swapped id":        otherID + "." + signature,
+		"other secret":      id + "." + forged.sign(id),
+	} {
+		if _, err := s.Resolve(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: Resolve err = %v, want ErrInvalidToken", name, err)
+		}
+		if err := s.Revoke(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: Revoke err = %v, want ErrInvalidToken", name, err)
+		}
+	}
+	if _, err := s.Resolve(token); err != nil {
+		t.Errorf("the session was revoked by a tampered token: %v", err)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	s := newTestStore()
+	token, session, err := s.Create("jdoe", "cookie", time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sessions[session.ID].ExpiresAt = time.Now().Add(-time.Second)
+	if _, err := s.Resolve(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Resolve of an expired session: err = %v", err)
+	}
+	if _, ok := s.sessions[session.ID]; ok {
+		t.Error("the expired session was kept")
+	}
+}
+
+// TestCookieExpiry checks that a session does not outlive its Pepal cookie,
+// unless it is renewable.
+func TestCookieExpiry(t *testing.T) {
+	s := newTestStore()
+	cookieExpires := time.Now().Add(10 * time.Minute)
+
+	_, session, err := s.Create("jdoe", "cookie", cookieExpires, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.ExpiresAt.Equal(cookieExpires) {
+		t.Errorf("expiry = %v, want the cookie one %v", session.ExpiresAt, cookieExpires)
+	}
+
+	_, session, err = s.Create("jdoe", "cookie", cookieExpires, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.ExpiresAt.After(cookieExpires) {
+		t.Errorf("renewable session expiry = %v, before the ttl", session.ExpiresAt)
+	}
+}
+
+func TestRevokeUser(t *testing.T) {
+	s := newTestStore()
+	var tokens []string
+	for _, username := range []string{"jdoe", "jdoe", "jroe"} {
+		token, _, err := s.Create(username, "cookie", time.Time{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	if n := s.RevokeUser("jdoe"); n != 2 {
+		t.Errorf("revoked %d sessions, want 2", n)
+	}
+	for i, token := range tokens {
+		_, err := s.Resolve(token)
+		if revoked := i < 2; revoked != errors.Is(err, ErrInvalidToken) {
+			t.Errorf("token %d: Resolve err = %v", i, err)
+		}
+	}
+}
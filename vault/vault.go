@@ -0,0 +1,248 @@
+// Package vault stores the Pepal credentials of opted-in users, encrypted at
+// rest with AES-256-GCM under keys taken from the configuration.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"helper/v3/atomicfile"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when no credentials are stored for a user.
+var ErrNotFound = errors.New("no stored credentials for this user")
+
+// Keyring holds the encryption keys by ID. The active key encrypts new
+// records; the others are only kept to decrypt records written before a
+// rotation.
+type Keyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// ParseKeyring parses a comma-separated list of "id:base64key" pairs, such as
+// the VAULT_KEYS setting. The first key is the active one and every key must
+// decode to 32 bytes.
+func ParseKeyring(spec string) (*Keyring, error) {
+	keyring := &Keyring{keys: make(map[string][]byte)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid vault key %q: expected id:base64key", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vault key %q: %v", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid vault key %q: expected 32 bytes, got %d", id, len(key))
+		}
+		if _, ok := keyring.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate vault key %q", id)
+		}
+		if keyring.active == "" {
+			keyring.active = id
+		}
+		keyring.keys[id] = key
+	}
+
+	if keyring.active == "" {
+		return nil, errors.New("no vault key configured")
+	}
+	return keyring, nil
+}
+
+// record is an encrypted password as stored on disk.
+type record struct {
+	KeyID      string    `json:"key_id"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Vault maps Pepal usernames to their encrypted passwords. It is safe for
+// concurrent use.
+type Vault struct {
+	mu      sync.Mutex
+	path    string
+	keyring *Keyring
+	records map[string]record
+}
+
+// Open loads the vault stored at path, creating it on the first write, and
+// re-encrypts under the active key every record written with an older one.
+func Open(path string, keyring *Keyring) (*Vault, error) {
+	v := &Vault{
+		path:    path,
+		keyring: keyring,
+		records: make(map[string]record),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading vault: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &v.records); err != nil {
+			return nil, fmt.Errorf("error decoding vault: %v", err)
+		}
+	}
+
+	if err := v.rekey(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Put stores or replaces the password of a user.
+func (v *Vault) Put(username, password string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	rec, err := v.seal(username, password)
+	if err != nil {
+		return err
+	}
+	if previous, ok := v.records[username]; ok {
+		rec.CreatedAt = previous.CreatedAt
+	}
+	v.records[username] = rec
+	return v.save()
+}
+
+// Get returns the password of a user.
+func (v *Vault) Get(username string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	rec, ok := v.records[username]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v.open(username, rec)
+}
+
+// Has reports whether credentials are stored for a user.
+func (v *Vault) Has(username string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, ok := v.records[username]
+	return ok
+}
+
+// Delete removes the credentials of a user.
+func (v *Vault) Delete(username string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.records[username]; !ok {
+		return ErrNotFound
+	}
+	delete(v.records, username)
+	return v.save()
+}
+
+// rekey re-encrypts the records that are not under the active key.
+func (v *Vault) rekey() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	changed := false
+	for username, rec := range v.records {
+		if rec.KeyID == v.keyring.active {
+			continue
+		}
+		password, err := v.open(username, rec)
+		if err != nil {
+			return err
+		}
+		rekeyed, err := v.seal(username, password)
+		if err != nil {
+			return err
+		}
+		rekeyed.CreatedAt = rec.CreatedAt
+		rekeyed.UpdatedAt = rec.UpdatedAt
+		v.records[username] = rekeyed
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return v.save()
+}
+
+// seal encrypts a password under the active key. The username is bound to the
+// ciphertext as additional data, so records cannot be swapped between users.
+func (v *Vault) seal(username, password string) (record, error) {
+	aead, err := newAEAD(v.keyring.keys[v.keyring.active])
+	if err != nil {
+		return record{}, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return record{}, err
+	}
+
+	now := time.Now()
+	return record{
+		KeyID:      v.keyring.active,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, []byte(password), []byte(username)),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}, nil
+}
+
+// open decrypts a record with the key it was written with.
+func (v *Vault) open(username string, rec record) (string, error) {
+	key, ok := v.keyring.keys[rec.KeyID]
+	if !ok {
+		return "", fmt.Errorf("vault key %q is not configured", rec.KeyID)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	password, err := aead.Open(nil, rec.Nonce, rec.Ciphertext, []byte(username))
+	if err != nil {
+		return "", fmt.Errorf("error decrypting credentials of %q: %v", username, err)
+	}
+	return string(password), nil
+}
+
+// save writes the records to disk. The caller must hold v.mu.
+func (v *Vault) save() error {
+	data, err := json.MarshalIndent(v.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(v.path, data, 0o700); err != nil {
+		return fmt.Errorf("error writing vault: %v", err)
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,161 @@
+package vault
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKey returns a key spec whose 32 bytes are all b.
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), 32)))
+}
+
+func openVault(t *testing.T, path, keys string) *Vault {
+	t.Helper()
+	keyring, err := ParseKeyring(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Open(path, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestParseKeyring(t *testing.T) {
+	for name, spec := range map[string]string{
+		"empty":     " , ",
+		"no id":     ":" + base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"not b64":   "k1:not base64!",
+		"short key": "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16)),
+		"duplicate": testKey("k1", 'a') + "," + testKey("k1", 'b'),
+	} {
+		if _, err := ParseKeyring(spec); err == nil {
+			t.Errorf("%s: keyring %q accepted", name, spec)
+		}
+	}
+
+	keyring, err := ParseKeyring(testKey("k2", 'b') + ", " + testKey("k1", 'a'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.active != "k2" || len(keyring.keys) != 2 {
+		t.Errorf("keyring = %q with %d keys, want k2 with 2", keyring.active, len(keyring.keys))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	v := openVault(t, path, testKey("k1", 'a'))
+
+	if _, err := v.Get("jdoe"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get before Put: err = %v, want ErrNotFound", err)
+	}
+	if err := v.Put("jdoe", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Put("jroe", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Put("jdoe", "n3w"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The passwords survive a reopening, and are not stored in clear
+	v = openVault(t, path, testKey("k1", 'a'))
+	for username, want := range map[string]string{"jdoe": "n3w", "jroe": "hunter2"} {
+		if password, err := v.Get(username); err != nil || password != want {
+			t.Errorf("Get(%s) = %q, %v, want %q", username, password, err, want)
+		}
+		if ciphertext := string(v.records[username].Ciphertext); strings.Contains(ciphertext, want) {
+			t.Errorf("the password of %s is stored in clear", username)
+		}
+	}
+	if !v.Has("jdoe") || !v.Has("jroe") {
+		t.Error("stored credentials not found")
+	}
+
+	if err := v.Delete("jdoe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Delete("jdoe"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete: err = %v, want ErrNotFound", err)
+	}
+	v = openVault(t, path, testKey("k1", 'a'))
+	if v.Has("jdoe") {
+		t.Error("deleted credentials came back after a reopening")
+	}
+}
+
+// TestRecordOfAnotherUser checks that the username is bound to its record, so
+// a record copied to another user does not decrypt.
+func TestRecordOfAnotherUser(t *testing.T) {
+	v := openVault(t, filepath.Join(t.TempDir(), "vault.json"), testKey("k1", 'a'))
+	if err := v.Put("jdoe", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	v.records["mallory"] = v.records["jdoe"]
+	if password, err := v.Get("mallory"); err == nil {
+		t.Errorf("the record of jdoe decrypted as mallory: %q", password)
+	}
+}
+
+func TestTamperedRecord(t *testing.T) {
+	v := openVault(t, filepath.Join(t.TempDir(), "vault.json"), testKey("k1", 'a'))
+	if err := v.Put("jdoe", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	rec := v.records["jdoe"]
+	rec.Ciphertext = append([]byte(nil), rec.Ciphertext...)
+	rec.Ciphertext[0] ^= 1
+	v.records["jdoe"] = rec
+	if _, err := v.Get("jdoe"); err == nil {
+		t.Error("a tampered record decrypted")
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	v := openVault(t, path, testKey("k1", 'a'))
+	if err := v.Put("jdoe", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key of the records was removed from the configuration
+	keyring, err := ParseKeyring(testKey("k2", 'b'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, keyring); err == nil || !strings.Contains(err.Error(), `"k1"`) {
+		t.Errorf("Open without the key of the records: err = %v", err)
+	}
+}
+
+// TestRotation checks that opening the vault with a new active key
+// re-encrypts the records under it, so the old key can then be removed.
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	v := openVault(t, path, testKey("k1", 'a'))
+	if err := v.Put("jdoe", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	created := v.records["jdoe"].CreatedAt
+
+	v = openVault(t, path, testKey("k2", 'b')+","+testKey("k1", 'a'))
+	rec := v.records["jdoe"]
+	if rec.KeyID != "k2" {
+		t.Errorf("record key after the rotation = %q, want k2", rec.KeyID)
+	}
+	if !rec.CreatedAt.Equal(created) {
+		t.Errorf("creation date changed by the rotation: %v, want %v", rec.CreatedAt, created)
+	}
+
+	v = openVault(t, path, testKey("k2", 'b'))
+	if password, err := v.Get("jdoe"); err != nil || password != "s3cret" {
+		t.Errorf("Get after removing the old key = %q, %v", password, err)
+	}
+}